@@ -87,7 +87,7 @@ const (
 var (
 	genAllTypesSamePkgErr  = errors.New("All types must be in the same package")
 	genExpectArrayOrMapErr = errors.New("unexpected type. Expecting array/map/slice")
-	genBase64enc           = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789__")
+	genBase64enc           = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_$")
 	genQNameRegex          = regexp.MustCompile(`[A-Za-z_.]+`)
 )
 
@@ -1468,6 +1468,13 @@ func genCustomTypeName(tstr string) string {
 			break
 		}
 	}
+	// the alphabet needs 64 distinct symbols; fold '$' back to '_' so
+	// the result stays a valid identifier.
+	for i := 0; i < len2; i++ {
+		if bufx[i] == '$' {
+			bufx[i] = '_'
+		}
+	}
 	return string(bufx[:len2])
 }
 
@@ -733,8 +733,12 @@ func (d *jsonDecDriver) DecodeBytes(bs []byte, isstring, zerocopy bool) (bsOut [
 	} else {
 		bsOut = make([]byte, slen)
 	}
-	base64.StdEncoding.Decode(bsOut, bs0)
-	return
+	slen2, err := base64.StdEncoding.Decode(bsOut, bs0)
+	if err != nil {
+		d.d.errorf("error decoding base64 binary '%s': %v", bs0, err)
+		return nil
+	}
+	return bsOut[:slen2]
 }
 
 func (d *jsonDecDriver) DecodeString() (s string) {
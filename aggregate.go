@@ -0,0 +1,644 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+type (
+	// A Stage transforms the documents flowing through an aggregation pipeline.
+	// Every stage runs in the same read transaction, so stages that join
+	// other collections see a consistent view of the database.
+	Stage func(*bolt.Tx, []map[interface{}]interface{}) ([]map[interface{}]interface{}, error)
+
+	// An Accumulator folds the values of a group into a single result.
+	Accumulator interface {
+		Add(value interface{})
+		Result() interface{}
+	}
+)
+
+var stageBuilders = map[string]func(interface{}, *Collation) (Stage, error){
+	"$match":   matchStage,
+	"$group":   groupStage,
+	"$sort":    sortStage,
+	"$project": projectStage,
+	"$unwind":  unwindStage,
+	"$limit":   limitStage,
+
+	"$lookup":      lookupStage,
+	"$graphLookup": graphLookupStage,
+}
+
+var accumulators = map[string]func() Accumulator{
+	"$sum":      func() Accumulator { return new(sumAccumulator) },
+	"$avg":      func() Accumulator { return new(avgAccumulator) },
+	"$min":      func() Accumulator { return &extremeAccumulator{sign: -1} },
+	"$max":      func() Accumulator { return &extremeAccumulator{sign: 1} },
+	"$count":    func() Accumulator { return new(countAccumulator) },
+	"$push":     func() Accumulator { return &pushAccumulator{values: []interface{}{}} },
+	"$addToSet": func() Accumulator { return &pushAccumulator{values: []interface{}{}, unique: true} },
+	"$first":    func() Accumulator { return new(firstAccumulator) },
+	"$last":     func() Accumulator { return new(lastAccumulator) },
+}
+
+func aggregate(db string, collection string, pipelineReader io.Reader) ([]byte, error) {
+	body, err := decodeJson(pipelineReader)
+	if err != nil {
+		return nil, err
+	}
+
+	specs, ok := body["pipeline"].([]interface{})
+	if !ok {
+		return nil, errors.New("Cannot aggregate without a pipeline")
+	}
+	coll, err := parseCollation(body["collation"])
+	if err != nil {
+		return nil, err
+	}
+
+	stages, err := buildPipeline(specs, coll)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []byte
+	err = readDb(db, func(tx *bolt.Tx) error {
+		results, err := runPipeline(tx, collection, stages)
+		if err != nil {
+			return err
+		}
+		for _, doc := range results {
+			encDoc, err := encodeDoc(doc)
+			if err != nil {
+				return err
+			}
+			docs = append(docs, encDoc.Bytes()...)
+		}
+		return nil
+	})
+	return docs, err
+}
+
+// buildPipeline builds the stages of a pipeline. The collation applies to
+// the strings compared by $match, $sort and $group.
+func buildPipeline(specs []interface{}, coll *Collation) ([]Stage, error) {
+	stages := make([]Stage, 0, len(specs))
+	for _, spec := range specs {
+		specMap, ok := spec.(map[interface{}]interface{})
+		if !ok || len(specMap) != 1 {
+			return nil, errors.New("Each pipeline stage must be an object with a single stage operator")
+		}
+		for name, arg := range specMap {
+			builder, ok := stageBuilders[fmt.Sprint(name)]
+			if !ok {
+				return nil, fmt.Errorf("Unknown pipeline stage %v", name)
+			}
+			stage, err := builder(arg, coll)
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, stage)
+		}
+	}
+	return stages, nil
+}
+
+func runPipeline(tx *bolt.Tx, collection string, stages []Stage) ([]map[interface{}]interface{}, error) {
+	docs, err := loadCollection(tx, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stage := range stages {
+		docs, err = stage(tx, docs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+// loadCollection decodes every document in a collection. A missing
+// collection has no documents.
+func loadCollection(tx *bolt.Tx, collection string) ([]map[interface{}]interface{}, error) {
+	docs := []map[interface{}]interface{}{}
+	bucket, err := collectionBucket(tx, collection)
+	if err != nil {
+		return nil, err
+	}
+	if bucket == nil {
+		return docs, nil
+	}
+	err = bucket.ForEach(func(k []byte, v []byte) error {
+		doc, err := decodeJson(v)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+		return nil
+	})
+	return docs, err
+}
+
+func matchStage(arg interface{}, coll *Collation) (Stage, error) {
+	query, ok := arg.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("$match requires a query object")
+	}
+	if err := checkQuery(query); err != nil {
+		return nil, err
+	}
+	return func(tx *bolt.Tx, docs []map[interface{}]interface{}) ([]map[interface{}]interface{}, error) {
+		matched := docs[:0]
+		for _, doc := range docs {
+			match, err := queryMatch(doc, query, coll)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				matched = append(matched, doc)
+			}
+		}
+		return matched, nil
+	}, nil
+}
+
+func groupStage(arg interface{}, coll *Collation) (Stage, error) {
+	spec, ok := arg.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("$group requires an object")
+	}
+	idExpr, ok := spec["_id"]
+	if !ok {
+		return nil, errors.New("$group requires an _id expression")
+	}
+
+	type field struct {
+		name string
+		op   string
+		expr interface{}
+	}
+	var fields []field
+	for k, v := range spec {
+		name := fmt.Sprint(k)
+		if name == "_id" {
+			continue
+		}
+		acc, ok := v.(map[interface{}]interface{})
+		if !ok || len(acc) != 1 {
+			return nil, fmt.Errorf("$group field %s must be a single accumulator", name)
+		}
+		for op, expr := range acc {
+			if _, ok := accumulators[fmt.Sprint(op)]; !ok {
+				return nil, fmt.Errorf("Unknown accumulator %v", op)
+			}
+			fields = append(fields, field{name, fmt.Sprint(op), expr})
+		}
+	}
+
+	return func(tx *bolt.Tx, docs []map[interface{}]interface{}) ([]map[interface{}]interface{}, error) {
+		type group struct {
+			id   interface{}
+			accs []Accumulator
+		}
+		groups := map[string]*group{}
+		var order []string
+		for _, doc := range docs {
+			scope := NewExprScope(doc, nil)
+			id, err := evalExpr(scope, idExpr)
+			if err != nil {
+				return nil, err
+			}
+			key := collatedGroupKey(id, coll)
+			g, ok := groups[key]
+			if !ok {
+				g = &group{id: id}
+				for _, f := range fields {
+					g.accs = append(g.accs, accumulators[f.op]())
+				}
+				groups[key] = g
+				order = append(order, key)
+			}
+			for i, f := range fields {
+				value, err := evalExpr(scope, f.expr)
+				if err != nil {
+					return nil, err
+				}
+				g.accs[i].Add(value)
+			}
+		}
+
+		results := make([]map[interface{}]interface{}, 0, len(order))
+		for _, key := range order {
+			g := groups[key]
+			result := map[interface{}]interface{}{"_id": g.id}
+			for i, f := range fields {
+				result[f.name] = g.accs[i].Result()
+			}
+			results = append(results, result)
+		}
+		return results, nil
+	}, nil
+}
+
+// groupKey is the same for equal values, so numbers of different types
+// but equal value, or dates written with different offsets, share a group.
+func groupKey(v interface{}) string {
+	return collatedGroupKey(v, nil)
+}
+
+// collatedGroupKey is groupKey with strings compared under coll.
+func collatedGroupKey(v interface{}, coll *Collation) string {
+	if isNumber(v) {
+		return "number " + numberKey(v)
+	}
+	if t, ok := dateValue(v); ok {
+		return fmt.Sprintf("date %d", t.UnixNano())
+	}
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		key := "{"
+		for _, k := range sortedKeys(v) {
+			key += groupKey(k) + ":" + collatedGroupKey(v[k], coll) + ","
+		}
+		return key + "}"
+	case []interface{}:
+		key := "["
+		for _, e := range v {
+			key += collatedGroupKey(e, coll) + ","
+		}
+		return key + "]"
+	case string:
+		return fmt.Sprintf("%q", coll.Key(v))
+	}
+	return fmt.Sprintf("%#v", v)
+}
+
+// sortStage accepts a single field, {"field": 1}, or an array of single
+// field objects for compound sorts, since object keys are unordered.
+func sortStage(arg interface{}, coll *Collation) (Stage, error) {
+	keys, err := parseSortKeys(arg)
+	if err != nil {
+		return nil, err
+	}
+	return func(tx *bolt.Tx, docs []map[interface{}]interface{}) ([]map[interface{}]interface{}, error) {
+		sortDocs(docs, keys, coll)
+		return docs, nil
+	}, nil
+}
+
+type sortKey struct {
+	path      string
+	direction int
+}
+
+func parseSortKeys(arg interface{}) ([]sortKey, error) {
+	var specs []interface{}
+	switch arg := arg.(type) {
+	case map[interface{}]interface{}:
+		if len(arg) != 1 {
+			return nil, errors.New("Sort on multiple fields with an array of single field objects")
+		}
+		specs = []interface{}{arg}
+	case []interface{}:
+		specs = arg
+	default:
+		return nil, errors.New("Sort requires an object or an array")
+	}
+
+	var keys []sortKey
+	for _, spec := range specs {
+		specMap, ok := spec.(map[interface{}]interface{})
+		if !ok || len(specMap) != 1 {
+			return nil, errors.New("Each sort key must be an object with a single field")
+		}
+		for k, v := range specMap {
+			direction, ok := intValue(v)
+			if !ok || (direction != 1 && direction != -1) {
+				return nil, fmt.Errorf("Sort direction for %v must be 1 or -1", k)
+			}
+			keys = append(keys, sortKey{fmt.Sprint(k), int(direction)})
+		}
+	}
+	return keys, nil
+}
+
+func sortDocs(docs []map[interface{}]interface{}, keys []sortKey, coll *Collation) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, key := range keys {
+			a, _ := lookupField(docs[i], key.path)
+			b, _ := lookupField(docs[j], key.path)
+			if c := compareCollated(a, b, coll); c != 0 {
+				return c*key.direction < 0
+			}
+		}
+		return false
+	})
+}
+
+func projectStage(arg interface{}, coll *Collation) (Stage, error) {
+	spec, ok := arg.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("$project requires an object")
+	}
+
+	include, exclude := false, false
+	for k, v := range spec {
+		if k == "_id" {
+			continue
+		}
+		if isProjectionFlag(v) {
+			if projectionFlag(v) {
+				include = true
+			} else {
+				exclude = true
+			}
+		} else {
+			include = true
+		}
+	}
+	if include && exclude {
+		return nil, errors.New("$project cannot mix inclusion and exclusion")
+	}
+
+	return func(tx *bolt.Tx, docs []map[interface{}]interface{}) ([]map[interface{}]interface{}, error) {
+		for i, doc := range docs {
+			var projected map[interface{}]interface{}
+			if exclude {
+				projected = copyDoc(doc)
+			} else {
+				projected = map[interface{}]interface{}{}
+				if id, ok := doc["_id"]; ok {
+					projected["_id"] = id
+				}
+			}
+			for k, v := range spec {
+				path := fmt.Sprint(k)
+				if !isProjectionFlag(v) {
+					value, err := evalExpr(NewExprScope(doc, nil), v)
+					if err != nil {
+						return nil, err
+					}
+					setField(projected, path, value)
+				} else if !projectionFlag(v) {
+					unsetField(projected, path)
+				} else if value, ok := lookupField(doc, path); ok {
+					setField(projected, path, value)
+				}
+			}
+			docs[i] = projected
+		}
+		return docs, nil
+	}, nil
+}
+
+func isProjectionFlag(v interface{}) bool {
+	switch v.(type) {
+	case bool, uint64, int64, float64:
+		return true
+	}
+	return false
+}
+
+func projectionFlag(v interface{}) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	f, _ := floatValue(v)
+	return f != 0
+}
+
+func unwindStage(arg interface{}, coll *Collation) (Stage, error) {
+	var path string
+	preserve := false
+	switch arg := arg.(type) {
+	case string:
+		path = arg
+	case map[interface{}]interface{}:
+		path, _ = arg["path"].(string)
+		preserve, _ = arg["preserveNullAndEmptyArrays"].(bool)
+	}
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.New("$unwind requires a field path starting with $")
+	}
+	path = path[1:]
+
+	return func(tx *bolt.Tx, docs []map[interface{}]interface{}) ([]map[interface{}]interface{}, error) {
+		var unwound []map[interface{}]interface{}
+		for _, doc := range docs {
+			value, ok := lookupField(doc, path)
+			slice, isSlice := value.([]interface{})
+			if !ok || value == nil || (isSlice && len(slice) == 0) {
+				if preserve {
+					unwound = append(unwound, doc)
+				}
+				continue
+			}
+			if !isSlice {
+				unwound = append(unwound, doc)
+				continue
+			}
+			for _, v := range slice {
+				unwoundDoc := copyDoc(doc)
+				setField(unwoundDoc, path, v)
+				unwound = append(unwound, unwoundDoc)
+			}
+		}
+		return unwound, nil
+	}, nil
+}
+
+func limitStage(arg interface{}, coll *Collation) (Stage, error) {
+	limit, ok := intValue(arg)
+	if !ok || limit < 0 {
+		return nil, errors.New("$limit requires a non-negative integer")
+	}
+	return func(tx *bolt.Tx, docs []map[interface{}]interface{}) ([]map[interface{}]interface{}, error) {
+		if int64(len(docs)) > limit {
+			docs = docs[:limit]
+		}
+		return docs, nil
+	}, nil
+}
+
+// lookupField follows a dotted path through nested objects.
+func lookupField(doc map[interface{}]interface{}, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return nil, false
+		}
+		value, ok = obj[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func setField(doc map[interface{}]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	obj := doc
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := obj[part].(map[interface{}]interface{})
+		if !ok {
+			child = map[interface{}]interface{}{}
+			obj[part] = child
+		}
+		obj = child
+	}
+	obj[parts[len(parts)-1]] = value
+}
+
+func unsetField(doc map[interface{}]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	obj := doc
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := obj[part].(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+		obj = child
+	}
+	delete(obj, parts[len(parts)-1])
+}
+
+// copyDoc copies nested objects so stages can modify the result without
+// touching documents shared with other results.
+func copyDoc(doc map[interface{}]interface{}) map[interface{}]interface{} {
+	cp := make(map[interface{}]interface{}, len(doc))
+	for k, v := range doc {
+		if obj, ok := v.(map[interface{}]interface{}); ok {
+			v = copyDoc(obj)
+		}
+		cp[k] = v
+	}
+	return cp
+}
+
+// sumAccumulator adds numbers, ignoring other values.
+type sumAccumulator struct {
+	sum   interface{}
+	count uint64
+}
+
+func (a *sumAccumulator) Add(value interface{}) {
+	if !isNumber(value) {
+		return
+	}
+	if a.sum == nil {
+		a.sum = value
+	} else if sum, err := addOp.apply(a.sum, value); err == nil {
+		a.sum = sum
+	}
+	a.count++
+}
+
+func (a *sumAccumulator) Result() interface{} {
+	if a.sum == nil {
+		return uint64(0)
+	}
+	return a.sum
+}
+
+type avgAccumulator struct {
+	sumAccumulator
+}
+
+func (a *avgAccumulator) Result() interface{} {
+	if a.count == 0 {
+		return nil
+	}
+	sum := a.sum
+	if _, ok := decimalValue(sum); !ok {
+		sum, _ = floatValue(sum)
+	}
+	avg, _ := divideOp.apply(sum, a.count)
+	return avg
+}
+
+// extremeAccumulator keeps the smallest (sign -1) or largest (sign 1) value,
+// ignoring missing and null values.
+type extremeAccumulator struct {
+	sign  int
+	value interface{}
+}
+
+func (a *extremeAccumulator) Add(value interface{}) {
+	if value == nil {
+		return
+	}
+	if a.value == nil || compareValues(value, a.value)*a.sign > 0 {
+		a.value = value
+	}
+}
+
+func (a *extremeAccumulator) Result() interface{} {
+	return a.value
+}
+
+type countAccumulator struct {
+	count uint64
+}
+
+func (a *countAccumulator) Add(value interface{}) {
+	a.count++
+}
+
+func (a *countAccumulator) Result() interface{} {
+	return a.count
+}
+
+type pushAccumulator struct {
+	values []interface{}
+	unique bool
+}
+
+func (a *pushAccumulator) Add(value interface{}) {
+	if a.unique {
+		for _, v := range a.values {
+			if compareValues(v, value) == 0 {
+				return
+			}
+		}
+	}
+	a.values = append(a.values, value)
+}
+
+func (a *pushAccumulator) Result() interface{} {
+	return a.values
+}
+
+type firstAccumulator struct {
+	value interface{}
+	set   bool
+}
+
+func (a *firstAccumulator) Add(value interface{}) {
+	if !a.set {
+		a.value, a.set = value, true
+	}
+}
+
+func (a *firstAccumulator) Result() interface{} {
+	return a.value
+}
+
+type lastAccumulator struct {
+	value interface{}
+}
+
+func (a *lastAccumulator) Add(value interface{}) {
+	a.value = value
+}
+
+func (a *lastAccumulator) Result() interface{} {
+	return a.value
+}
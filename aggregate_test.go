@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func withTestDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "rtd")
+	assert.Ok(t, err)
+	rootDir = dir
+	return func() {
+		for name, db := range dbs {
+			db.Close()
+			delete(dbs, name)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func insertTestDocs(t *testing.T, db string, collection string, docs ...string) {
+	for _, doc := range docs {
+		_, err := insertDoc(db, collection, strings.NewReader(doc))
+		assert.Ok(t, err)
+	}
+}
+
+func aggregateDocs(t *testing.T, db string, collection string, pipeline string) []map[interface{}]interface{} {
+	encDocs, err := aggregate(db, collection, strings.NewReader(`{"pipeline": `+pipeline+`}`))
+	assert.Ok(t, err)
+	return decodeDocs(t, encDocs)
+}
+
+func decodeDocs(t *testing.T, encDocs []byte) []map[interface{}]interface{} {
+	var docs []map[interface{}]interface{}
+	reader := strings.NewReader(string(encDocs))
+	for reader.Len() > 0 {
+		doc, err := decodeJson(reader)
+		assert.Ok(t, err)
+		docs = append(docs, doc)
+	}
+	return docs
+}
+
+func TestAggregateGroup(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "shop", "orders",
+		`{"customer": "ann", "total": 10, "items": ["a", "b"]}`,
+		`{"customer": "bob", "total": 5, "items": ["c"]}`,
+		`{"customer": "ann", "total": 20, "items": ["a"]}`,
+		`{"customer": "cat", "total": 1, "status": "void"}`,
+	)
+
+	docs := aggregateDocs(t, "shop", "orders", `[
+		{"$match": {"customer": ["ann", "bob"]}},
+		{"$group": {"_id": "$customer", "sum": {"$sum": "$total"}, "avg": {"$avg": "$total"}, "max": {"$max": "$total"}, "n": {"$count": {}}}},
+		{"$sort": {"sum": -1}}
+	]`)
+	assert.Equals(t, 2, len(docs))
+	assert.Equals(t, "ann", docs[0]["_id"])
+	assert.Equals(t, uint64(30), docs[0]["sum"])
+	assert.Equals(t, float64(15), docs[0]["avg"])
+	assert.Equals(t, uint64(20), docs[0]["max"])
+	assert.Equals(t, uint64(2), docs[0]["n"])
+	assert.Equals(t, "bob", docs[1]["_id"])
+
+	docs = aggregateDocs(t, "shop", "orders", `[
+		{"$unwind": "$items"},
+		{"$group": {"_id": null, "items": {"$addToSet": "$items"}}}
+	]`)
+	assert.Equals(t, 1, len(docs))
+	assert.Equals(t, 3, len(docs[0]["items"].([]interface{})))
+}
+
+func TestAggregateProjectAndLimit(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "shop", "orders",
+		`{"customer": {"name": "ann"}, "total": 10}`,
+		`{"customer": {"name": "bob"}, "total": 5}`,
+	)
+
+	docs := aggregateDocs(t, "shop", "orders", `[
+		{"$sort": [{"total": 1}]},
+		{"$project": {"_id": 0, "name": "$customer.name"}},
+		{"$limit": 1}
+	]`)
+	assert.Equals(t, 1, len(docs))
+	assert.Equals(t, map[interface{}]interface{}{"name": "bob"}, docs[0])
+
+	_, err := aggregate("shop", "orders", strings.NewReader(`{"pipeline": [{"$bogus": {}}]}`))
+	assert.Cond(t, err != nil, "unknown stages should be rejected")
+}
+
+func TestAggregateLookup(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "blog", "posts", `{"slug": "go", "title": "golang is awesome"}`)
+	insertTestDocs(t, "blog", "comments",
+		`{"post": "go", "body": "agreed"}`,
+		`{"post": "go", "body": "+1"}`,
+		`{"post": "rust", "body": "elsewhere"}`,
+	)
+	insertTestDocs(t, "blog", "employees",
+		`{"name": "ann"}`,
+		`{"name": "bob", "reportsTo": "ann"}`,
+		`{"name": "cat", "reportsTo": "bob"}`,
+	)
+
+	docs := aggregateDocs(t, "blog", "posts", `[
+		{"$lookup": {"from": "comments", "localField": "slug", "foreignField": "post", "as": "comments"}}
+	]`)
+	assert.Equals(t, 1, len(docs))
+	assert.Equals(t, 2, len(docs[0]["comments"].([]interface{})))
+
+	docs = aggregateDocs(t, "blog", "employees", `[
+		{"$match": {"name": "cat"}},
+		{"$graphLookup": {"from": "employees", "startWith": "$reportsTo", "connectFromField": "reportsTo", "connectToField": "name", "as": "chain", "depthField": "depth"}}
+	]`)
+	assert.Equals(t, 1, len(docs))
+	chain := docs[0]["chain"].([]interface{})
+	assert.Equals(t, 2, len(chain))
+	assert.Equals(t, "ann", chain[1].(map[interface{}]interface{})["name"])
+	assert.Equals(t, uint64(1), chain[1].(map[interface{}]interface{})["depth"])
+
+	// The pipeline's collation applies to the join, and a missing field
+	// joins like null.
+	insertTestDocs(t, "blog", "posts", `{"title": "drafts"}`)
+	insertTestDocs(t, "blog", "comments", `{"post": "GO", "body": "shouting"}`, `{"post": null, "body": "orphan"}`, `{"body": "unattached"}`)
+	encDocs, err := aggregate("blog", "posts", strings.NewReader(`{
+		"pipeline": [
+			{"$lookup": {"from": "comments", "localField": "slug", "foreignField": "post", "as": "comments"}},
+			{"$sort": {"title": 1}}
+		],
+		"collation": {"locale": "en", "strength": 2}
+	}`))
+	assert.Ok(t, err)
+	docs = decodeDocs(t, encDocs)
+	assert.Equals(t, 2, len(docs))
+	assert.Equals(t, 2, len(docs[0]["comments"].([]interface{})))
+	assert.Equals(t, 3, len(docs[1]["comments"].([]interface{})))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Backups are copies of database files taken from a read transaction, so
+// writes carry on while they stream. Tx.WriteTo is not used: it copies the
+// meta pages found on disk, which a write committed after the transaction
+// began may have replaced with one pointing past the copied pages. A DbCopy
+// reads the meta pages under the writer lock instead, begins its read
+// transaction at the same point and lets writes go before copying the
+// rest. As with any long read transaction in bolt, a write that needs to
+// grow the database's memory map waits until the copies in progress end.
+type DbCopy struct {
+	db   *openDb
+	tx   *bolt.Tx
+	file *os.File
+	meta []byte
+}
+
+var errDbNotFound = errors.New("Database not found")
+
+// beginCopy starts a consistent copy of a database. The caller closes it.
+func beginCopy(name string) (*DbCopy, error) {
+	if _, err := os.Stat(dbFileName(name)); os.IsNotExist(err) {
+		return nil, errDbNotFound
+	}
+	db, err := getDb(name)
+	if err != nil {
+		return nil, err
+	}
+	c, err := db.beginCopy()
+	if err != nil {
+		db.release()
+	}
+	if err == errDbReplaced {
+		// The file now holds the compacted or restored database.
+		return beginCopy(name)
+	}
+	return c, err
+}
+
+func (db *openDb) beginCopy() (*DbCopy, error) {
+	writer, err := db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	defer writer.Rollback()
+	if err := db.err(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(db.Path())
+	if err != nil {
+		return nil, err
+	}
+	meta := make([]byte, 2*db.Info().PageSize)
+	if _, err := file.ReadAt(meta, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	tx, err := db.Begin(false)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &DbCopy{db: db, tx: tx, file: file, meta: meta}, nil
+}
+
+// Size returns the number of bytes of the copy.
+func (c *DbCopy) Size() int64 {
+	return c.tx.Size()
+}
+
+func (c *DbCopy) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(c.meta)
+	if err != nil {
+		return int64(n), err
+	}
+	meta := int64(len(c.meta))
+	m, err := io.Copy(w, io.NewSectionReader(c.file, meta, c.Size()-meta))
+	return meta + m, err
+}
+
+func (c *DbCopy) Close() error {
+	c.tx.Rollback()
+	c.db.release()
+	return c.file.Close()
+}
+
+// backupDb writes a consistent copy of a database to w, compressed with
+// gzip if compress is set.
+func backupDb(name string, w io.Writer, compress bool) error {
+	c, err := beginCopy(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if !compress {
+		_, err = c.WriteTo(w)
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := c.WriteTo(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// backupAll writes a tar of every database to w, compressed with gzip if
+// compress is set. Each database is copied consistently, one after the
+// other, so the copies may be from slightly different times.
+func backupAll(w io.Writer, compress bool) error {
+	if compress {
+		zw := gzip.NewWriter(w)
+		if err := backupAll(zw, false); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	names, err := listDatabases()
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		c, err := beginCopy(name)
+		if err == errDbNotFound {
+			// Deleted since it was listed.
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     name + ".db",
+			Mode:     0600,
+			Size:     c.Size(),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		})
+		if err == nil {
+			_, err = c.WriteTo(tw)
+		}
+		c.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
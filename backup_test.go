@@ -0,0 +1,61 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hooklift/assert"
+)
+
+func TestBackup(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+
+	// Writes committed while a copy is taken, growing the file, are not in
+	// it. They stay within the memory map, which the copy keeps from
+	// growing.
+	c, err := beginCopy("app")
+	assert.Ok(t, err)
+	for i := 0; i < 10; i++ {
+		insertTestDocs(t, "app", "users", `{"name": "`+strings.Repeat("x", 4096)+`"}`)
+	}
+	file, err := os.Create(dbFileName("copy"))
+	assert.Ok(t, err)
+	n, err := c.WriteTo(file)
+	assert.Ok(t, err)
+	assert.Equals(t, c.Size(), n)
+	assert.Ok(t, c.Close())
+	assert.Ok(t, file.Close())
+
+	assert.Ok(t, readDb("copy", func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			return err
+		}
+		return nil
+	}))
+	assert.Equals(t, 2, countDocs(t, "copy", "users", `{}`))
+
+	var buf bytes.Buffer
+	assert.Ok(t, backupAll(&buf, true))
+	zr, err := gzip.NewReader(&buf)
+	assert.Ok(t, err)
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Ok(t, err)
+		names = append(names, header.Name)
+	}
+	assert.Equals(t, []string{"app.db", "copy.db"}, names)
+
+	assert.Equals(t, errDbNotFound, backupDb("missing", &buf, false))
+}
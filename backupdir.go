@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scheduled backups copy every database into a directory of the backup
+// directory named after the time of the backup, such as 20150510T120000Z,
+// with a manifest.json listing each file with its size, SHA-256, the
+// sequence number of its latest change and the time it was copied at:
+//
+//	{"time": {"$date": ...}, "databases": [{"name": "app", "file": "app.db",
+//	 "size": 32768, "sha256": "...", "seq": 42, "time": {"$date": ...}}]}
+//
+// A backup is written under a name starting with a dot and renamed once its
+// manifest is written, so an interrupted one is never listed. The files are
+// plain database files, which can be restored with PUT /:db/_restore.
+const manifestFile = "manifest.json"
+
+const backupNameFormat = "20060102T150405Z"
+
+var (
+	backupDir       string
+	backupKeepLast  int
+	backupKeepDaily int
+)
+
+// A BackupSet is one backup of every database.
+type BackupSet struct {
+	Name  string
+	Time  time.Time
+	Files []*BackupFile
+}
+
+type BackupFile struct {
+	Db     string
+	File   string
+	Size   int64
+	SHA256 string
+	// Seq is the sequence number of the latest change in the copy, which
+	// has every change made before Time.
+	Seq  uint64
+	Time time.Time
+}
+
+// takeBackup copies every database into a new backup set in dir.
+func takeBackup(dir string, now time.Time) (*BackupSet, error) {
+	set := &BackupSet{Name: now.UTC().Format(backupNameFormat), Time: now}
+	path := filepath.Join(dir, set.Name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("Backup %s already exists", set.Name)
+	}
+	partial := filepath.Join(dir, "."+set.Name)
+	if err := os.MkdirAll(partial, 0700); err != nil {
+		return nil, err
+	}
+	err := writeBackupSet(partial, set)
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		os.RemoveAll(partial)
+		return nil, err
+	}
+	return set, nil
+}
+
+func writeBackupSet(path string, set *BackupSet) error {
+	names, err := listDatabases()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		c, err := beginCopy(name)
+		if err == errDbNotFound {
+			// Deleted since it was listed.
+			continue
+		} else if err != nil {
+			return err
+		}
+		file := &BackupFile{Db: name, File: name + ".db", Seq: oplogSeq(c.tx), Time: time.Now().UTC().Round(0)}
+		hash := sha256.New()
+		err = writeDbFile(filepath.Join(path, file.File), func(w io.Writer) error {
+			var err error
+			file.Size, err = c.WriteTo(io.MultiWriter(w, hash))
+			return err
+		})
+		c.Close()
+		if err != nil {
+			return err
+		}
+		file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+		set.Files = append(set.Files, file)
+	}
+
+	files := make([]interface{}, len(set.Files))
+	for i, file := range set.Files {
+		files[i] = map[interface{}]interface{}{
+			"name":   file.Db,
+			"file":   file.File,
+			"size":   uint64(file.Size),
+			"sha256": file.SHA256,
+			"seq":    file.Seq,
+			"time":   NewDate(file.Time),
+		}
+	}
+	manifest, err := encodeDoc(map[interface{}]interface{}{
+		"time":      NewDate(set.Time),
+		"databases": files,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, manifestFile), manifest.Bytes(), 0600)
+}
+
+// listBackups returns the backup sets in dir, oldest first.
+func listBackups(dir string) ([]*BackupSet, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var sets []*BackupSet
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || entry.Name() == oplogArchiveDir {
+			continue
+		}
+		set, err := readManifest(dir, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("Error reading backup %s: %s", entry.Name(), err)
+		}
+		sets = append(sets, set)
+	}
+	sort.Sort(backupsByTime(sets))
+	return sets, nil
+}
+
+func readManifest(dir string, name string) (*BackupSet, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name, manifestFile))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := decodeJson(data)
+	if err != nil {
+		return nil, err
+	}
+	set := &BackupSet{Name: name}
+	set.Time, _ = dateValue(manifest["time"])
+	files, _ := manifest["databases"].([]interface{})
+	for _, f := range files {
+		entry, ok := f.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid manifest entry %v", f)
+		}
+		file := &BackupFile{}
+		file.Db, _ = entry["name"].(string)
+		file.File, _ = entry["file"].(string)
+		file.SHA256, _ = entry["sha256"].(string)
+		size, _ := intValue(entry["size"])
+		seq, _ := intValue(entry["seq"])
+		file.Size, file.Seq = size, uint64(seq)
+		file.Time, _ = dateValue(entry["time"])
+		if file.File == "" || file.File != filepath.Base(file.File) {
+			return nil, fmt.Errorf("Invalid manifest entry %v", f)
+		}
+		set.Files = append(set.Files, file)
+	}
+	return set, nil
+}
+
+type backupsByTime []*BackupSet
+
+func (b backupsByTime) Len() int           { return len(b) }
+func (b backupsByTime) Less(i, j int) bool { return b[i].Time.Before(b[j].Time) }
+func (b backupsByTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// verifyBackup checks the size and checksum of every file of a backup set
+// against its manifest.
+func verifyBackup(dir string, set *BackupSet) []error {
+	var problems []error
+	for _, file := range set.Files {
+		f, err := os.Open(filepath.Join(dir, set.Name, file.File))
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		hash := sha256.New()
+		size, err := io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			problems = append(problems, err)
+		} else if size != file.Size {
+			problems = append(problems, fmt.Errorf("%s has %d bytes, expected %d", file.File, size, file.Size))
+		} else if sum := hex.EncodeToString(hash.Sum(nil)); sum != file.SHA256 {
+			problems = append(problems, fmt.Errorf("%s has checksum %s, expected %s", file.File, sum, file.SHA256))
+		}
+	}
+	return problems
+}
+
+// pruneBackups removes the backup sets that are neither among the keepLast
+// latest nor the latest of one of the keepDaily latest days with a backup.
+// Nothing is removed when both are 0.
+func pruneBackups(dir string, keepLast int, keepDaily int) error {
+	if keepLast <= 0 && keepDaily <= 0 {
+		return nil
+	}
+	sets, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	days := 0
+	lastDay := ""
+	for i := len(sets) - 1; i >= 0; i-- {
+		set := sets[i]
+		if len(sets)-1-i < keepLast {
+			keep[set.Name] = true
+		}
+		if day := set.Time.Local().Format("2006-01-02"); day != lastDay {
+			lastDay = day
+			if days < keepDaily {
+				keep[set.Name] = true
+			}
+			days++
+		}
+	}
+	for _, set := range sets {
+		if !keep[set.Name] {
+			if err := os.RemoveAll(filepath.Join(dir, set.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runBackups takes a backup whenever the schedule says, then prunes old
+// ones.
+func runBackups(dir string, schedule *Schedule) {
+	for {
+		next := schedule.next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		time.Sleep(next.Sub(time.Now()))
+		set, err := takeBackup(dir, time.Now())
+		if err != nil {
+			log.Printf("Error backing up to %s: %s", dir, err)
+			continue
+		}
+		log.Printf("Backed up %d databases to %s", len(set.Files), filepath.Join(dir, set.Name))
+		if err := pruneBackups(dir, backupKeepLast, backupKeepDaily); err != nil {
+			log.Printf("Error pruning backups in %s: %s", dir, err)
+		}
+	}
+}
+
+// backupCommand lists the backups in dir, or verifies them, and returns the
+// exit status of the command.
+func backupCommand(dir string, verify bool) int {
+	sets, err := listBackups(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	status := 0
+	for _, set := range sets {
+		var size int64
+		for _, file := range set.Files {
+			size += file.Size
+		}
+		fmt.Printf("%s\t%s\t%d databases\t%d bytes", set.Name, set.Time.Local().Format(time.RFC3339), len(set.Files), size)
+		if !verify {
+			fmt.Println()
+			continue
+		}
+		problems := verifyBackup(dir, set)
+		if len(problems) == 0 {
+			fmt.Println("\tok")
+			continue
+		}
+		status = 1
+		fmt.Println("\tFAILED")
+		for _, problem := range problems {
+			fmt.Printf("\t%s\n", problem)
+		}
+	}
+	return status
+}
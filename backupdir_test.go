@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func backupNames(t *testing.T, dir string) []string {
+	sets, err := listBackups(dir)
+	assert.Ok(t, err)
+	var names []string
+	for _, set := range sets {
+		names = append(names, set.Name)
+	}
+	return names
+}
+
+func TestBackupDir(t *testing.T) {
+	defer withTestDir(t)()
+	dir := filepath.Join(rootDir, "backups")
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`)
+	insertTestDocs(t, "logs", "events", `{"type": "start"}`)
+
+	now := time.Date(2015, 5, 15, 3, 0, 0, 0, time.Local)
+	set, err := takeBackup(dir, now)
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(set.Files))
+	_, err = takeBackup(dir, now)
+	assert.Cond(t, err != nil, "a backup should not replace another")
+
+	sets, err := listBackups(dir)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(sets))
+	assert.Equals(t, set.Files, sets[0].Files)
+	assert.Cond(t, now.Equal(sets[0].Time), "the manifest should hold the time of the backup")
+	assert.Equals(t, 0, len(verifyBackup(dir, sets[0])))
+
+	// A backup file restores as the database it was taken from.
+	file, err := os.Open(filepath.Join(dir, set.Name, "app.db"))
+	assert.Ok(t, err)
+	assert.Ok(t, restoreDb("restored", file))
+	file.Close()
+	assert.Equals(t, 1, countDocs(t, "restored", "users", `{}`))
+
+	assert.Ok(t, ioutil.WriteFile(filepath.Join(dir, set.Name, "logs.db"), []byte("changed"), 0600))
+	assert.Equals(t, 1, len(verifyBackup(dir, sets[0])))
+}
+
+func TestPruneBackups(t *testing.T) {
+	defer withTestDir(t)()
+	dir := filepath.Join(rootDir, "backups")
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`)
+
+	// Three backups a day for four days.
+	start := time.Date(2015, 5, 15, 0, 0, 0, 0, time.Local)
+	var all []string
+	for day := 0; day < 4; day++ {
+		for hour := 0; hour < 24; hour += 8 {
+			set, err := takeBackup(dir, start.AddDate(0, 0, day).Add(time.Duration(hour)*time.Hour))
+			assert.Ok(t, err)
+			all = append(all, set.Name)
+		}
+	}
+
+	assert.Ok(t, pruneBackups(dir, 0, 0))
+	assert.Equals(t, all, backupNames(t, dir))
+
+	// The latest four, and the latest of each of the three latest days.
+	assert.Ok(t, pruneBackups(dir, 4, 3))
+	assert.Equals(t, []string{all[5], all[8], all[9], all[10], all[11]}, backupNames(t, dir))
+
+	assert.Ok(t, pruneBackups(dir, 1, 0))
+	assert.Equals(t, []string{all[11]}, backupNames(t, dir))
+}
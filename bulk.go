@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/boltdb/bolt"
+	"github.com/ugorji/go/codec"
+)
+
+// Bulk modes. A transaction applies every operation or none of them.
+// Ordered applies operations until one fails and keeps those before it;
+// unordered applies every operation that succeeds. All modes write in a
+// single bolt transaction, so a bulk request costs one fsync.
+const (
+	BulkTransaction = "transaction"
+	BulkOrdered     = "ordered"
+	BulkUnordered   = "unordered"
+)
+
+var errBulkRolledBack = errors.New("Bulk transaction rolled back")
+
+// A BulkOp is one operation of a bulk request:
+//
+//	{"op": "insert", "collection": "c", "doc": {...}}
+//	{"op": "update", "collection": "c", "id": "...", "update": {...}, "upsert": false}
+//	{"op": "update", "collection": "c", "query": {...}, "update": {...}, "upsert": false}
+//	{"op": "delete", "collection": "c", "id": "..."}
+//	{"op": "delete", "collection": "c", "query": {...}}
+type BulkOp struct {
+	Op         string
+	Collection string
+
+	id     string
+	query  map[interface{}]interface{}
+	doc    map[interface{}]interface{}
+	update map[interface{}]interface{}
+	upsert bool
+}
+
+type BulkResult struct {
+	Committed bool
+	Items     []map[interface{}]interface{}
+}
+
+func parseBulkOp(v interface{}) (*BulkOp, error) {
+	spec, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("Bulk operations must be objects")
+	}
+	op := &BulkOp{}
+	op.Op, _ = spec["op"].(string)
+	op.Collection, _ = spec["collection"].(string)
+	if op.Collection == "" {
+		return nil, errors.New("Bulk operations require a collection")
+	}
+	op.id, _ = spec["id"].(string)
+	op.query, _ = spec["query"].(map[interface{}]interface{})
+	op.doc, _ = spec["doc"].(map[interface{}]interface{})
+	op.update, _ = spec["update"].(map[interface{}]interface{})
+	op.upsert, _ = spec["upsert"].(bool)
+
+	switch op.Op {
+	case "insert":
+		if op.doc == nil {
+			return nil, errors.New("Bulk insert requires a doc")
+		}
+	case "update":
+		if op.update == nil {
+			return nil, errors.New("Bulk update requires an update object")
+		}
+		fallthrough
+	case "delete":
+		if (op.id == "") == (op.query == nil) {
+			return nil, fmt.Errorf("Bulk %s requires either an id or a query", op.Op)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown bulk operation %q", op.Op)
+	}
+	return op, nil
+}
+
+// readBulkOps reads operations given as a JSON array or as one JSON object
+// per line.
+func readBulkOps(reader io.Reader) ([]interface{}, error) {
+	decoder := codec.NewDecoder(reader, jh)
+	var ops []interface{}
+	for {
+		var v interface{}
+		if err := decoder.Decode(&v); err == io.EOF {
+			return ops, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if array, ok := v.([]interface{}); ok && ops == nil {
+			ops = array
+		} else {
+			ops = append(ops, v)
+		}
+	}
+}
+
+// apply runs the operation in tx. A failing operation writes nothing.
+func (op *BulkOp) apply(tx *bolt.Tx) (map[interface{}]interface{}, error) {
+	if op.Op == "delete" {
+		if bucket, err := collectionBucket(tx, op.Collection); err != nil || bucket == nil {
+			return map[interface{}]interface{}{"n": uint64(0)}, err
+		}
+	}
+	bucket, err := openCollection(tx, op.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "insert":
+		doc := copyDoc(op.doc)
+		if err := validateExtendedJson(doc); err != nil {
+			return nil, err
+		}
+		lookupId, err := docLookupId(doc)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := putDoc(bucket, lookupId, doc); err != nil {
+			return nil, err
+		}
+		return map[interface{}]interface{}{"_id": doc["_id"], "n": uint64(1)}, nil
+
+	case "update":
+		if op.id != "" {
+			lookupId, err := ParseId(op.id)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := updateById(bucket, lookupId, op.update, 0, op.upsert); err != nil {
+				return nil, err
+			}
+			return map[interface{}]interface{}{"_id": op.id, "n": uint64(1)}, nil
+		}
+		docs, err := updateMatching(bucket, op.query, op.update, op.upsert)
+		if err != nil {
+			return nil, err
+		}
+		return map[interface{}]interface{}{"n": docCount(docs)}, nil
+
+	default:
+		if op.id != "" {
+			lookupId, err := ParseId(op.id)
+			if err != nil {
+				return nil, err
+			}
+			deleted, err := deleteById(bucket, lookupId, 0)
+			if err != nil {
+				return nil, err
+			}
+			var n uint64
+			if deleted {
+				n = 1
+			}
+			return map[interface{}]interface{}{"_id": op.id, "n": n}, nil
+		}
+		n, err := deleteMatching(bucket, op.query)
+		if err != nil {
+			return nil, err
+		}
+		return map[interface{}]interface{}{"n": n}, nil
+	}
+}
+
+// docCount counts the documents in a stream of encoded documents.
+func docCount(docs []byte) uint64 {
+	decoder := codec.NewDecoderBytes(docs, jh)
+	var n uint64
+	for {
+		var doc map[interface{}]interface{}
+		if decoder.Decode(&doc) != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// bulk applies a list of operations to the collections of a database and
+// reports the outcome of each.
+func bulk(db string, mode string, reader io.Reader) (*BulkResult, error) {
+	mode, err := bulkMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	ops, result, err := parseBulk(reader)
+	if err != nil || result != nil {
+		return result, err
+	}
+
+	result = &BulkResult{}
+	err = updateDb(db, func(tx *bolt.Tx) error {
+		return applyBulkOps(tx, ops, mode, result)
+	})
+	if err == errBulkRolledBack {
+		return result, nil
+	}
+	return result, err
+}
+
+// bulkMode checks a bulk mode, defaulting to a transaction.
+func bulkMode(mode string) (string, error) {
+	switch mode {
+	case "":
+		return BulkTransaction, nil
+	case BulkTransaction, BulkOrdered, BulkUnordered:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown bulk mode %q", mode)
+}
+
+// parseBulk reads the operations of a bulk request. Malformed operations
+// are reported in a result without running anything, so that a typo cannot
+// leave an ordered import half done.
+func parseBulk(reader io.Reader) ([]*BulkOp, *BulkResult, error) {
+	specs, err := readBulkOps(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ops := make([]*BulkOp, len(specs))
+	var invalid *BulkResult
+	for i, spec := range specs {
+		if ops[i], err = parseBulkOp(spec); err != nil {
+			if invalid == nil {
+				invalid = &BulkResult{}
+			}
+			invalid.Items = append(invalid.Items, map[interface{}]interface{}{"index": uint64(i), "error": err.Error()})
+		}
+	}
+	return ops, invalid, nil
+}
+
+// applyBulkOps applies ops in tx, adding their outcomes to result. In
+// transaction mode a failure returns errBulkRolledBack, which rolls tx back.
+func applyBulkOps(tx *bolt.Tx, ops []*BulkOp, mode string, result *BulkResult) error {
+	for i, op := range ops {
+		item, err := op.apply(tx)
+		if err != nil {
+			item = map[interface{}]interface{}{"error": err.Error()}
+		}
+		item["index"] = uint64(i)
+		result.Items = append(result.Items, item)
+
+		if err != nil && mode == BulkTransaction {
+			return errBulkRolledBack
+		}
+		if err != nil && mode == BulkOrdered {
+			break
+		}
+	}
+	result.Committed = true
+	return nil
+}
+
+func (result *BulkResult) encode() ([]byte, error) {
+	items := make([]interface{}, len(result.Items))
+	for i, item := range result.Items {
+		items[i] = item
+	}
+	encDoc, err := encodeDoc(map[interface{}]interface{}{"committed": result.Committed, "items": items})
+	if err != nil {
+		return nil, err
+	}
+	return encDoc.Bytes(), nil
+}
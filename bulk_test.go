@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func countDocs(t *testing.T, db string, collection string, q string) int {
+	encDocs, err := query(db, collection, strings.NewReader(q))
+	assert.Ok(t, err)
+	return len(decodeDocs(t, encDocs))
+}
+
+func TestBulkModes(t *testing.T) {
+	defer withTestDir(t)()
+
+	ndjson := `{"op": "insert", "collection": "users", "doc": {"name": "ada"}}
+{"op": "insert", "collection": "users", "doc": {"name": "bob"}}
+{"op": "update", "collection": "users", "query": {"name": "bob"}, "update": {"admin": true}}
+{"op": "insert", "collection": "logs", "doc": {"event": "import"}}
+`
+	result, err := bulk("app", "", strings.NewReader(ndjson))
+	assert.Ok(t, err)
+	assert.Cond(t, result.Committed, "the transaction should commit")
+	assert.Equals(t, 4, len(result.Items))
+	assert.Equals(t, uint64(1), result.Items[2]["n"])
+	assert.Equals(t, 1, countDocs(t, "app", "users", `{"admin": true}`))
+	assert.Equals(t, 1, countDocs(t, "app", "logs", `{}`))
+
+	failing := `[
+		{"op": "delete", "collection": "users", "query": {"name": "ada"}},
+		{"op": "update", "collection": "users", "query": {"name": "bob"}, "update": {"n": {"$expr": {"$add": ["$name", 1]}}}},
+		{"op": "insert", "collection": "users", "doc": {"name": "cy"}}
+	]`
+	result, err = bulk("app", BulkTransaction, strings.NewReader(failing))
+	assert.Ok(t, err)
+	assert.Cond(t, !result.Committed, "the transaction should roll back")
+	assert.Equals(t, 2, len(result.Items))
+	assert.Cond(t, result.Items[1]["error"] != nil, "the failing item should report its error")
+	assert.Equals(t, 2, countDocs(t, "app", "users", `{}`))
+
+	result, err = bulk("app", BulkOrdered, strings.NewReader(failing))
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(result.Items))
+	assert.Equals(t, 1, countDocs(t, "app", "users", `{}`))
+
+	result, err = bulk("app", BulkUnordered, strings.NewReader(failing))
+	assert.Ok(t, err)
+	assert.Equals(t, 3, len(result.Items))
+	assert.Equals(t, uint64(0), result.Items[0]["n"])
+	assert.Equals(t, 2, countDocs(t, "app", "users", `{}`))
+
+	result, err = bulk("app", BulkUnordered, strings.NewReader(`[{"op": "drop", "collection": "users"}]`))
+	assert.Ok(t, err)
+	assert.Cond(t, !result.Committed && result.Items[0]["error"] != nil, "malformed operations should run nothing")
+}
+
+func TestBulkById(t *testing.T) {
+	defer withTestDir(t)()
+	id, _, err := NewId()
+	assert.Ok(t, err)
+
+	result, err := bulk("app", "", strings.NewReader(`[
+		{"op": "update", "collection": "users", "id": "`+id+`", "update": {"name": "ada"}, "upsert": true},
+		{"op": "update", "collection": "users", "id": "`+id+`", "update": {"name": "ada lovelace"}}
+	]`))
+	assert.Ok(t, err)
+	assert.Cond(t, result.Committed, "the transaction should commit")
+	doc, err := findDoc("app", "users", id)
+	assert.Ok(t, err)
+	assert.Cond(t, strings.Contains(string(doc), "ada lovelace"), "the second update should apply")
+
+	result, err = bulk("app", "", strings.NewReader(`{"op": "delete", "collection": "users", "id": "`+id+`"}`))
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(1), result.Items[0]["n"])
+	assert.Equals(t, errDocNotFound, deleteDoc("app", "users", id, 0))
+}
+
+func TestDeleteDoc(t *testing.T) {
+	defer withTestDir(t)()
+	encDoc, err := insertDoc("app", "users", strings.NewReader(`{"name": "ada"}`))
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc.Bytes())
+	assert.Ok(t, err)
+	id := doc["_id"].(string)
+
+	assert.Equals(t, errRevisionMismatch, deleteDoc("app", "users", id, 2))
+	assert.Ok(t, deleteDoc("app", "users", id, 1))
+	assert.Equals(t, 0, countDocs(t, "app", "users", `{}`))
+}
+
+func TestMultiGet(t *testing.T) {
+	defer withTestDir(t)()
+	var ids []string
+	for _, name := range []string{"ada", "bob", "cy"} {
+		encDoc, err := insertDoc("app", "users", strings.NewReader(`{"name": "`+name+`"}`))
+		assert.Ok(t, err)
+		doc, err := decodeJson(encDoc.Bytes())
+		assert.Ok(t, err)
+		ids = append(ids, doc["_id"].(string))
+	}
+	missing, _, err := NewId()
+	assert.Ok(t, err)
+
+	encDocs, err := findDocs("app", "users", strings.NewReader(
+		`{"ids": ["`+ids[2]+`", "`+missing+`", "`+ids[0]+`", "nope"]}`))
+	assert.Ok(t, err)
+	docs := decodeDocs(t, encDocs)
+	assert.Equals(t, 4, len(docs))
+	assert.Equals(t, "cy", docs[0]["name"])
+	assert.Equals(t, missing, docs[1]["_id"])
+	assert.Equals(t, errDocNotFound.Error(), docs[1]["error"])
+	assert.Equals(t, "ada", docs[2]["name"])
+	assert.Cond(t, docs[3]["error"] != nil, "invalid ids should be reported")
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Document writes are appended to the oplog as their transaction runs and
+// published to the change hub after it commits. Bolt runs commit handlers
+// after releasing its writer lock, so the hub puts changes back in sequence
+// order before sending them.
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+type Change struct {
+	Seq        uint64
+	Collection string
+	Op         string
+	Id         string
+	Time       time.Time
+
+	// doc is the document after the change, or before it for a delete, so
+	// that filters can match deleted documents.
+	doc map[interface{}]interface{}
+}
+
+// encode writes the change as sent to clients, with its document when
+// withDoc is set.
+func (change *Change) encode(withDoc bool) ([]byte, error) {
+	encEvent, err := encodeDoc(change.entry(withDoc))
+	if err != nil {
+		return nil, err
+	}
+	return encEvent.Bytes(), nil
+}
+
+// entry returns the change in the form clients and followers read.
+func (change *Change) entry(withDoc bool) map[interface{}]interface{} {
+	entry := map[interface{}]interface{}{
+		"seq":        change.Seq,
+		"op":         change.Op,
+		"collection": change.Collection,
+		"_id":        change.Id,
+		"time":       NewDate(change.Time),
+	}
+	if withDoc && change.doc != nil {
+		entry["doc"] = change.doc
+	}
+	return entry
+}
+
+// parseChange reads a change written by entry.
+func parseChange(entry map[interface{}]interface{}) (*Change, error) {
+	change := &Change{}
+	change.Seq, _ = entry["seq"].(uint64)
+	change.Op, _ = entry["op"].(string)
+	change.Collection, _ = entry["collection"].(string)
+	change.Id, _ = entry["_id"].(string)
+	change.Time, _ = dateValue(entry["time"])
+	change.doc, _ = entry["doc"].(map[interface{}]interface{})
+	if change.Seq == 0 || change.Collection == "" || change.Id == "" {
+		return nil, fmt.Errorf("Invalid change %v", entry)
+	}
+	return change, nil
+}
+
+// A changeSet collects the changes of one write transaction, with the names
+// of the collection buckets it opened.
+type changeSet struct {
+	db      string
+	tx      *bolt.Tx
+	buckets map[*bolt.Bucket]string
+	changes []*Change
+
+	// replayed is set on transactions that apply changes from a cluster
+	// log, which must not be proposed again.
+	replayed bool
+
+	// state lists the writes to the buckets the server keeps beside the
+	// collections, in order.
+	state []*StateWrite
+
+	// at is the time of the change being copied from another server's
+	// oplog, which it is logged with, or zero to log changes at the current
+	// time.
+	at time.Time
+}
+
+var (
+	changeSetMutex sync.Mutex
+	changeSets     = map[*bolt.Tx]*changeSet{}
+)
+
+// trackChanges records the document writes of tx and publishes them when it
+// commits. The transaction calls untrack when it ends.
+func trackChanges(tx *bolt.Tx, db string) *changeSet {
+	set := &changeSet{db: db, tx: tx, buckets: map[*bolt.Bucket]string{}}
+	changeSetMutex.Lock()
+	changeSets[tx] = set
+	changeSetMutex.Unlock()
+
+	tx.OnCommit(func() {
+		hub.publish(set.db, set.changes)
+		if len(set.changes) > 0 {
+			webhooks.notify(set.db)
+		}
+	})
+	return set
+}
+
+func (set *changeSet) untrack() {
+	changeSetMutex.Lock()
+	delete(changeSets, set.tx)
+	changeSetMutex.Unlock()
+}
+
+func txChangeSet(tx *bolt.Tx) *changeSet {
+	changeSetMutex.Lock()
+	defer changeSetMutex.Unlock()
+	return changeSets[tx]
+}
+
+var errReservedCollection = errors.New("Collection names starting with _ are reserved")
+
+// validCollectionName reports whether name can name a collection. Names
+// starting with _ belong to the buckets the server keeps alongside the
+// collections, such as the oplog and idempotency keys.
+func validCollectionName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "_")
+}
+
+// collectionBucket returns a collection for reading, or nil when it does
+// not exist.
+func collectionBucket(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	if !validCollectionName(name) {
+		return nil, errReservedCollection
+	}
+	return tx.Bucket([]byte(name)), nil
+}
+
+// openCollection opens a collection for writing, creating it if needed, and
+// names it for the changes recorded on it.
+func openCollection(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	if !validCollectionName(name) {
+		return nil, errReservedCollection
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	if set := txChangeSet(tx); set != nil {
+		set.buckets[bucket] = name
+	}
+	return bucket, nil
+}
+
+// State write operations.
+const (
+	StatePut          = "put"
+	StateDelete       = "delete"
+	StateDeleteBucket = "deleteBucket"
+)
+
+// A StateWrite is a write to a bucket the server keeps beside the
+// collections, such as a recorded idempotency key, addressed by the path of
+// bucket names leading to it.
+type StateWrite struct {
+	Op    string   `codec:"op"`
+	Path  []string `codec:"path"`
+	Key   []byte   `codec:"key"`
+	Value []byte   `codec:"value,omitempty"`
+}
+
+// A StateBucket is a bucket the server keeps beside the collections, whose
+// writes are recorded with the changes of their transaction, so that a
+// cluster leader proposes them with the changes.
+type StateBucket struct {
+	*bolt.Bucket
+	path []string
+}
+
+// openState opens the state bucket at path, creating it if needed.
+func openState(tx *bolt.Tx, path ...string) (*StateBucket, error) {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(path[0]))
+	if err != nil {
+		return nil, err
+	}
+	state := &StateBucket{Bucket: bucket, path: path[:1]}
+	for _, name := range path[1:] {
+		if state, err = state.CreateBucketIfNotExists(name); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// CreateBucketIfNotExists opens a nested state bucket, creating it if
+// needed.
+func (b *StateBucket) CreateBucketIfNotExists(name string) (*StateBucket, error) {
+	bucket, err := b.Bucket.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return &StateBucket{Bucket: bucket, path: b.subPath(name)}, nil
+}
+
+// NestedBucket returns a nested state bucket, or nil when it does not exist.
+func (b *StateBucket) NestedBucket(name string) *StateBucket {
+	bucket := b.Bucket.Bucket([]byte(name))
+	if bucket == nil {
+		return nil
+	}
+	return &StateBucket{Bucket: bucket, path: b.subPath(name)}
+}
+
+func (b *StateBucket) subPath(name string) []string {
+	return append(append([]string{}, b.path...), name)
+}
+
+// Put writes a key and records the write.
+func (b *StateBucket) Put(key []byte, value []byte) error {
+	if err := b.Bucket.Put(key, value); err != nil {
+		return err
+	}
+	b.record(&StateWrite{Op: StatePut, Key: key, Value: value})
+	return nil
+}
+
+// Delete removes a key and records the delete.
+func (b *StateBucket) Delete(key []byte) error {
+	if err := b.Bucket.Delete(key); err != nil {
+		return err
+	}
+	b.record(&StateWrite{Op: StateDelete, Key: key})
+	return nil
+}
+
+// DeleteBucket removes a nested bucket and records the delete.
+func (b *StateBucket) DeleteBucket(name string) error {
+	if err := b.Bucket.DeleteBucket([]byte(name)); err != nil {
+		return err
+	}
+	b.record(&StateWrite{Op: StateDeleteBucket, Key: []byte(name)})
+	return nil
+}
+
+func (b *StateBucket) record(write *StateWrite) {
+	if set := txChangeSet(b.Tx()); set != nil {
+		write.Path = b.path
+		write.Key = append([]byte{}, write.Key...)
+		write.Value = append([]byte(nil), write.Value...)
+		set.state = append(set.state, write)
+	}
+}
+
+// applyStateWrite repeats a state write recorded on another server.
+func applyStateWrite(tx *bolt.Tx, write *StateWrite) error {
+	if len(write.Path) == 0 {
+		return fmt.Errorf("State write %s has no bucket", write.Op)
+	}
+	if validCollectionName(write.Path[0]) {
+		return fmt.Errorf("State write to collection %s", write.Path[0])
+	}
+	state, err := openState(tx, write.Path...)
+	if err != nil {
+		return err
+	}
+	switch write.Op {
+	case StatePut:
+		if write.Value == nil {
+			write.Value = []byte{}
+		}
+		return state.Bucket.Put(write.Key, write.Value)
+	case StateDelete:
+		return state.Bucket.Delete(write.Key)
+	case StateDeleteBucket:
+		if err := state.Bucket.DeleteBucket(write.Key); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown state write %q", write.Op)
+}
+
+func recordChange(bucket *bolt.Bucket, op string, lookupId []byte, encDoc []byte) error {
+	set := txChangeSet(bucket.Tx())
+	if set == nil {
+		return nil
+	}
+	collection, ok := set.buckets[bucket]
+	if !ok {
+		return nil
+	}
+	doc, err := decodeJson(encDoc)
+	if err != nil {
+		return err
+	}
+	change := &Change{
+		Collection: collection,
+		Op:         op,
+		Id:         IdString(lookupId),
+		Time:       time.Now().UTC(),
+		doc:        doc,
+	}
+	if !set.at.IsZero() {
+		change.Time = set.at
+	}
+	if err := logChange(bucket.Tx(), change); err != nil {
+		return err
+	}
+	set.changes = append(set.changes, change)
+	return nil
+}
+
+// putDocValue stores an encoded document and records the change.
+func putDocValue(bucket *bolt.Bucket, lookupId []byte, encDoc []byte) error {
+	op := ChangeUpdate
+	if bucket.Get(lookupId) == nil {
+		op = ChangeInsert
+	}
+	if err := bucket.Put(lookupId, encDoc); err != nil {
+		return err
+	}
+	return recordChange(bucket, op, lookupId, encDoc)
+}
+
+// deleteDocValue deletes a document and records the change.
+func deleteDocValue(bucket *bolt.Bucket, lookupId []byte) error {
+	doc := bucket.Get(lookupId)
+	if doc == nil {
+		return nil
+	}
+	if err := recordChange(bucket, ChangeDelete, lookupId, doc); err != nil {
+		return err
+	}
+	return bucket.Delete(lookupId)
+}
+
+// A ChangeHub sends the changes of each database to subscribers, in
+// sequence order.
+type ChangeHub struct {
+	mutex       sync.Mutex
+	published   map[string]uint64
+	pending     map[string][]*Change
+	subscribers map[*ChangeSubscriber]bool
+}
+
+// A ChangeSubscriber receives the changes of a database, optionally limited
+// to a collection and to documents matching a filter. A subscriber that
+// falls behind is closed and should resume from its last sequence number.
+type ChangeSubscriber struct {
+	Changes chan *Change
+
+	db         string
+	collection string
+	filter     map[interface{}]interface{}
+	coll       *Collation
+
+	// after is the sequence number of the last change sent, or returned as
+	// backlog, before the subscriber joined the hub.
+	after uint64
+}
+
+var hub = &ChangeHub{
+	published:   map[string]uint64{},
+	pending:     map[string][]*Change{},
+	subscribers: map[*ChangeSubscriber]bool{},
+}
+
+// open starts numbering the changes of a database after seq, the latest
+// change in its oplog.
+func (h *ChangeHub) open(db string, seq uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.published[db] = seq
+	delete(h.pending, db)
+}
+
+func (h *ChangeHub) publish(db string, changes []*Change) {
+	if len(changes) == 0 {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	pending := append(h.pending[db], changes...)
+	sort.Sort(changesBySeq(pending))
+	n := 0
+	for ; n < len(pending) && pending[n].Seq == h.published[db]+1; n++ {
+		h.published[db]++
+		h.send(db, pending[n])
+	}
+	h.pending[db] = pending[n:]
+}
+
+func (h *ChangeHub) send(db string, change *Change) {
+	for sub := range h.subscribers {
+		if sub.db != db || !sub.wants(change) {
+			continue
+		}
+		select {
+		case sub.Changes <- change:
+		default:
+			delete(h.subscribers, sub)
+			close(sub.Changes)
+		}
+	}
+}
+
+type changesBySeq []*Change
+
+func (c changesBySeq) Len() int           { return len(c) }
+func (c changesBySeq) Less(i, j int) bool { return c[i].Seq < c[j].Seq }
+func (c changesBySeq) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+func newChangeSubscriber(db string, collection string, filter map[interface{}]interface{}) (*ChangeSubscriber, error) {
+	coll, err := parseCollation(filter["collation"])
+	if err != nil {
+		return nil, err
+	}
+	if err := checkQuery(filter); err != nil {
+		return nil, err
+	}
+	return &ChangeSubscriber{
+		Changes:    make(chan *Change, 256),
+		db:         db,
+		collection: collection,
+		filter:     withoutField(filter, "collation"),
+		coll:       coll,
+	}, nil
+}
+
+// subscribe starts sending changes to sub and returns those it matches from
+// the oplog after since, up to the last published change. Only new changes
+// are sent when resume is not set.
+func (h *ChangeHub) subscribe(sub *ChangeSubscriber, since uint64, resume bool) ([]*Change, error) {
+	db, err := getDb(sub.db)
+	if err != nil {
+		return nil, err
+	}
+	defer db.release()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	sub.after = h.published[sub.db]
+	var backlog []*Change
+	if resume {
+		err := db.View(func(tx *bolt.Tx) error {
+			if since > oplogSeq(tx) {
+				return errResumeTooOld
+			}
+			if since >= sub.after {
+				// Changes after since were committed but not yet
+				// published; the hub sends them.
+				sub.after = since
+				return nil
+			}
+			changes, err := readOplog(tx, since, int(sub.after-since))
+			for _, change := range changes {
+				if sub.matches(change) {
+					backlog = append(backlog, change)
+				}
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.subscribers[sub] = true
+	return backlog, nil
+}
+
+// replayChanges sends the changes sub matches from the oplog after since, a
+// page at a time, and returns the sequence number it reached. Subscribing
+// from there leaves only the changes made meanwhile to the hub.
+func replayChanges(sub *ChangeSubscriber, since uint64, send func(*Change) error) (uint64, error) {
+	for {
+		var changes []*Change
+		err := readDb(sub.db, func(tx *bolt.Tx) error {
+			var err error
+			changes, err = readOplog(tx, since, oplogPage)
+			return err
+		})
+		if err != nil {
+			return since, err
+		}
+		for _, change := range changes {
+			if sub.matches(change) {
+				if err := send(change); err != nil {
+					return since, err
+				}
+			}
+			since = change.Seq
+		}
+		if len(changes) < oplogPage {
+			return since, nil
+		}
+	}
+}
+
+func (h *ChangeHub) unsubscribe(sub *ChangeSubscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.subscribers[sub] {
+		delete(h.subscribers, sub)
+		close(sub.Changes)
+	}
+}
+
+// wants reports whether change should be sent to sub by the hub.
+func (sub *ChangeSubscriber) wants(change *Change) bool {
+	return change.Seq > sub.after && sub.matches(change)
+}
+
+// matches reports whether change is in the collection and matches the
+// filter of sub. A change the filter's $expr fails on, say by dividing by
+// zero, is not sent, since a feed has no request to fail.
+func (sub *ChangeSubscriber) matches(change *Change) bool {
+	if sub.collection != "" && change.Collection != sub.collection {
+		return false
+	}
+	if len(sub.filter) == 0 {
+		return true
+	}
+	match, err := queryMatch(change.doc, sub.filter, sub.coll)
+	return err == nil && match
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func nextChange(t *testing.T, sub *ChangeSubscriber) *Change {
+	select {
+	case change := <-sub.Changes:
+		return change
+	case <-time.After(time.Second):
+		t.Fatal("no change published")
+	}
+	return nil
+}
+
+func TestChangeFeed(t *testing.T) {
+	defer withTestDir(t)()
+	sub, err := newChangeSubscriber("feed", "users", nil)
+	assert.Ok(t, err)
+	backlog, err := hub.subscribe(sub, 0, false)
+	assert.Ok(t, err)
+	defer hub.unsubscribe(sub)
+	assert.Equals(t, 0, len(backlog))
+
+	encDoc, err := insertDoc("feed", "users", strings.NewReader(`{"name": "ada"}`))
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc.Bytes())
+	assert.Ok(t, err)
+	id := doc["_id"].(string)
+	_, err = insertDoc("feed", "other", strings.NewReader(`{"name": "bob"}`))
+	assert.Ok(t, err)
+	_, err = updateQuery("feed", "users", strings.NewReader(`{"query": {"name": "ada"}, "update": {"admin": true}}`))
+	assert.Ok(t, err)
+	assert.Ok(t, deleteDoc("feed", "users", id, 0))
+
+	insert, update, del := nextChange(t, sub), nextChange(t, sub), nextChange(t, sub)
+	assert.Equals(t, ChangeInsert, insert.Op)
+	assert.Equals(t, id, insert.Id)
+	assert.Equals(t, ChangeUpdate, update.Op)
+	assert.Equals(t, ChangeDelete, del.Op)
+	assert.Equals(t, insert.Seq+2, update.Seq)
+	assert.Equals(t, update.Seq+1, del.Seq)
+
+	encEvent, err := update.encode(true)
+	assert.Ok(t, err)
+	event, err := decodeJson(encEvent)
+	assert.Ok(t, err)
+	assert.Equals(t, true, event["doc"].(map[interface{}]interface{})["admin"])
+
+	// Rolled back transactions publish nothing.
+	result, err := bulk("feed", "", strings.NewReader(`[
+		{"op": "insert", "collection": "users", "doc": {"name": "cy"}},
+		{"op": "update", "collection": "users", "id": "`+id+`", "update": {"a": 1}}
+	]`))
+	assert.Ok(t, err)
+	assert.Cond(t, !result.Committed, "the bulk transaction should roll back")
+	select {
+	case change := <-sub.Changes:
+		t.Fatalf("unexpected change %v", change)
+	default:
+	}
+
+	// Resuming replays the changes after the token that match the filter.
+	filter, err := decodeJson(strings.NewReader(`{"name": "ada"}`))
+	assert.Ok(t, err)
+	resumed, err := newChangeSubscriber("feed", "", filter)
+	assert.Ok(t, err)
+	backlog, err = hub.subscribe(resumed, insert.Seq, true)
+	assert.Ok(t, err)
+	defer hub.unsubscribe(resumed)
+	assert.Equals(t, 2, len(backlog))
+	assert.Equals(t, update.Seq, backlog[0].Seq)
+
+	tooNew, err := newChangeSubscriber("feed", "", nil)
+	assert.Ok(t, err)
+	_, err = hub.subscribe(tooNew, del.Seq+100, true)
+	assert.Equals(t, errResumeTooOld, err)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ugorji/go/codec"
+)
+
+// In cluster mode every server holds every database and writes go through
+// the Raft log. The leader runs a write as usual, then proposes the changes
+// of its transaction to the log and commits the transaction only once a
+// majority of the cluster has them. The other servers apply committed
+// entries in log order, with the leader's sequence numbers, and forward the
+// writes they receive to the leader. Reads are served by any server.
+//
+// Each database records in its "_cluster" bucket the index of the last entry
+// applied to it, so an entry is applied once however often the log is
+// replayed, after a restart or a snapshot install. Webhooks go through the
+// log too, and the idempotency keys and map-reduce state a transaction
+// writes are proposed with its changes.
+const clusterBucket = "_cluster"
+
+// Entry types of the cluster log.
+const (
+	RaftChanges  = "changes"
+	RaftCreateDb = "createDb"
+	RaftDeleteDb = "deleteDb"
+	RaftCloneDb  = "cloneDb"
+)
+
+var clusterIndexKey = []byte("index")
+
+// cluster is this server's node when running in cluster mode.
+var cluster *RaftNode
+
+func clusterFileName() string {
+	return fmt.Sprintf("%s/_cluster.raft", rootDir)
+}
+
+// startCluster joins the cluster as id. peers lists the members of a new
+// cluster as id=url pairs separated by commas, and is empty for a server
+// added to an existing one.
+func startCluster(id string, peers string) error {
+	members := map[string]string{}
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		parts := strings.SplitN(peer, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Invalid cluster peer %q, expected id=url", peer)
+		}
+		members[parts[0]] = strings.TrimRight(parts[1], "/")
+	}
+	if len(members) > 0 && members[id] == "" {
+		return fmt.Errorf("Cluster peers do not include %s", id)
+	}
+
+	node, err := NewRaftNode(id, clusterFileName(), members, NewHttpTransport(), applyClusterEntry, installClusterSnapshot)
+	if err != nil {
+		return err
+	}
+	cluster = node
+	node.start()
+	return nil
+}
+
+func dbIndex(tx *bolt.Tx) uint64 {
+	if bucket := tx.Bucket([]byte(clusterBucket)); bucket != nil {
+		return uint64Value(bucket.Get(clusterIndexKey))
+	}
+	return 0
+}
+
+func setDbIndex(tx *bolt.Tx, index uint64) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(clusterBucket))
+	if err != nil {
+		return err
+	}
+	return bucket.Put(clusterIndexKey, oplogKey(index))
+}
+
+// replicate proposes the changes of a transaction to the cluster log before
+// it commits.
+func (set *changeSet) replicate() error {
+	if cluster == nil || set.replayed || len(set.changes)+len(set.state) == 0 {
+		return nil
+	}
+	entry := &RaftEntry{Type: RaftChanges, Db: set.db, State: set.state}
+	for _, change := range set.changes {
+		entry.Changes = append(entry.Changes, change.entry(true))
+	}
+	index, err := cluster.propose(entry)
+	if err != nil {
+		return err
+	}
+	return setDbIndex(set.tx, index)
+}
+
+// applyClusterEntry applies a committed entry to the database it names,
+// unless the database has it already.
+func applyClusterEntry(index uint64, entry *RaftEntry) error {
+	switch entry.Type {
+	case RaftChanges, RaftCreateDb:
+		changes := make([]*Change, len(entry.Changes))
+		for i, c := range entry.Changes {
+			change, err := parseChange(c)
+			if err != nil {
+				return err
+			}
+			changes[i] = change
+		}
+		return updateDb(entry.Db, func(tx *bolt.Tx) error {
+			txChangeSet(tx).replayed = true
+			if dbIndex(tx) >= index {
+				return nil
+			}
+			if err := applyChangesTx(tx, changes); err != nil {
+				return err
+			}
+			for _, write := range entry.State {
+				if err := applyStateWrite(tx, write); err != nil {
+					return err
+				}
+			}
+			return setDbIndex(tx, index)
+		})
+	case RaftPutWebhook, RaftDeleteWebhook, RaftWebhookProgress:
+		return updateDb(entry.Db, func(tx *bolt.Tx) error {
+			txChangeSet(tx).replayed = true
+			if dbIndex(tx) >= index {
+				return nil
+			}
+			if err := applyWebhook(tx, entry.Type, entry.Webhook); err != nil {
+				return err
+			}
+			return setDbIndex(tx, index)
+		})
+	case RaftCloneDb:
+		// Every server clones its own copy of the source at the same point
+		// of the log. A clone that exists was made by this entry already,
+		// and a missing source was deleted by a later one.
+		_, err := os.Stat(dbFileName(entry.Db))
+		if err == nil {
+			return nil
+		}
+		if err = cloneDb(entry.Source, entry.Db, index); err == errDbNotFound {
+			return nil
+		}
+		return err
+	case RaftDeleteDb:
+		if _, err := os.Stat(dbFileName(entry.Db)); os.IsNotExist(err) {
+			return nil
+		}
+		var applied uint64
+		err := readDb(entry.Db, func(tx *bolt.Tx) error {
+			applied = dbIndex(tx)
+			return nil
+		})
+		if err != nil || applied >= index {
+			return err
+		}
+		return deleteDb(entry.Db)
+	}
+	return fmt.Errorf("Unknown cluster log entry type %q", entry.Type)
+}
+
+// installClusterSnapshot replaces every database with the leader's copy.
+func installClusterSnapshot(leader string) error {
+	f := NewFollower(leader)
+	names, err := f.primaryDatabases()
+	if err != nil {
+		return err
+	}
+	local, err := listDatabases()
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for _, name := range names {
+		keep[name] = true
+	}
+	for _, name := range local {
+		if !keep[name] {
+			if err := deleteDb(name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range names {
+		if err := f.bootstrap(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createDatabase(name string) error {
+	if cluster != nil {
+		return cluster.proposeApplied(&RaftEntry{Type: RaftCreateDb, Db: name})
+	}
+	db, err := getDb(name)
+	if err != nil {
+		return err
+	}
+	db.release()
+	return nil
+}
+
+func deleteDatabase(name string) error {
+	if cluster != nil {
+		return cluster.proposeApplied(&RaftEntry{Type: RaftDeleteDb, Db: name})
+	}
+	return deleteDb(name)
+}
+
+// HttpTransport sends Raft messages as JSON posts to /_raft/ endpoints.
+type HttpTransport struct {
+	client *http.Client
+	// snapshotClient waits for the peer to copy every database.
+	snapshotClient *http.Client
+}
+
+func NewHttpTransport() *HttpTransport {
+	return &HttpTransport{
+		client:         &http.Client{Timeout: time.Second},
+		snapshotClient: &http.Client{},
+	}
+}
+
+func (t *HttpTransport) call(client *http.Client, url string, req interface{}, resp interface{}) error {
+	var body []byte
+	if err := codec.NewEncoderBytes(&body, jh).Encode(req); err != nil {
+		return err
+	}
+	r, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(r.Body)
+		return fmt.Errorf("POST %s: %s: %s", url, r.Status, msg)
+	}
+	return codec.NewDecoder(r.Body, jh).Decode(resp)
+}
+
+func (t *HttpTransport) Vote(url string, req *VoteRequest) (*VoteResponse, error) {
+	resp := &VoteResponse{}
+	return resp, t.call(t.client, url+"/_raft/vote", req, resp)
+}
+
+func (t *HttpTransport) Append(url string, req *AppendRequest) (*AppendResponse, error) {
+	resp := &AppendResponse{}
+	return resp, t.call(t.client, url+"/_raft/append", req, resp)
+}
+
+func (t *HttpTransport) Snapshot(url string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	resp := &SnapshotResponse{}
+	return resp, t.call(t.snapshotClient, url+"/_raft/snapshot", req, resp)
+}
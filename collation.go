@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Collation controls how strings are matched and sorted. Without one,
+// strings compare byte by byte.
+//
+// Strings are compared in levels, like the Unicode collation algorithm:
+// base letters first, then accents, then case, with lower case sorting
+// before upper case. Strength 1 compares base letters only, so "Résumé"
+// matches "resume"; strength 2 adds accents and strength 3, the default,
+// adds case. CaseLevel adds the case level to strength 1, and
+// NumericOrdering compares runs of digits by their value, so "2" sorts
+// before "10".
+//
+// The root collation rules are applied to every locale except "simple",
+// which keeps byte order. Locales that reorder letters are not supported.
+type Collation struct {
+	Locale          string
+	Strength        int
+	CaseLevel       bool
+	NumericOrdering bool
+}
+
+// tailoredLocales reorder or add letters to the root collation.
+var tailoredLocales = map[string]bool{
+	"da": true, "de@collation=phonebook": true, "es@collation=traditional": true,
+	"et": true, "fi": true, "hu": true, "is": true, "lt": true, "nb": true,
+	"nn": true, "no": true, "pl": true, "sk": true, "sv": true, "tr": true,
+}
+
+func parseCollation(v interface{}) (*Collation, error) {
+	if v == nil {
+		return nil, nil
+	}
+	spec, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("Collation must be an object")
+	}
+
+	c := &Collation{Strength: 3}
+	c.Locale, ok = spec["locale"].(string)
+	if !ok || c.Locale == "" {
+		return nil, errors.New("Collation requires a locale")
+	}
+	if tailoredLocales[c.Locale] {
+		return nil, fmt.Errorf("Collation locale %s is not supported", c.Locale)
+	}
+	if strength, ok := spec["strength"]; ok {
+		s, ok := intValue(strength)
+		if !ok || s < 1 || s > 3 {
+			return nil, errors.New("Collation strength must be 1, 2 or 3")
+		}
+		c.Strength = int(s)
+	}
+	c.CaseLevel, _ = spec["caseLevel"].(bool)
+	c.NumericOrdering, _ = spec["numericOrdering"].(bool)
+	if c.Locale == "simple" && (c.CaseLevel || c.NumericOrdering || c.Strength != 3) {
+		return nil, errors.New("The simple locale compares bytes and takes no other options")
+	}
+	return c, nil
+}
+
+// CompareStrings orders two strings under the collation.
+func (c *Collation) CompareStrings(a string, b string) int {
+	if c == nil || c.Locale == "simple" {
+		return strings.Compare(a, b)
+	}
+
+	for _, weight := range c.levels() {
+		if cmp := c.compareWeights(a, b, weight); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+// numberMark brackets runs of digits in collation keys. It is a Unicode
+// noncharacter, so it does not appear in text.
+const numberMark = "\ufffe"
+
+// Key returns a string that is the same for strings the collation treats
+// as equal, for grouping and hashing.
+func (c *Collation) Key(s string) string {
+	if c == nil || c.Locale == "simple" {
+		return s
+	}
+	var key []rune
+	for _, weight := range c.levels() {
+		for rest := s; rest != ""; {
+			if c.NumericOrdering && isDigit(rest) {
+				digits := digitRun(rest)
+				key = append(key, []rune(numberMark+strings.TrimLeft(digits, "0")+numberMark)...)
+				rest = rest[len(digits):]
+				continue
+			}
+			r, size := utf8.DecodeRuneInString(rest)
+			key = append(key, weight(r))
+			rest = rest[size:]
+		}
+		key = append(key, 0)
+	}
+	return string(key)
+}
+
+func (c *Collation) levels() []func(rune) rune {
+	levels := []func(rune) rune{primaryWeight}
+	if c.Strength >= 2 {
+		levels = append(levels, unicode.ToLower)
+	}
+	if c.Strength >= 3 || c.CaseLevel {
+		levels = append(levels, caseWeight)
+	}
+	return levels
+}
+
+// compareWeights compares two strings after mapping every rune through
+// weight, reading runs of digits as numbers under NumericOrdering.
+func (c *Collation) compareWeights(a string, b string, weight func(rune) rune) int {
+	for a != "" && b != "" {
+		if c.NumericOrdering && isDigit(a) && isDigit(b) {
+			aDigits, bDigits := digitRun(a), digitRun(b)
+			if cmp := compareDigits(aDigits, bDigits); cmp != 0 {
+				return cmp
+			}
+			a, b = a[len(aDigits):], b[len(bDigits):]
+			continue
+		}
+
+		aRune, aSize := utf8.DecodeRuneInString(a)
+		bRune, bSize := utf8.DecodeRuneInString(b)
+		aWeight, bWeight := weight(aRune), weight(bRune)
+		if aWeight != bWeight {
+			if aWeight < bWeight {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[aSize:], b[bSize:]
+	}
+	return len(a) - len(b)
+}
+
+func isDigit(s string) bool {
+	return s[0] >= '0' && s[0] <= '9'
+}
+
+func digitRun(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+func compareDigits(a string, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// primaryWeight maps a rune to its lower case base letter.
+func primaryWeight(r rune) rune {
+	r = unicode.ToLower(r)
+	if base, ok := baseLetters[r]; ok {
+		return base
+	}
+	return r
+}
+
+// caseWeight sorts lower case before upper case and leaves other runes
+// equal, so that only case differences remain at this level.
+func caseWeight(r rune) rune {
+	if unicode.IsUpper(r) {
+		return 1
+	}
+	return 0
+}
+
+// baseLetters removes accents from the lower case Latin letters of the
+// Latin-1 Supplement and Latin Extended-A blocks.
+var baseLetters = map[rune]rune{}
+
+func init() {
+	for base, accented := range map[rune]string{
+		'a': "àáâãäåāăą",
+		'c': "çćĉċč",
+		'd': "ďđ",
+		'e': "èéêëēĕėęě",
+		'g': "ĝğġģ",
+		'h': "ĥħ",
+		'i': "ìíîïĩīĭįı",
+		'j': "ĵ",
+		'k': "ķ",
+		'l': "ĺļľŀł",
+		'n': "ñńņňŉ",
+		'o': "òóôõöøōŏő",
+		'r': "ŕŗř",
+		's': "śŝşšſ",
+		't': "ţťŧ",
+		'u': "ùúûüũūŭůűų",
+		'w': "ŵ",
+		'y': "ýÿŷ",
+		'z': "źżž",
+	} {
+		for _, r := range accented {
+			baseLetters[r] = base
+		}
+	}
+}
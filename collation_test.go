@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func collation(t *testing.T, spec string) *Collation {
+	doc, err := decodeJson([]byte(`{"collation": ` + spec + `}`))
+	assert.Ok(t, err)
+	c, err := parseCollation(doc["collation"])
+	assert.Ok(t, err)
+	return c
+}
+
+func TestCollationCompareStrings(t *testing.T) {
+	primary := collation(t, `{"locale": "en", "strength": 1}`)
+	assert.Equals(t, 0, primary.CompareStrings("Résumé", "resume"))
+	assert.Equals(t, primary.Key("Résumé"), primary.Key("RESUME"))
+
+	secondary := collation(t, `{"locale": "en", "strength": 2}`)
+	assert.Equals(t, 0, secondary.CompareStrings("alice", "Alice"))
+	assert.Cond(t, secondary.CompareStrings("resume", "résumé") < 0, "accents are significant at strength 2")
+
+	tertiary := collation(t, `{"locale": "en"}`)
+	assert.Cond(t, tertiary.CompareStrings("alice", "Alice") < 0, "lower case sorts first")
+	assert.Cond(t, tertiary.CompareStrings("Alice", "bob") < 0, "letters sort before case")
+
+	caseLevel := collation(t, `{"locale": "en", "strength": 1, "caseLevel": true}`)
+	assert.Equals(t, 0, caseLevel.CompareStrings("resume", "résumé"))
+	assert.Cond(t, caseLevel.CompareStrings("resume", "Resume") != 0, "case is significant with caseLevel")
+
+	numeric := collation(t, `{"locale": "en", "numericOrdering": true}`)
+	assert.Cond(t, numeric.CompareStrings("file2", "file10") < 0, "digits compare by value")
+
+	var binary *Collation
+	assert.Cond(t, binary.CompareStrings("file2", "file10") > 0, "no collation compares bytes")
+
+	_, err := parseCollation(map[interface{}]interface{}{"locale": "sv"})
+	assert.Cond(t, err != nil, "tailored locales are rejected")
+}
+
+func TestCollationQueries(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "app", "users",
+		`{"name": "Alice"}`,
+		`{"name": "alice"}`,
+		`{"name": "bob"}`,
+		`{"name": "Émile"}`,
+	)
+
+	encDocs, err := query("app", "users", strings.NewReader(`{"name": "alice", "collation": {"locale": "en", "strength": 2}}`))
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(decodeDocs(t, encDocs)))
+
+	encDocs, err = query("app", "users", strings.NewReader(`{"name": "alice"}`))
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(decodeDocs(t, encDocs)))
+
+	encDocs, err = aggregate("app", "users", strings.NewReader(`{
+		"pipeline": [{"$sort": {"name": 1}}, {"$group": {"_id": "$name", "n": {"$count": {}}}}],
+		"collation": {"locale": "en", "strength": 1}
+	}`))
+	assert.Ok(t, err)
+	docs := decodeDocs(t, encDocs)
+	assert.Equals(t, 3, len(docs))
+	assert.Equals(t, uint64(2), docs[0]["n"])
+	assert.Equals(t, "bob", docs[1]["_id"])
+	assert.Equals(t, "Émile", docs[2]["_id"])
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Bolt reuses the pages freed by deletes but never shrinks its file, so a
+// database is compacted by copying its keys into a new file, in order and
+// with full pages, then swapping the file in. The copy runs in a write
+// transaction, so writes queue behind it while reads carry on. The old file
+// is closed once the transactions using it have finished; the writes queued
+// on it fail with errDbReplaced and run again on the new one. Compactions
+// run one at a time, and deleting or replacing a database waits for the one
+// in progress.
+
+// compactTxSize is the number of bytes copied in each transaction of the
+// new file.
+const compactTxSize = 64 << 20
+
+var compactMutex sync.Mutex
+
+type Compaction struct {
+	Db     string
+	Before int64
+	After  int64
+}
+
+// compactDb copies a database into a new file and swaps it in, returning
+// the size of the file before and after. The database keeps its old file
+// if the swap fails.
+func compactDb(name string) (*Compaction, error) {
+	compactMutex.Lock()
+	defer compactMutex.Unlock()
+	if _, err := os.Stat(dbFileName(name)); os.IsNotExist(err) {
+		return nil, errDbNotFound
+	}
+	db, err := getDb(name)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		db.release()
+		return nil, err
+	}
+
+	result := &Compaction{Db: name, Before: fileSize(dbFileName(name))}
+	path := dbFileName(name) + ".compact"
+	os.Remove(path)
+	if err := compactTo(path, tx); err != nil {
+		tx.Rollback()
+		db.release()
+		os.Remove(path)
+		return nil, err
+	}
+	result.After = fileSize(path)
+
+	// The writes queued behind tx find the database retired once it ends.
+	takeDb(name)
+	defer reopenDb(name)
+	db.retire(errDbReplaced)
+	tx.Rollback()
+	db.release()
+	if err := db.closeIdle(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	if err := os.Rename(path, dbFileName(name)); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return result, nil
+}
+
+// compactTo copies every bucket of src into a new database file at path.
+func compactTo(path string, src *bolt.Tx) error {
+	dst, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = copyBuckets(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func copyBuckets(dst *bolt.DB, src *bolt.Tx) error {
+	tx, err := dst.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() { tx.Rollback() }()
+	size := 0
+
+	// open returns the bucket at path in tx, creating it if needed.
+	open := func(path [][]byte) (*bolt.Bucket, error) {
+		bucket, err := tx.CreateBucketIfNotExists(path[0])
+		for _, name := range path[1:] {
+			if err != nil {
+				break
+			}
+			bucket, err = bucket.CreateBucketIfNotExists(name)
+		}
+		if bucket != nil {
+			bucket.FillPercent = 1
+		}
+		return bucket, err
+	}
+	var copyBucket func(path [][]byte, b *bolt.Bucket) error
+	copyBucket = func(path [][]byte, b *bolt.Bucket) error {
+		if _, err := open(path); err != nil {
+			return err
+		}
+		return b.ForEach(func(k []byte, v []byte) error {
+			if v == nil {
+				child := append(append([][]byte{}, path...), k)
+				return copyBucket(child, b.Bucket(k))
+			}
+			if size > compactTxSize {
+				if err := tx.Commit(); err != nil {
+					return err
+				}
+				if tx, err = dst.Begin(true); err != nil {
+					return err
+				}
+				size = 0
+			}
+			bucket, err := open(path)
+			if err != nil {
+				return err
+			}
+			size += len(k) + len(v)
+			return bucket.Put(k, v)
+		})
+	}
+	err = src.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return copyBucket([][]byte{name}, b)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The oplog numbers changes with the sequence of its bucket, which is
+	// the number of its latest entry, and bolt can only increment it.
+	if seq := oplogSeq(src); seq > 0 {
+		oplog := tx.Bucket([]byte(oplogBucket))
+		for n := uint64(0); n < seq; {
+			if n, err = oplog.NextSequence(); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hooklift/assert"
+)
+
+func TestCompact(t *testing.T) {
+	defer withTestDir(t)()
+	// Only the documents take space, not the oplog of their changes.
+	defer func(retention time.Duration) { oplogRetention = retention }(oplogRetention)
+	oplogRetention = time.Nanosecond
+	padding := strings.Repeat("x", 1000)
+	assert.Ok(t, updateCollection("app", "logs", func(bucket *bolt.Bucket) error {
+		for i := 0; i < 2000; i++ {
+			_, lookupId, err := NewId()
+			if err != nil {
+				return err
+			}
+			doc := map[interface{}]interface{}{"n": uint64(i), "padding": padding}
+			if _, err := putDoc(bucket, lookupId, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`)
+	assert.Ok(t, updateCollection("app", "logs", func(bucket *bolt.Bucket) error {
+		_, err := deleteMatching(bucket, map[interface{}]interface{}{"n": map[interface{}]interface{}{"$gte": uint64(10)}})
+		return err
+	}))
+	seq := func() (seq uint64) {
+		assert.Ok(t, readDb("app", func(tx *bolt.Tx) error {
+			seq = oplogSeq(tx)
+			return nil
+		}))
+		return seq
+	}
+	before := seq()
+
+	result, err := compactDb("app")
+	assert.Ok(t, err)
+	assert.Cond(t, result.After < result.Before, fmt.Sprintf("the file should shrink, from %d to %d bytes", result.Before, result.After))
+	assert.Equals(t, result.After, fileSize(dbFileName("app")))
+	assert.Equals(t, 10, countDocs(t, "app", "logs", `{}`))
+	assert.Equals(t, 1, countDocs(t, "app", "users", `{}`))
+
+	// The oplog carries on from the same sequence.
+	assert.Equals(t, before, seq())
+	insertTestDocs(t, "app", "users", `{"name": "bob"}`)
+	changes, err := oplogChanges(t, "app", before)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(changes))
+	assert.Equals(t, before+1, changes[0].Seq)
+
+	var backup bytes.Buffer
+	assert.Ok(t, backupDb("app", &backup, false))
+	assert.Ok(t, restoreDb("copy", &backup))
+	assert.Equals(t, 2, countDocs(t, "copy", "users", `{}`))
+
+	_, err = compactDb("missing")
+	assert.Equals(t, errDbNotFound, err)
+}
+
+func TestCompactWhileWriting(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`)
+	// Enough data for copies to take a while.
+	_, err := bulk("app", "", strings.NewReader(strings.Repeat(`{"op": "insert", "collection": "logs", "doc": {"padding": "`+strings.Repeat("x", 1000)+`"}}
+`, 2000)))
+	assert.Ok(t, err)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				_, err := insertDoc("app", "users", strings.NewReader(`{"name": "bob"}`))
+				assert.Ok(t, err)
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		_, err := compactDb("app")
+		assert.Ok(t, err)
+	}
+	wg.Wait()
+
+	// Writes queued behind a compaction land in the new file.
+	assert.Equals(t, 201, countDocs(t, "app", "users", `{}`))
+	changes, err := oplogChanges(t, "app", 2001)
+	assert.Ok(t, err)
+	assert.Equals(t, 200, len(changes))
+}
+
+// holdRead starts a read of a database and keeps it open until the
+// returned function is called, which returns the number of documents the
+// read then finds in collection.
+func holdRead(t *testing.T, db string, collection string) func() int {
+	started, finish := make(chan struct{}), make(chan struct{})
+	found := make(chan int)
+	go func() {
+		n := 0
+		err := readDb(db, func(tx *bolt.Tx) error {
+			close(started)
+			<-finish
+			return tx.Bucket([]byte(collection)).ForEach(func(k []byte, v []byte) error {
+				n++
+				return nil
+			})
+		})
+		assert.Ok(t, err)
+		found <- n
+	}()
+	<-started
+	return func() int {
+		close(finish)
+		return <-found
+	}
+}
+
+// waitsFor runs f, checking that it doesn't return before release is
+// called.
+func waitsFor(t *testing.T, release func() int, f func() error) int {
+	done := make(chan error)
+	go func() { done <- f() }()
+	select {
+	case <-done:
+		t.Fatal("the file was closed under a read")
+	case <-time.After(50 * time.Millisecond):
+	}
+	n := release()
+	assert.Ok(t, <-done)
+	return n
+}
+
+func TestCompactWaitsForReads(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+
+	release := holdRead(t, "app", "users")
+	n := waitsFor(t, release, func() error {
+		_, err := compactDb("app")
+		return err
+	})
+	assert.Equals(t, 2, n)
+	insertTestDocs(t, "app", "users", `{"name": "cy"}`)
+	assert.Equals(t, 3, countDocs(t, "app", "users", `{}`))
+}
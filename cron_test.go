@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	// A Friday.
+	now := time.Date(2015, 5, 15, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2015, 5, 15, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, 5, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2015, 5, 16, 3, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2015, 5, 16, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2015, 5, 15, 11, 0, 0, 0, time.UTC)},
+		{"30 9-17/4 * * 1-5", time.Date(2015, 5, 15, 13, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2015, 5, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,20 2 *", time.Date(2016, 2, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted.
+		{"0 12 20 * 1", time.Date(2015, 5, 18, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		s, err := parseSchedule(test.spec)
+		assert.Ok(t, err)
+		assert.Equals(t, test.next, s.next(now))
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "0 0 30 2 *"} {
+		_, err := parseSchedule(spec)
+		assert.Cond(t, err != nil, spec+" should be refused")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Dates are written in extended JSON as {"$date": "2015-05-10T12:00:00+02:00"},
+// with an RFC 3339 string, or as {"$date": 1431252000000} and
+// {"$date": {"$numberLong": "1431252000000"}}, with milliseconds since the
+// Unix epoch. They are stored as sent and compared by the instant they
+// name, so the offset a client used does not change ordering.
+const dateKey = "$date"
+
+func isDate(v interface{}) bool {
+	_, ok := dateValue(v)
+	return ok
+}
+
+func dateValue(v interface{}) (time.Time, bool) {
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok || len(obj) != 1 {
+		return time.Time{}, false
+	}
+	value, ok := obj[dateKey]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := parseDate(value)
+	return t, err == nil
+}
+
+func parseDate(value interface{}) (time.Time, error) {
+	switch value := value.(type) {
+	case string:
+		return time.Parse(time.RFC3339Nano, value)
+	case map[interface{}]interface{}:
+		if s, ok := value["$numberLong"].(string); ok && len(value) == 1 {
+			ms, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return msTime(ms), nil
+		}
+	default:
+		if ms, ok := intValue(value); ok {
+			return msTime(ms), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid date %v", value)
+}
+
+func msTime(ms int64) time.Time {
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)).UTC()
+}
+
+func NewDate(t time.Time) map[interface{}]interface{} {
+	return map[interface{}]interface{}{dateKey: t.UTC().Format(time.RFC3339Nano)}
+}
+
+func compareDates(a time.Time, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// isExtendedJson reports whether an object is a single value written in
+// extended JSON rather than an object or a set of query operators.
+func isExtendedJson(v interface{}) bool {
+	if obj, ok := v.(map[interface{}]interface{}); ok && len(obj) == 1 {
+		_, isDate := obj[dateKey]
+		_, isDecimal := obj[decimalKey]
+		return isDate || isDecimal
+	}
+	return false
+}
+
+// validateExtendedJson rejects malformed dates and decimals before they are
+// stored, since they would otherwise be matched as plain objects.
+func validateExtendedJson(v interface{}) error {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		if isExtendedJson(v) {
+			if !isDate(v) && !isNumber(v) {
+				return fmt.Errorf("Invalid extended JSON value %v", v)
+			}
+			return nil
+		}
+		for _, value := range v {
+			if err := validateExtendedJson(value); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if err := validateExtendedJson(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
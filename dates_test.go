@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestDateQueries(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "cal", "events",
+		`{"name": "a", "at": {"$date": "2015-05-10T12:00:00+02:00"}}`,
+		`{"name": "b", "at": {"$date": "2015-05-10T11:00:00Z"}}`,
+		`{"name": "c", "at": {"$date": 1431259200000}}`,
+		`{"name": "d", "at": "2015-05-10T09:00:00Z"}`,
+	)
+
+	for q, expected := range map[string]int{
+		`{"at": {"$date": "2015-05-10T10:00:00Z"}}`:                1,
+		`{"at": {"$gt": {"$date": "2015-05-10T10:30:00Z"}}}`:       2,
+		`{"at": {"$lte": {"$date": "2015-05-10T13:00:00+02:00"}}}`: 2,
+	} {
+		encDocs, err := query("cal", "events", strings.NewReader(q))
+		assert.Ok(t, err)
+		assert.Equals(t, expected, len(decodeDocs(t, encDocs)))
+	}
+
+	docs := aggregateDocs(t, "cal", "events", `[
+		{"$match": {"at": {"$gte": {"$date": 0}}}},
+		{"$sort": {"at": -1}}
+	]`)
+	assert.Equals(t, 3, len(docs))
+	assert.Equals(t, "c", docs[0]["name"])
+	assert.Equals(t, "a", docs[2]["name"])
+	assert.Equals(t, map[interface{}]interface{}{"$date": "2015-05-10T12:00:00+02:00"}, docs[2]["at"])
+
+	_, err := insertDoc("cal", "events", strings.NewReader(`{"at": {"$date": "yesterday"}}`))
+	assert.Cond(t, err != nil, "invalid dates should be rejected")
+}
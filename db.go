@@ -5,7 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/ugorji/go/codec"
@@ -13,75 +18,298 @@ import (
 
 type (
 	BucketHandler   func(*bolt.Bucket) error
+	TxHandler       func(*bolt.Tx) error
 	QueryHandler    func(*bolt.Bucket, []byte, []byte, map[interface{}]interface{}) error
 	TransactionFunc func(string, string, BucketHandler) error
 )
 
 var jh codec.Handle = new(codec.JsonHandle)
 
+var errDocNotFound = errors.New("Document not found")
+
 func dbFileName(name string) string {
 	return fmt.Sprintf("%s/%s.db", rootDir, name)
 }
 
-func getDb(name string) (*bolt.DB, error) {
+// An openDb is an open database file. Every use of it holds a reference,
+// taken by getDb and dropped by release, and the file is closed only once
+// the last one is dropped.
+type openDb struct {
+	*bolt.DB
+
+	mutex sync.Mutex
+	idle  *sync.Cond
+	users int
+	// gone is returned by the transactions still waiting for the file
+	// once it is being closed.
+	gone error
+}
+
+// closingDbs holds the databases being closed, which can't be opened again
+// until their file is deleted or replaced. dbsClosed is signalled when one
+// is done.
+var (
+	closingDbs = map[string]bool{}
+	dbsClosed  = sync.NewCond(&dbsMutex)
+)
+
+// errDbReplaced is returned by a transaction that waited for a database
+// file that was replaced, and runs again on the new one.
+var errDbReplaced = errors.New("Database file was replaced")
+
+// getDb opens a database, or returns it if it is open, with a reference
+// the caller releases.
+func getDb(name string) (*openDb, error) {
+	dbsMutex.Lock()
+	defer dbsMutex.Unlock()
+	for closingDbs[name] {
+		dbsClosed.Wait()
+	}
 	if db, ok := dbs[name]; ok {
+		db.acquire()
 		return db, nil
 	}
 
-	db, err := bolt.Open(dbFileName(name), 0600, nil)
+	file, err := bolt.Open(dbFileName(name), 0600, nil)
 	if err != nil {
 		return nil, err
 	}
+	var seq uint64
+	file.View(func(tx *bolt.Tx) error {
+		seq = oplogSeq(tx)
+		return nil
+	})
+	hub.open(name, seq)
+	db := &openDb{DB: file}
+	db.idle = sync.NewCond(&db.mutex)
+	db.acquire()
 	dbs[name] = db
 	return db, nil
 }
 
+func (db *openDb) acquire() {
+	db.mutex.Lock()
+	db.users++
+	db.mutex.Unlock()
+}
+
+func (db *openDb) release() {
+	db.mutex.Lock()
+	if db.users--; db.users == 0 {
+		db.idle.Broadcast()
+	}
+	db.mutex.Unlock()
+}
+
+// err returns the error of a transaction that got the database before it
+// started closing, nil while it is open.
+func (db *openDb) err() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.gone
+}
+
+// retire makes the transactions still waiting for the database fail with
+// err.
+func (db *openDb) retire(err error) {
+	db.mutex.Lock()
+	db.gone = err
+	db.mutex.Unlock()
+}
+
+// closeIdle closes the file once every reference is released.
+func (db *openDb) closeIdle() error {
+	db.mutex.Lock()
+	for db.users > 0 {
+		db.idle.Wait()
+	}
+	db.mutex.Unlock()
+	return db.DB.Close()
+}
+
+// takeDb stops a database from being used until reopenDb, and returns it
+// if it is open.
+func takeDb(name string) *openDb {
+	dbsMutex.Lock()
+	defer dbsMutex.Unlock()
+	for closingDbs[name] {
+		dbsClosed.Wait()
+	}
+	closingDbs[name] = true
+	db := dbs[name]
+	delete(dbs, name)
+	return db
+}
+
+func reopenDb(name string) {
+	dbsMutex.Lock()
+	delete(closingDbs, name)
+	dbsClosed.Broadcast()
+	dbsMutex.Unlock()
+}
+
+// closeDb closes a database once the transactions using it have finished,
+// and runs fn on its file. Transactions waiting for the database fail with
+// gone. The database is reopened on its next use.
+func closeDb(name string, gone error, fn func() error) error {
+	defer reopenDb(name)
+	if db := takeDb(name); db != nil {
+		db.retire(gone)
+		if err := db.closeIdle(); err != nil {
+			return err
+		}
+	}
+	return fn()
+}
+
 func deleteDb(name string) error {
-	db, err := getDb(name)
-	if err != nil {
+	compactMutex.Lock()
+	defer compactMutex.Unlock()
+	return closeDb(name, errDbNotFound, func() error {
+		err := os.Remove(dbFileName(name))
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
+	})
+}
+
+// replaceDb replaces the file of a database with the one at path. Writes
+// waiting for the old file run again on the new one.
+func replaceDb(name string, path string) error {
+	compactMutex.Lock()
+	defer compactMutex.Unlock()
+	return closeDb(name, errDbReplaced, func() error {
+		return os.Rename(path, dbFileName(name))
+	})
+}
+
+// addDb moves the database file at path in place as a new database.
+func addDb(name string, path string) error {
+	dbsMutex.Lock()
+	defer dbsMutex.Unlock()
+	for closingDbs[name] {
+		dbsClosed.Wait()
+	}
+	if _, err := os.Stat(dbFileName(name)); err == nil {
+		return errDbExists
 	}
-	db.Close()
-	return os.Remove(dbFileName(name))
+	return os.Rename(path, dbFileName(name))
+}
+
+// listDatabases returns the names of the databases in the data directory.
+func listDatabases() ([]string, error) {
+	files, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".db") {
+			names = append(names, strings.TrimSuffix(file.Name(), ".db"))
+		}
+	}
+	return names, nil
+}
+
+// listCollections returns the names of the collections of a database,
+// leaving out the buckets the server keeps beside them.
+func listCollections(dbName string) ([]string, error) {
+	names := []string{}
+	err := readDb(dbName, func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if validCollectionName(string(name)) {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	return names, err
 }
 
 func insertDoc(db string, collection string, docReader io.Reader) (*bytes.Buffer, error) {
-	doc, err := decodeJson(docReader)
+	doc, lookupId, err := parseNewDoc(docReader)
 	if err != nil {
 		return nil, err
 	}
 
+	var encDoc *bytes.Buffer
+	err = updateCollection(db, collection, func(bucket *bolt.Bucket) error {
+		encDoc, err = putDoc(bucket, lookupId, doc)
+		return err
+	})
+	return encDoc, err
+}
+
+// parseNewDoc reads and validates a document to insert and returns it with
+// its lookup id.
+func parseNewDoc(docReader interface{}) (map[interface{}]interface{}, []byte, error) {
+	doc, err := decodeJson(docReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validateExtendedJson(doc); err != nil {
+		return nil, nil, err
+	}
+	lookupId, err := docLookupId(doc)
+	return doc, lookupId, err
+}
+
+// docLookupId returns the lookup id of a new document, giving it an id if
+// it has none.
+func docLookupId(doc map[interface{}]interface{}) ([]byte, error) {
 	id, ok := doc["_id"]
-	var lookupId []byte
 	if !ok {
-		id, lookupId, err = NewId()
+		id, lookupId, err := NewId()
 		if err != nil {
 			return nil, err
 		}
 		doc["_id"] = id
-	} else {
-		id, ok := id.(string)
-		if !ok {
-			return nil, errors.New("ID must be a string UUID")
+		return lookupId, nil
+	}
+	strId, ok := id.(string)
+	if !ok {
+		return nil, errors.New("ID must be a string UUID")
+	}
+	return ParseId(strId)
+}
+
+// putDoc stores a new version of a document. Replacing a document keeps
+// its history, and only goes through if the document is at the revision
+// doc names in _rev, if any.
+func putDoc(bucket *bolt.Bucket, lookupId []byte, doc map[interface{}]interface{}) (*bytes.Buffer, error) {
+	rev, err := takeMetadata(doc)
+	if err != nil {
+		return nil, err
+	}
+	if existing := bucket.Get(lookupId); existing != nil {
+		if err := checkRev(existing, rev); err != nil {
+			return nil, err
 		}
-		lookupId, err = ParseId(id)
+		existingDoc, err := decodeJson(existing)
 		if err != nil {
 			return nil, err
 		}
+		for _, field := range []string{createdAtField, revField} {
+			if v, ok := existingDoc[field]; ok {
+				doc[field] = v
+			}
+		}
 	}
+	touchDoc(doc, lookupId, time.Now())
 
 	encDoc, err := encodeDoc(doc)
 	if err != nil {
 		return nil, err
 	}
-
-	err = updateCollection(db, collection, func(bucket *bolt.Bucket) error {
-		return bucket.Put(lookupId, encDoc.Bytes())
-	})
-	return encDoc, err
+	return encDoc, putDocValue(bucket, lookupId, encDoc.Bytes())
 }
 
-func updateDoc(db string, collection string, id string, updateReader interface{}) ([]byte, error) {
+// updateDoc applies update to the document with the given id, or creates
+// it from update when it does not exist and upsert is set. When
+// expectedRev is not zero, the update only goes through if the document is
+// still at that revision, and fails with errRevisionMismatch otherwise.
+func updateDoc(db string, collection string, id string, updateReader interface{}, expectedRev uint64, upsert bool) ([]byte, error) {
 	update, err := decodeJson(updateReader)
 	if err != nil {
 		return nil, err
@@ -94,14 +322,91 @@ func updateDoc(db string, collection string, id string, updateReader interface{}
 
 	var encDoc *bytes.Buffer
 	err = updateCollection(db, collection, func(bucket *bolt.Bucket) error {
-		originalDoc := bucket.Get(lookupId)
-		encDoc, err = updateDocValue(originalDoc, update, bucket)
-		if err != nil {
-			return err
+		encDoc, err = updateById(bucket, lookupId, update, expectedRev, upsert)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encDoc.Bytes(), nil
+}
+
+func updateById(bucket *bolt.Bucket, lookupId []byte, update map[interface{}]interface{}, expectedRev uint64, upsert bool) (*bytes.Buffer, error) {
+	originalDoc := bucket.Get(lookupId)
+	if err := checkRev(originalDoc, expectedRev); err != nil {
+		return nil, err
+	}
+	if originalDoc == nil {
+		if !upsert {
+			return nil, errDocNotFound
 		}
-		return bucket.Put(lookupId, encDoc.Bytes())
+		return upsertDoc(bucket, map[interface{}]interface{}{"_id": IdString(lookupId)}, update)
+	}
+	encDoc, err := updateDocValue(lookupId, originalDoc, update)
+	if err != nil {
+		return nil, err
+	}
+	return encDoc, putDocValue(bucket, lookupId, encDoc.Bytes())
+}
+
+// checkRev fails with errRevisionMismatch unless expectedRev is zero or the
+// revision of doc.
+func checkRev(doc []byte, expectedRev uint64) error {
+	if expectedRev == 0 {
+		return nil
+	}
+	rev, err := docRev(doc)
+	if err != nil {
+		return err
+	}
+	if rev != expectedRev {
+		return errRevisionMismatch
+	}
+	return nil
+}
+
+// deleteDoc removes the document with the given id. When expectedRev is not
+// zero, the document must still be at that revision.
+func deleteDoc(db string, collection string, id string, expectedRev uint64) error {
+	lookupId, err := ParseId(id)
+	if err != nil {
+		return err
+	}
+	return updateCollection(db, collection, func(bucket *bolt.Bucket) error {
+		deleted, err := deleteById(bucket, lookupId, expectedRev)
+		if err == nil && !deleted {
+			err = errDocNotFound
+		}
+		return err
 	})
-	return encDoc.Bytes(), err
+}
+
+func deleteById(bucket *bolt.Bucket, lookupId []byte, expectedRev uint64) (bool, error) {
+	doc := bucket.Get(lookupId)
+	if err := checkRev(doc, expectedRev); err != nil || doc == nil {
+		return false, err
+	}
+	return true, deleteDocValue(bucket, lookupId)
+}
+
+// deleteMatching removes the documents matching query and returns how many
+// it removed.
+func deleteMatching(bucket *bolt.Bucket, query map[interface{}]interface{}) (uint64, error) {
+	// Deleting moves the cursor, so keys are collected first.
+	var keys [][]byte
+	_, err := runQuery(bucket, query, func(bucket *bolt.Bucket, key []byte, value []byte, doc map[interface{}]interface{}) error {
+		keys = append(keys, append([]byte{}, key...))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		if err := deleteDocValue(bucket, key); err != nil {
+			return 0, err
+		}
+	}
+	return uint64(len(keys)), nil
 }
 
 func query(db string, collection string, queryReader io.Reader) ([]byte, error) {
@@ -110,11 +415,6 @@ func query(db string, collection string, queryReader io.Reader) ([]byte, error)
 		return nil, err
 	}
 
-	id, ok := queryMap["_id"]
-	if ok {
-		return findDoc(db, collection, id.(string))
-	}
-
 	var docs []byte
 	err = iterateQuery(db, collection, queryMap, readCollection, func(bucket *bolt.Bucket, key []byte, value []byte, doc map[interface{}]interface{}) error {
 		docs = append(docs, value...)
@@ -138,27 +438,86 @@ func updateQuery(db string, collection string, queryReader io.Reader) ([]byte, e
 	if !ok {
 		return nil, errors.New("Cannot update without an update object")
 	}
+	upsert, _ := updateMap["upsert"].(bool)
 
 	id, ok := queryMap["_id"]
 	if ok {
-		return updateDoc(db, collection, id.(string), update)
+		return updateDoc(db, collection, id.(string), update, 0, upsert)
 	}
 
 	var docs []byte
-	err = iterateQuery(db, collection, queryMap, updateCollection, func(bucket *bolt.Bucket, key []byte, value []byte, doc map[interface{}]interface{}) error {
-		updated, err := updateDocValue(value, update, bucket)
-		if err != nil {
-			return err
-		}
+	err = updateCollection(db, collection, func(bucket *bolt.Bucket) error {
+		docs, err = updateMatching(bucket, queryMap, update, upsert)
+		return err
+	})
+	return docs, err
+}
 
-		err = bucket.Put(key, updated.Bytes())
+// updateMatching applies update to every document matching query and
+// returns the updated documents. Every update is computed before any is
+// written, so a failing update leaves the collection unchanged.
+func updateMatching(bucket *bolt.Bucket, query map[interface{}]interface{}, update map[interface{}]interface{}, upsert bool) ([]byte, error) {
+	var keys [][]byte
+	var updates []*bytes.Buffer
+	_, err := runQuery(bucket, query, func(bucket *bolt.Bucket, key []byte, value []byte, doc map[interface{}]interface{}) error {
+		updated, err := updateDocValue(key, value, update)
 		if err != nil {
 			return err
 		}
-		docs = append(docs, updated.Bytes()...)
+		keys = append(keys, append([]byte{}, key...))
+		updates = append(updates, updated)
 		return nil
 	})
-	return docs, err
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys) == 0 && upsert {
+		inserted, err := upsertDoc(bucket, query, update)
+		if err != nil {
+			return nil, err
+		}
+		return inserted.Bytes(), nil
+	}
+
+	var docs []byte
+	for i, key := range keys {
+		if err := putDocValue(bucket, key, updates[i].Bytes()); err != nil {
+			return nil, err
+		}
+		docs = append(docs, updates[i].Bytes()...)
+	}
+	return docs, nil
+}
+
+// upsertDoc inserts the document an update creates when its query matches
+// nothing: the fields the query tests for equality, with the update
+// applied.
+func upsertDoc(bucket *bolt.Bucket, query map[interface{}]interface{}, update map[interface{}]interface{}) (*bytes.Buffer, error) {
+	doc := map[interface{}]interface{}{}
+	for k, v := range query {
+		if k == "limit" || k == "collation" || k == exprKey {
+			continue
+		}
+		if _, isOps := queryOperators(v); !isOps {
+			doc[k] = v
+		}
+	}
+	if err := validateExtendedJson(doc); err != nil {
+		return nil, err
+	}
+	if _, err := takeMetadata(doc); err != nil {
+		return nil, err
+	}
+	if err := applyUpdate(doc, update); err != nil {
+		return nil, err
+	}
+
+	lookupId, err := docLookupId(doc)
+	if err != nil {
+		return nil, err
+	}
+	return putDoc(bucket, lookupId, doc)
 }
 
 func findDoc(db string, collection string, id string) ([]byte, error) {
@@ -169,25 +528,75 @@ func findDoc(db string, collection string, id string) ([]byte, error) {
 
 	var doc []byte
 	err = readCollection(db, collection, func(bucket *bolt.Bucket) error {
-		doc = bucket.Get(lookupId)
+		if bucket != nil {
+			// Values are only valid during the transaction.
+			if v := bucket.Get(lookupId); v != nil {
+				doc = append([]byte{}, v...)
+			}
+		}
 		return nil
 	})
 	return doc, err
 }
 
-func updateDocValue(originalDoc []byte, update map[interface{}]interface{}, bucket *bolt.Bucket) (*bytes.Buffer, error) {
-	doc, err := decodeJson(originalDoc)
+// findDocs fetches the documents with the ids listed in {"ids": [...]} in
+// one read transaction. They are returned in the order requested, with
+// {"_id": id, "error": "..."} in place of ids that are invalid or not found.
+func findDocs(db string, collection string, reader io.Reader) ([]byte, error) {
+	request, err := decodeJson(reader)
 	if err != nil {
 		return nil, err
 	}
+	ids, ok := request["ids"].([]interface{})
+	if !ok {
+		return nil, errors.New("Multi-get requires an array of ids")
+	}
 
-	for k, v := range update {
-		if k == "_id" {
-			return nil, errors.New("Can't update ID on update")
+	missing := func(id interface{}, err error) ([]byte, error) {
+		encDoc, encErr := encodeDoc(map[interface{}]interface{}{"_id": id, "error": err.Error()})
+		if encErr != nil {
+			return nil, encErr
 		}
-		doc[k] = v
+		return encDoc.Bytes(), nil
 	}
 
+	var docs []byte
+	err = readCollection(db, collection, func(bucket *bolt.Bucket) error {
+		for _, id := range ids {
+			var doc []byte
+			strId, ok := id.(string)
+			lookupId, err := ParseId(strId)
+			if !ok {
+				err = errors.New("ID must be a string UUID")
+			}
+			if err == nil && bucket != nil {
+				doc = bucket.Get(lookupId)
+			}
+			if doc == nil {
+				if err == nil {
+					err = errDocNotFound
+				}
+				if doc, err = missing(id, err); err != nil {
+					return err
+				}
+			}
+			docs = append(docs, doc...)
+		}
+		return nil
+	})
+	return docs, err
+}
+
+func updateDocValue(lookupId []byte, originalDoc []byte, update map[interface{}]interface{}) (*bytes.Buffer, error) {
+	doc, err := decodeJson(originalDoc)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyUpdate(doc, update); err != nil {
+		return nil, err
+	}
+	touchDoc(doc, lookupId, time.Now())
+
 	encDoc, err := encodeDoc(doc)
 	if err != nil {
 		return nil, err
@@ -196,20 +605,194 @@ func updateDocValue(originalDoc []byte, update map[interface{}]interface{}, buck
 	return encDoc, err
 }
 
-func queryMatch(doc map[interface{}]interface{}, query map[interface{}]interface{}) bool {
+// applyUpdate sets the fields of update on doc. The metadata fields of
+// update are not set, and a _rev in update must be the revision of doc.
+func applyUpdate(doc map[interface{}]interface{}, update map[interface{}]interface{}) error {
+	if err := validateExtendedJson(update); err != nil {
+		return err
+	}
+	rev, err := metadataRev(update)
+	if err != nil {
+		return err
+	}
+	if current, _ := intValue(doc[revField]); rev != 0 && uint64(current) != rev {
+		return errRevisionMismatch
+	}
+
+	// Computed values, written {"$expr": expression}, are evaluated against
+	// the document as it was before the update.
+	scope := NewExprScope(doc, nil)
+	updated := make(map[interface{}]interface{}, len(update))
+	for k, v := range update {
+		if k == "_id" {
+			return errors.New("Can't update ID on update")
+		}
+		if isMetadataField(k) {
+			continue
+		}
+		if expr, ok := v.(map[interface{}]interface{}); ok && len(expr) == 1 {
+			if exprV, ok := expr[exprKey]; ok {
+				var err error
+				if v, err = evalExpr(scope, exprV); err != nil {
+					return err
+				}
+			}
+		}
+		updated[k] = v
+	}
+	for k, v := range updated {
+		doc[k] = v
+	}
+	return nil
+}
+
+// exprKey marks a computed expression, as a query condition that compares
+// fields of the document, {"$expr": {"$gt": ["$spent", "$budget"]}}, or as
+// an update value.
+const exprKey = "$expr"
+
+// checkQuery rejects a query that names an unknown operator, in a field
+// condition or its $expr, before any document is read.
+func checkQuery(query map[interface{}]interface{}) error {
+	for k, queryV := range query {
+		if k == exprKey {
+			if err := checkExpr(queryV); err != nil {
+				return err
+			}
+			continue
+		}
+		if name, ok := k.(string); ok && strings.HasPrefix(name, "$") {
+			return fmt.Errorf("Unknown query operator %s", name)
+		}
+		ops, isOps := queryOperators(queryV)
+		if !isOps {
+			continue
+		}
+		for op, v := range ops {
+			switch op {
+			case "$exists", "$ne", "$gt", "$gte", "$lt", "$lte":
+			case "$in", "$nin":
+				if _, ok := v.([]interface{}); !ok {
+					return fmt.Errorf("%s needs an array", op)
+				}
+			default:
+				return fmt.Errorf("Unknown query operator %s", op)
+			}
+		}
+	}
+	return nil
+}
+
+// queryMatch reports whether doc matches query. Errors evaluating the
+// query's $expr, such as a division by zero, are returned rather than
+// taken for a mismatch.
+func queryMatch(doc map[interface{}]interface{}, query map[interface{}]interface{}, coll *Collation) (bool, error) {
+	if expr, ok := query[exprKey]; ok {
+		result, err := evalExpr(NewExprScope(doc, nil), expr)
+		if err != nil || !truthy(result) {
+			return false, err
+		}
+	}
+	return fieldsMatch(doc, query, coll), nil
+}
+
+// fieldsMatch compares the fields of doc with the conditions of query.
+func fieldsMatch(doc map[interface{}]interface{}, query map[interface{}]interface{}, coll *Collation) bool {
 	for k, queryV := range query {
+		if k == exprKey {
+			continue
+		}
 		docV, ok := doc[k]
+		if ops, isOps := queryOperators(queryV); isOps {
+			if !operatorMatch(docV, ok, ops, coll) {
+				return false
+			}
+			continue
+		}
 		if !ok {
 			return false
 		}
-		if !valueMatch(docV, queryV) {
+		if !valueMatch(docV, queryV, coll) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryOperators returns the operators of a query value like
+// {"$gte": 1, "$lt": 10}. Every key must be an operator.
+func queryOperators(queryV interface{}) (map[interface{}]interface{}, bool) {
+	ops, ok := queryV.(map[interface{}]interface{})
+	if !ok || len(ops) == 0 || isExtendedJson(ops) {
+		return nil, false
+	}
+	for k := range ops {
+		if name, ok := k.(string); !ok || !strings.HasPrefix(name, "$") {
+			return nil, false
+		}
+	}
+	return ops, true
+}
+
+func operatorMatch(docV interface{}, exists bool, ops map[interface{}]interface{}, coll *Collation) bool {
+	for op, v := range ops {
+		var match bool
+		switch op {
+		case "$exists":
+			match = exists == truthy(v)
+		case "$ne":
+			match = !exists || !valueMatch(docV, v, coll)
+		case "$in", "$nin":
+			values, ok := v.([]interface{})
+			if !ok {
+				return false
+			}
+			match = exists && sliceMatchValue(values, docV, true, coll)
+			if op == "$nin" {
+				match = !match
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			match = exists && rangeMatch(docV, op.(string), v, coll)
+		default:
+			return false
+		}
+		if !match {
 			return false
 		}
 	}
 	return true
 }
 
-func valueMatch(docV interface{}, queryV interface{}) bool {
+// rangeMatch compares values of the same type; an array matches when any
+// of its elements does.
+func rangeMatch(docV interface{}, op string, queryV interface{}, coll *Collation) bool {
+	if docSlice, ok := docV.([]interface{}); ok {
+		for _, v := range docSlice {
+			if rangeMatch(v, op, queryV, coll) {
+				return true
+			}
+		}
+		return false
+	}
+	if typeRank(docV) != typeRank(queryV) {
+		return false
+	}
+
+	c := compareCollated(docV, queryV, coll)
+	switch op {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	case "$lte":
+		return c <= 0
+	}
+	return false
+}
+
+func valueMatch(docV interface{}, queryV interface{}, coll *Collation) bool {
 	// bool
 	vBool, vOk := queryV.(bool)
 	docBool, docOk := docV.(bool)
@@ -217,71 +800,76 @@ func valueMatch(docV interface{}, queryV interface{}) bool {
 		return vBool == docBool
 	}
 
-	// uint64
-	vInt, vOk := queryV.(uint64)
-	docInt, docOk := docV.(uint64)
-	if vOk && docOk {
-		return vInt == docInt
+	// number
+	if isNumber(queryV) && isNumber(docV) {
+		return compareNumbers(docV, queryV) == 0
 	}
 
-	// float64
-	vFloat, vOk := queryV.(float64)
-	docFloat, docOk := docV.(float64)
+	// date
+	vTime, vOk := dateValue(queryV)
+	docTime, docOk := dateValue(docV)
 	if vOk && docOk {
-		return vFloat == docFloat
+		return vTime.Equal(docTime)
+	}
+	if vOk || docOk {
+		_, vSlice := queryV.([]interface{})
+		_, docSlice := docV.([]interface{})
+		if !vSlice && !docSlice {
+			return false
+		}
 	}
 
 	// string
 	vStr, vOk := queryV.(string)
 	docStr, docOk := docV.(string)
 	if vOk && docOk {
-		return vStr == docStr
+		return coll.CompareStrings(docStr, vStr) == 0
 	}
 
 	// object
 	vObj, vOk := queryV.(map[interface{}]interface{})
 	docObj, docOk := docV.(map[interface{}]interface{})
 	if vOk && docOk {
-		return queryMatch(docObj, vObj)
+		return fieldsMatch(docObj, vObj, coll)
 	}
 
 	// slice
 	vSlice, vOk := queryV.([]interface{})
 	docSlice, docOk := docV.([]interface{})
 	if vOk && docOk {
-		return sliceMatch(docSlice, vSlice)
+		return sliceMatch(docSlice, vSlice, coll)
 	}
 	if vOk {
-		return sliceMatchValue(vSlice, docV, true)
+		return sliceMatchValue(vSlice, docV, true, coll)
 	}
 	if docOk {
-		return sliceMatchValue(docSlice, queryV, false)
+		return sliceMatchValue(docSlice, queryV, false, coll)
 	}
 
 	// not comparable
 	return false
 }
 
-func sliceMatch(docSlice []interface{}, vSlice []interface{}) bool {
+func sliceMatch(docSlice []interface{}, vSlice []interface{}, coll *Collation) bool {
 	if len(vSlice) != len(docSlice) {
 		return false
 	}
 	for i, v := range vSlice {
-		if !valueMatch(docSlice[i], v) {
+		if !valueMatch(docSlice[i], v, coll) {
 			return false
 		}
 	}
 	return true
 }
 
-func sliceMatchValue(slice []interface{}, value interface{}, sliceQuery bool) bool {
+func sliceMatchValue(slice []interface{}, value interface{}, sliceQuery bool, coll *Collation) bool {
 	for _, v := range slice {
 		if sliceQuery {
-			if valueMatch(value, v) {
+			if valueMatch(value, v, coll) {
 				return true
 			}
 		} else {
-			if valueMatch(v, value) {
+			if valueMatch(v, value, coll) {
 				return true
 			}
 		}
@@ -289,59 +877,250 @@ func sliceMatchValue(slice []interface{}, value interface{}, sliceQuery bool) bo
 	return false
 }
 
-func updateCollection(dbName string, collection string, handler BucketHandler) error {
-	db, err := getDb(dbName)
-	if err != nil {
-		return err
+func compareValues(a interface{}, b interface{}) int {
+	return compareCollated(a, b, nil)
+}
+
+// compareCollated orders any two values, comparing strings under coll.
+func compareCollated(a interface{}, b interface{}, coll *Collation) int {
+	aRank, bRank := typeRank(a), typeRank(b)
+	if aRank != bRank {
+		return aRank - bRank
 	}
+	if aRank == numberRank {
+		return compareNumbers(a, b)
+	}
+	if aRank == dateRank {
+		aTime, _ := dateValue(a)
+		bTime, _ := dateValue(b)
+		return compareDates(aTime, bTime)
+	}
+
+	switch a := a.(type) {
+	case bool:
+		b := b.(bool)
+		if a == b {
+			return 0
+		}
+		if !a {
+			return -1
+		}
+		return 1
+	case string:
+		return coll.CompareStrings(a, b.(string))
+	case map[interface{}]interface{}:
+		return compareObjects(a, b.(map[interface{}]interface{}), coll)
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := compareCollated(a[i], b[i], coll); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	}
+	return 0
+}
 
-	return db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(collection))
+func compareObjects(a map[interface{}]interface{}, b map[interface{}]interface{}, coll *Collation) int {
+	aKeys, bKeys := sortedKeys(a), sortedKeys(b)
+	for i := 0; i < len(aKeys) && i < len(bKeys); i++ {
+		if c := compareValues(aKeys[i], bKeys[i]); c != 0 {
+			return c
+		}
+		if c := compareCollated(a[aKeys[i]], b[bKeys[i]], coll); c != 0 {
+			return c
+		}
+	}
+	return len(aKeys) - len(bKeys)
+}
+
+func sortedKeys(obj map[interface{}]interface{}) []interface{} {
+	keys := make([]interface{}, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return compareValues(keys[i], keys[j]) < 0
+	})
+	return keys
+}
+
+const (
+	numberRank = 1
+	dateRank   = 6
+)
+
+// typeRank orders values of different types: null, numbers, strings,
+// objects, arrays, booleans and then dates.
+func typeRank(v interface{}) int {
+	if isNumber(v) {
+		return numberRank
+	}
+	if isDate(v) {
+		return dateRank
+	}
+	switch v.(type) {
+	case nil:
+		return 0
+	case string:
+		return 2
+	case map[interface{}]interface{}:
+		return 3
+	case []interface{}:
+		return 4
+	case bool:
+		return 5
+	}
+	return 7
+}
+
+func floatValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	if r, ok := decimalValue(v); ok {
+		f, _ := r.Float64()
+		return f, true
+	}
+	return 0, false
+}
+
+func intValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		return int64(v), v == float64(int64(v))
+	}
+	if r, ok := decimalValue(v); ok && r.IsInt() && r.Num().IsInt64() {
+		return r.Num().Int64(), true
+	}
+	return 0, false
+}
+
+func updateCollection(dbName string, collection string, handler BucketHandler) error {
+	return updateTx(dbName, func(tx *bolt.Tx) error {
+		set := trackChanges(tx, dbName)
+		defer set.untrack()
+		bucket, err := openCollection(tx, collection)
 		if err != nil {
 			return err
 		}
-		return handler(bucket)
+		if err := handler(bucket); err != nil {
+			return err
+		}
+		return set.replicate()
 	})
 }
 
 func readCollection(dbName string, collection string, handler BucketHandler) error {
+	return viewTx(dbName, func(tx *bolt.Tx) error {
+		bucket, err := collectionBucket(tx, collection)
+		if err != nil {
+			return err
+		}
+		return handler(bucket)
+	})
+}
+
+func updateDb(dbName string, handler TxHandler) error {
+	return updateTx(dbName, func(tx *bolt.Tx) error {
+		set := trackChanges(tx, dbName)
+		defer set.untrack()
+		if err := handler(tx); err != nil {
+			return err
+		}
+		return set.replicate()
+	})
+}
+
+func readDb(dbName string, handler TxHandler) error {
+	return viewTx(dbName, handler)
+}
+
+// updateTx runs handler in a write transaction of a database, again on the
+// new file if the database was compacted or replaced while it waited.
+func updateTx(dbName string, handler TxHandler) error {
+	for {
+		db, err := getDb(dbName)
+		if err != nil {
+			return err
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			if err := db.err(); err != nil {
+				return err
+			}
+			return handler(tx)
+		})
+		db.release()
+		if err != errDbReplaced {
+			return err
+		}
+	}
+}
+
+// viewTx runs handler in a read transaction of a database. Reads that got
+// the database before its file was replaced see the old file.
+func viewTx(dbName string, handler TxHandler) error {
 	db, err := getDb(dbName)
 	if err != nil {
 		return err
 	}
-
-	return db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(collection))
-		return handler(bucket)
-	})
+	defer db.release()
+	return db.View(handler)
 }
 
 func iterateQuery(db string, collection string, query map[interface{}]interface{}, tx TransactionFunc, handler QueryHandler) error {
 	return tx(db, collection, func(bucket *bolt.Bucket) error {
-		c := bucket.Cursor()
-		var count uint64 = 0
-		limit, useLimit := query["limit"].(uint64)
-		if useLimit {
-			delete(query, "limit")
-		}
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			doc, err := decodeJson(v)
-			if err != nil {
-				return err
-			}
-			if queryMatch(doc, query) {
-				err = handler(bucket, k, v, doc)
-				if err != nil {
-					return err
-				}
-				count++
-				if useLimit && count == limit {
-					return nil
-				}
-			}
+		_, err := runQuery(bucket, query, handler)
+		return err
+	})
+}
+
+// runQuery plans and executes a query, calling handler for each matching
+// document up to the query's limit. The query's collation applies to every
+// string it compares.
+func runQuery(bucket *bolt.Bucket, query map[interface{}]interface{}, handler QueryHandler) (*QueryStats, error) {
+	var count uint64 = 0
+	limit, useLimit := query["limit"].(uint64)
+	if useLimit {
+		query = withoutField(query, "limit")
+	}
+	coll, err := parseCollation(query["collation"])
+	if err != nil {
+		return nil, err
+	}
+	query = withoutField(query, "collation")
+	if err := checkQuery(query); err != nil {
+		return nil, err
+	}
+
+	candidates, err := planQuery(bucket, query, coll)
+	if err != nil {
+		return nil, err
+	}
+	stats := &QueryStats{Plan: candidates[0], Candidates: candidates}
+	if useLimit && limit == 0 {
+		return stats, nil
+	}
+
+	err = stats.Plan.execute(bucket, stats, func(k []byte, v []byte, doc map[interface{}]interface{}) (bool, error) {
+		err := handler(bucket, k, v, doc)
+		if err != nil {
+			return false, err
 		}
-		return nil
+		count++
+		return !useLimit || count < limit, nil
 	})
+	return stats, err
 }
 
 func decodeJson(data interface{}) (map[interface{}]interface{}, error) {
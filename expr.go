@@ -0,0 +1,411 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type (
+	// An ExprScope is the environment an expression is evaluated in: the
+	// current document, reached with "$field", and named variables, reached
+	// with "$$name".
+	ExprScope struct {
+		doc  map[interface{}]interface{}
+		vars map[string]interface{}
+	}
+
+	// An ExprOperator evaluates the argument of an operator such as
+	// {"$add": ["$a", 1]}.
+	ExprOperator func(*ExprScope, interface{}) (interface{}, error)
+)
+
+var exprOperators map[string]ExprOperator
+
+func init() {
+	exprOperators = map[string]ExprOperator{
+		"$literal": func(scope *ExprScope, arg interface{}) (interface{}, error) { return arg, nil },
+
+		"$add":      arithmeticOperator(addOp),
+		"$subtract": arithmeticOperator(subtractOp),
+		"$multiply": arithmeticOperator(multiplyOp),
+		"$divide":   arithmeticOperator(divideOp),
+		"$mod":      arithmeticOperator(modOp),
+
+		"$eq":  comparisonOperator(func(c int) bool { return c == 0 }),
+		"$ne":  comparisonOperator(func(c int) bool { return c != 0 }),
+		"$gt":  comparisonOperator(func(c int) bool { return c > 0 }),
+		"$gte": comparisonOperator(func(c int) bool { return c >= 0 }),
+		"$lt":  comparisonOperator(func(c int) bool { return c < 0 }),
+		"$lte": comparisonOperator(func(c int) bool { return c <= 0 }),
+
+		"$and":    andOperator,
+		"$or":     orOperator,
+		"$not":    notOperator,
+		"$cond":   condOperator,
+		"$ifNull": ifNullOperator,
+
+		"$sum":    arrayAccumulatorOperator("$sum"),
+		"$avg":    arrayAccumulatorOperator("$avg"),
+		"$min":    arrayAccumulatorOperator("$min"),
+		"$max":    arrayAccumulatorOperator("$max"),
+		"$size":   sizeOperator,
+		"$concat": concatOperator,
+
+		"$toLower":    stringOperator("$toLower", func(s string) interface{} { return strings.ToLower(s) }),
+		"$toUpper":    stringOperator("$toUpper", func(s string) interface{} { return strings.ToUpper(s) }),
+		"$trim":       stringOperator("$trim", func(s string) interface{} { return strings.TrimSpace(s) }),
+		"$strLen":     stringOperator("$strLen", strLen),
+		"$substr":     substrOperator,
+		"$split":      splitOperator,
+		"$strcasecmp": strcasecmpOperator,
+
+		"$year":        datePartOperator("$year", time.Time.Year),
+		"$month":       datePartOperator("$month", func(t time.Time) int { return int(t.Month()) }),
+		"$dayOfMonth":  datePartOperator("$dayOfMonth", time.Time.Day),
+		"$dayOfWeek":   datePartOperator("$dayOfWeek", func(t time.Time) int { return int(t.Weekday()) + 1 }),
+		"$dayOfYear":   datePartOperator("$dayOfYear", time.Time.YearDay),
+		"$hour":        datePartOperator("$hour", time.Time.Hour),
+		"$minute":      datePartOperator("$minute", time.Time.Minute),
+		"$second":      datePartOperator("$second", time.Time.Second),
+		"$millisecond": datePartOperator("$millisecond", func(t time.Time) int { return t.Nanosecond() / int(time.Millisecond) }),
+
+		"$dateToString":   dateToStringOperator,
+		"$dateFromString": dateFromStringOperator,
+		"$dateAdd":        dateAddOperator,
+		"$dateDiff":       dateDiffOperator,
+
+		"$switch": switchOperator,
+
+		"$in":           inOperator,
+		"$arrayElemAt":  arrayElemAtOperator,
+		"$slice":        sliceOperator,
+		"$concatArrays": concatArraysOperator,
+		"$isArray":      isArrayOperator,
+		"$filter":       filterOperator,
+		"$map":          mapOperator,
+		"$reduce":       reduceOperator,
+	}
+}
+
+func NewExprScope(doc map[interface{}]interface{}, vars map[string]interface{}) *ExprScope {
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+	return &ExprScope{doc: doc, vars: vars}
+}
+
+// evalExpr evaluates an expression. Strings starting with "$" are field
+// paths and "$$" variables, single key objects naming an operator apply it,
+// other objects and arrays are evaluated element by element, and anything
+// else, including dates and decimals, is a literal.
+func evalExpr(scope *ExprScope, expr interface{}) (interface{}, error) {
+	switch expr := expr.(type) {
+	case string:
+		if strings.HasPrefix(expr, "$$") {
+			name := expr[2:]
+			path := ""
+			if i := strings.Index(name, "."); i >= 0 {
+				name, path = name[:i], name[i+1:]
+			}
+			if name == "ROOT" || name == "CURRENT" {
+				return scope.field(path), nil
+			}
+			value, ok := scope.vars[name]
+			if !ok {
+				return nil, fmt.Errorf("Undefined variable $$%s", name)
+			}
+			if path != "" {
+				obj, _ := value.(map[interface{}]interface{})
+				value, _ = lookupField(obj, path)
+			}
+			return value, nil
+		}
+		if strings.HasPrefix(expr, "$") {
+			return scope.field(expr[1:]), nil
+		}
+	case map[interface{}]interface{}:
+		if isExtendedJson(expr) {
+			return expr, nil
+		}
+		if len(expr) == 1 {
+			for k, arg := range expr {
+				name := fmt.Sprint(k)
+				if strings.HasPrefix(name, "$") {
+					operator, ok := exprOperators[name]
+					if !ok {
+						return nil, fmt.Errorf("Unknown expression operator %s", name)
+					}
+					return operator(scope, arg)
+				}
+			}
+		}
+		result := make(map[interface{}]interface{}, len(expr))
+		for k, v := range expr {
+			value, err := evalExpr(scope, v)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = value
+		}
+		return result, nil
+	case []interface{}:
+		return evalArgs(scope, expr)
+	}
+	return expr, nil
+}
+
+// checkExpr finds the unknown operators of an expression without
+// evaluating it, so that a mistyped expression fails before it runs.
+func checkExpr(expr interface{}) error {
+	switch expr := expr.(type) {
+	case map[interface{}]interface{}:
+		if isExtendedJson(expr) {
+			return nil
+		}
+		if len(expr) == 1 {
+			for k, arg := range expr {
+				name := fmt.Sprint(k)
+				if strings.HasPrefix(name, "$") {
+					if _, ok := exprOperators[name]; !ok {
+						return fmt.Errorf("Unknown expression operator %s", name)
+					}
+					if name == "$literal" {
+						return nil
+					}
+					return checkExpr(arg)
+				}
+			}
+		}
+		for _, v := range expr {
+			if err := checkExpr(v); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, v := range expr {
+			if err := checkExpr(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (scope *ExprScope) field(path string) interface{} {
+	if path == "" {
+		return scope.doc
+	}
+	value, _ := lookupField(scope.doc, path)
+	return value
+}
+
+// evalArgs evaluates an operator's argument list. A single argument may be
+// given without the surrounding array.
+func evalArgs(scope *ExprScope, arg interface{}) ([]interface{}, error) {
+	args, ok := arg.([]interface{})
+	if !ok {
+		args = []interface{}{arg}
+	}
+	values := make([]interface{}, len(args))
+	for i, a := range args {
+		value, err := evalExpr(scope, a)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func evalArgCount(scope *ExprScope, arg interface{}, name string, count int) ([]interface{}, error) {
+	values, err := evalArgs(scope, arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != count {
+		return nil, fmt.Errorf("%s takes %d arguments", name, count)
+	}
+	return values, nil
+}
+
+// arithmeticOperator folds its arguments with op from left to right. A
+// null argument makes the result null.
+func arithmeticOperator(op numberOp) ExprOperator {
+	return func(scope *ExprScope, arg interface{}) (interface{}, error) {
+		values, err := evalArgs(scope, arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, errors.New("Arithmetic operators need at least one argument")
+		}
+		result := values[0]
+		for _, v := range values {
+			if v == nil {
+				return nil, nil
+			}
+		}
+		if !isNumber(result) {
+			return nil, fmt.Errorf("Cannot do arithmetic on %v", result)
+		}
+		for _, v := range values[1:] {
+			if result, err = op.apply(result, v); err != nil {
+				return nil, fmt.Errorf("Cannot do arithmetic on %v: %s", v, err)
+			}
+		}
+		return result, nil
+	}
+}
+
+func comparisonOperator(test func(int) bool) ExprOperator {
+	return func(scope *ExprScope, arg interface{}) (interface{}, error) {
+		values, err := evalArgCount(scope, arg, "Comparisons", 2)
+		if err != nil {
+			return nil, err
+		}
+		return test(compareValues(values[0], values[1])), nil
+	}
+}
+
+// truthy treats null, false and zero as false and everything else as true.
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	if isNumber(v) {
+		return !isZero(v)
+	}
+	return true
+}
+
+func andOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, ok := arg.([]interface{})
+	if !ok {
+		args = []interface{}{arg}
+	}
+	for _, a := range args {
+		value, err := evalExpr(scope, a)
+		if err != nil || !truthy(value) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func orOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, ok := arg.([]interface{})
+	if !ok {
+		args = []interface{}{arg}
+	}
+	for _, a := range args {
+		value, err := evalExpr(scope, a)
+		if err != nil || truthy(value) {
+			return err == nil, err
+		}
+	}
+	return false, nil
+}
+
+func notOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgCount(scope, arg, "$not", 1)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(values[0]), nil
+}
+
+// condOperator accepts [if, then, else] or {"if": ..., "then": ..., "else": ...}
+// and only evaluates the branch that is taken.
+func condOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	var ifExpr, thenExpr, elseExpr interface{}
+	switch arg := arg.(type) {
+	case []interface{}:
+		if len(arg) != 3 {
+			return nil, errors.New("$cond takes 3 arguments")
+		}
+		ifExpr, thenExpr, elseExpr = arg[0], arg[1], arg[2]
+	case map[interface{}]interface{}:
+		ifExpr, thenExpr, elseExpr = arg["if"], arg["then"], arg["else"]
+	default:
+		return nil, errors.New("$cond requires an array or an object")
+	}
+
+	cond, err := evalExpr(scope, ifExpr)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(cond) {
+		return evalExpr(scope, thenExpr)
+	}
+	return evalExpr(scope, elseExpr)
+}
+
+func ifNullOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgs(scope, arg)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		if v != nil {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// arrayAccumulatorOperator applies a group accumulator to an array, or to
+// the argument list when given several arguments.
+func arrayAccumulatorOperator(name string) ExprOperator {
+	return func(scope *ExprScope, arg interface{}) (interface{}, error) {
+		values, err := evalArgs(scope, arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 1 {
+			if slice, ok := values[0].([]interface{}); ok {
+				values = slice
+			}
+		}
+		acc := accumulators[name]()
+		for _, v := range values {
+			acc.Add(v)
+		}
+		return acc.Result(), nil
+	}
+}
+
+func sizeOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgCount(scope, arg, "$size", 1)
+	if err != nil {
+		return nil, err
+	}
+	slice, ok := values[0].([]interface{})
+	if !ok {
+		return nil, errors.New("$size requires an array")
+	}
+	return uint64(len(slice)), nil
+}
+
+func concatOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgs(scope, arg)
+	if err != nil {
+		return nil, err
+	}
+	var result string
+	for _, v := range values {
+		if v == nil {
+			return nil, nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("$concat requires strings, got %v", v)
+		}
+		result += s
+	}
+	return result, nil
+}
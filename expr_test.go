@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestExprQuery(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "acme", "projects",
+		`{"name": "a", "budget": 100, "spent": 120}`,
+		`{"name": "b", "budget": 100, "spent": 80}`,
+		`{"name": "c", "budget": 50.5, "spent": 50.5}`,
+	)
+
+	encDocs, err := query("acme", "projects", strings.NewReader(`{"$expr": {"$gt": ["$spent", "$budget"]}}`))
+	assert.Ok(t, err)
+	docs := decodeDocs(t, encDocs)
+	assert.Equals(t, 1, len(docs))
+	assert.Equals(t, "a", docs[0]["name"])
+
+	encDocs, err = query("acme", "projects", strings.NewReader(
+		`{"budget": 100, "$expr": {"$lt": [{"$subtract": ["$budget", "$spent"]}, 0]}}`))
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(decodeDocs(t, encDocs)))
+
+	// Mistakes in an expression fail the query rather than match nothing.
+	_, err = query("acme", "projects", strings.NewReader(`{"$expr": {"$gtt": ["$spent", "$budget"]}}`))
+	assert.Cond(t, err != nil, "unknown operators should be rejected")
+	_, err = updateQuery("acme", "projects", strings.NewReader(
+		`{"query": {"$expr": {"$gt": [{"$divide": ["$spent", 0]}, 1]}}, "update": {"over": true}}`))
+	assert.Cond(t, err != nil, "a division by zero should fail the update")
+	_, err = aggregate("acme", "projects", strings.NewReader(`{"pipeline": [{"$match": {"$expr": {"$nope": 1}}}]}`))
+	assert.Cond(t, err != nil, "unknown operators should be rejected in $match")
+}
+
+func TestExprOperators(t *testing.T) {
+	doc, err := decodeJson(strings.NewReader(`{
+		"name": "  Ada Lovelace ",
+		"born": {"$date": "1815-12-10T08:30:00.250Z"},
+		"scores": [3, 9, 4, 7]
+	}`))
+	assert.Ok(t, err)
+	scope := NewExprScope(doc, nil)
+
+	for expr, expected := range map[string]interface{}{
+		`{"$toUpper": {"$trim": "$name"}}`:                                       "ADA LOVELACE",
+		`{"$substr": [{"$trim": "$name"}, 4, 4]}`:                                "Love",
+		`{"$strLen": {"$trim": "$name"}}`:                                        uint64(12),
+		`{"$arrayElemAt": [{"$split": [{"$trim": "$name"}, " "]}, -1]}`:          "Lovelace",
+		`{"$strcasecmp": ["abc", "ABD"]}`:                                        int64(-1),
+		`{"$year": "$born"}`:                                                     uint64(1815),
+		`{"$dayOfYear": "$born"}`:                                                uint64(344),
+		`{"$hour": {"date": "$born", "timezone": "Asia/Tokyo"}}`:                 uint64(17),
+		`{"$dateToString": {"date": "$born", "format": "%Y-%m-%d %H:%M:%S.%L"}}`: "1815-12-10 08:30:00.250",
+		`{"$dateDiff": {"startDate": "$born", "endDate": {"$date": "1852-11-27T00:00:00Z"}, "unit": "year"}}`: uint64(37),
+		`{"$size": {"$filter": {"input": "$scores", "as": "s", "cond": {"$gte": ["$$s", 5]}}}}`:               uint64(2),
+		`{"$reduce": {"input": "$scores", "initialValue": 0, "in": {"$add": ["$$value", "$$this"]}}}`:         uint64(23),
+		`{"$in": [9, "$scores"]}`: true,
+		`{"$switch": {"branches": [{"case": {"$gt": [{"$max": "$scores"}, 8]}, "then": "high"}], "default": "low"}}`: "high",
+	} {
+		e, err := decodeJson(strings.NewReader(expr))
+		assert.Ok(t, err)
+		value, err := evalExpr(scope, e)
+		assert.Ok(t, err)
+		assert.Equals(t, expected, value)
+	}
+
+	e, err := decodeJson(strings.NewReader(`{"$map": {"input": {"$slice": ["$scores", -2]}, "in": {"$multiply": ["$$this", 10]}}}`))
+	assert.Ok(t, err)
+	value, err := evalExpr(scope, e)
+	assert.Ok(t, err)
+	assert.Equals(t, []interface{}{uint64(40), uint64(70)}, value)
+
+	e, err = decodeJson(strings.NewReader(`{"$dateAdd": {"startDate": "$born", "unit": "month", "amount": 2}}`))
+	assert.Ok(t, err)
+	value, err = evalExpr(scope, e)
+	assert.Ok(t, err)
+	assert.Equals(t, map[interface{}]interface{}{"$date": "1816-02-10T08:30:00.25Z"}, value)
+}
+
+func TestExprProjectAndUpdate(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "acme", "people", `{"first": "Ada", "last": "Lovelace", "visits": 4}`)
+
+	docs := aggregateDocs(t, "acme", "people", `[
+		{"$project": {"full": {"$concat": ["$first", " ", {"$toUpper": "$last"}]}}}
+	]`)
+	assert.Equals(t, "Ada LOVELACE", docs[0]["full"])
+
+	_, err := updateQuery("acme", "people", strings.NewReader(`{
+		"query": {"first": "Ada"},
+		"update": {"visits": {"$expr": {"$add": ["$visits", 1]}}, "last": {"$expr": "$first"}}
+	}`))
+	assert.Ok(t, err)
+	encDocs, err := query("acme", "people", strings.NewReader(`{"first": "Ada"}`))
+	assert.Ok(t, err)
+	docs = decodeDocs(t, encDocs)
+	assert.Equals(t, uint64(5), docs[0]["visits"])
+	assert.Equals(t, "Ada", docs[0]["last"])
+}
+
+func TestExprHugeLengths(t *testing.T) {
+	for expr, expected := range map[string]interface{}{
+		`{"$substr": ["hello", 1, 9223372036854775807]}`: "ello",
+		`{"$slice": [[1, 2], 1, 9223372036854775807]}`:   []interface{}{uint64(2)},
+		`{"$slice": [[1, 2], 9223372036854775807]}`:      []interface{}{uint64(1), uint64(2)},
+	} {
+		e, err := decodeJson(strings.NewReader(expr))
+		assert.Ok(t, err)
+		value, err := evalExpr(NewExprScope(nil, nil), e)
+		assert.Ok(t, err)
+		assert.Equals(t, expected, value)
+	}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// with returns a child scope with an extra variable, for operators that
+// bind names like $filter and $map.
+func (scope *ExprScope) with(name string, value interface{}) *ExprScope {
+	vars := make(map[string]interface{}, len(scope.vars)+1)
+	for k, v := range scope.vars {
+		vars[k] = v
+	}
+	vars[name] = value
+	return &ExprScope{doc: scope.doc, vars: vars}
+}
+
+func exprString(v interface{}, name string) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s requires a string, got %v", name, v)
+	}
+	return s, nil
+}
+
+func exprInt(v interface{}, name string) (int, error) {
+	i, ok := intValue(v)
+	if !ok {
+		return 0, fmt.Errorf("%s requires an integer, got %v", name, v)
+	}
+	return int(i), nil
+}
+
+func exprArray(v interface{}, name string) ([]interface{}, error) {
+	slice, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s requires an array, got %v", name, v)
+	}
+	return slice, nil
+}
+
+// objectArgs reads the named arguments of an operator like
+// {"$filter": {"input": ..., "cond": ...}} without evaluating them.
+func objectArgs(arg interface{}, name string, required ...string) (map[interface{}]interface{}, error) {
+	args, ok := arg.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s requires an object", name)
+	}
+	for _, field := range required {
+		if _, ok := args[field]; !ok {
+			return nil, fmt.Errorf("%s requires %s", name, field)
+		}
+	}
+	return args, nil
+}
+
+// stringOperator applies fn to a single string argument. Null stays null.
+func stringOperator(name string, fn func(string) interface{}) ExprOperator {
+	return func(scope *ExprScope, arg interface{}) (interface{}, error) {
+		values, err := evalArgCount(scope, arg, name, 1)
+		if err != nil || values[0] == nil {
+			return nil, err
+		}
+		s, err := exprString(values[0], name)
+		if err != nil {
+			return nil, err
+		}
+		return fn(s), nil
+	}
+}
+
+// substrOperator takes [string, start, length] in characters. A negative
+// length runs to the end of the string.
+func substrOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgCount(scope, arg, "$substr", 3)
+	if err != nil || values[0] == nil {
+		return nil, err
+	}
+	s, err := exprString(values[0], "$substr")
+	if err != nil {
+		return nil, err
+	}
+	start, err := exprInt(values[1], "$substr")
+	if err != nil {
+		return nil, err
+	}
+	length, err := exprInt(values[2], "$substr")
+	if err != nil {
+		return nil, err
+	}
+
+	runes := []rune(s)
+	if start < 0 || start > len(runes) {
+		return "", nil
+	}
+	end := len(runes)
+	if length >= 0 && length < end-start {
+		end = start + length
+	}
+	return string(runes[start:end]), nil
+}
+
+func splitOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgCount(scope, arg, "$split", 2)
+	if err != nil || values[0] == nil {
+		return nil, err
+	}
+	s, err := exprString(values[0], "$split")
+	if err != nil {
+		return nil, err
+	}
+	sep, err := exprString(values[1], "$split")
+	if err != nil {
+		return nil, err
+	}
+	var parts []interface{}
+	for _, part := range strings.Split(s, sep) {
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func strcasecmpOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgCount(scope, arg, "$strcasecmp", 2)
+	if err != nil {
+		return nil, err
+	}
+	a, err := exprString(values[0], "$strcasecmp")
+	if err != nil {
+		return nil, err
+	}
+	b, err := exprString(values[1], "$strcasecmp")
+	if err != nil {
+		return nil, err
+	}
+	return int64(strings.Compare(strings.ToLower(a), strings.ToLower(b))), nil
+}
+
+// dateArg evaluates a date operand, given either as a date expression or as
+// {"date": ..., "timezone": "Europe/Paris"}. Null stays null.
+func dateArg(scope *ExprScope, arg interface{}, name string) (*time.Time, error) {
+	var timezone interface{}
+	if args, ok := arg.(map[interface{}]interface{}); ok {
+		if dateExpr, ok := args["date"]; ok {
+			arg, timezone = dateExpr, args["timezone"]
+		}
+	}
+
+	values, err := evalArgCount(scope, arg, name, 1)
+	if err != nil || values[0] == nil {
+		return nil, err
+	}
+	t, ok := dateValue(values[0])
+	if !ok {
+		return nil, fmt.Errorf("%s requires a date, got %v", name, values[0])
+	}
+	if timezone != nil {
+		loc, err := exprLocation(scope, timezone)
+		if err != nil {
+			return nil, err
+		}
+		t = t.In(loc)
+	}
+	return &t, nil
+}
+
+func exprLocation(scope *ExprScope, expr interface{}) (*time.Location, error) {
+	value, err := evalExpr(scope, expr)
+	if err != nil {
+		return nil, err
+	}
+	name, err := exprString(value, "timezone")
+	if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(name)
+}
+
+func datePartOperator(name string, part func(time.Time) int) ExprOperator {
+	return func(scope *ExprScope, arg interface{}) (interface{}, error) {
+		t, err := dateArg(scope, arg, name)
+		if err != nil || t == nil {
+			return nil, err
+		}
+		return uint64(part(*t)), nil
+	}
+}
+
+// dateFormats maps the % specifiers of $dateToString to Go layouts.
+var dateFormats = map[byte]string{
+	'Y': "2006", 'm': "01", 'd': "02", 'H': "15", 'M': "04", 'S': "05",
+	'L': ".000", 'z': "-0700", 'Z': "Z07:00", 'b': "Jan", 'a': "Mon",
+}
+
+// dateToStringOperator takes {"date": ..., "format": "%Y-%m-%d", "timezone": ...}.
+// Without a format it writes RFC 3339.
+func dateToStringOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, err := objectArgs(arg, "$dateToString", "date")
+	if err != nil {
+		return nil, err
+	}
+	t, err := dateArg(scope, map[interface{}]interface{}{"date": args["date"], "timezone": args["timezone"]}, "$dateToString")
+	if err != nil || t == nil {
+		return nil, err
+	}
+	if _, ok := args["timezone"]; !ok {
+		utc := t.UTC()
+		t = &utc
+	}
+
+	format, ok := args["format"]
+	if !ok {
+		return t.Format(time.RFC3339Nano), nil
+	}
+	formatValue, err := evalExpr(scope, format)
+	if err != nil {
+		return nil, err
+	}
+	f, err := exprString(formatValue, "$dateToString format")
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' || i+1 == len(f) {
+			out = append(out, f[i])
+			continue
+		}
+		i++
+		switch spec := f[i]; spec {
+		case '%':
+			out = append(out, '%')
+		case 'j':
+			out = append(out, fmt.Sprintf("%03d", t.YearDay())...)
+		case 'u':
+			out = append(out, fmt.Sprint((int(t.Weekday())+6)%7+1)...)
+		case 'L':
+			out = append(out, t.Format(dateFormats[spec])[1:]...)
+		default:
+			layout, ok := dateFormats[spec]
+			if !ok {
+				return nil, fmt.Errorf("Unknown date format %%%c", spec)
+			}
+			out = append(out, t.Format(layout)...)
+		}
+	}
+	return string(out), nil
+}
+
+func dateFromStringOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, err := objectArgs(arg, "$dateFromString", "dateString")
+	if err != nil {
+		return nil, err
+	}
+	value, err := evalExpr(scope, args["dateString"])
+	if err != nil || value == nil {
+		return nil, err
+	}
+	s, err := exprString(value, "$dateFromString")
+	if err != nil {
+		return nil, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, err
+	}
+	return NewDate(t), nil
+}
+
+// dateUnits are the units accepted by $dateAdd and $dateDiff. Months and
+// years follow the calendar; the other units are fixed durations.
+var dateUnits = map[string]time.Duration{
+	"millisecond": time.Millisecond,
+	"second":      time.Second,
+	"minute":      time.Minute,
+	"hour":        time.Hour,
+	"day":         24 * time.Hour,
+	"week":        7 * 24 * time.Hour,
+	"month":       0,
+	"year":        0,
+}
+
+func dateUnit(scope *ExprScope, expr interface{}, name string) (string, error) {
+	value, err := evalExpr(scope, expr)
+	if err != nil {
+		return "", err
+	}
+	unit, err := exprString(value, name)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := dateUnits[unit]; !ok {
+		return "", fmt.Errorf("%s: unknown unit %s", name, unit)
+	}
+	return unit, nil
+}
+
+// dateAddOperator takes {"startDate": ..., "unit": "day", "amount": 3}.
+func dateAddOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, err := objectArgs(arg, "$dateAdd", "startDate", "unit", "amount")
+	if err != nil {
+		return nil, err
+	}
+	t, err := dateArg(scope, args["startDate"], "$dateAdd")
+	if err != nil || t == nil {
+		return nil, err
+	}
+	unit, err := dateUnit(scope, args["unit"], "$dateAdd")
+	if err != nil {
+		return nil, err
+	}
+	amountValue, err := evalExpr(scope, args["amount"])
+	if err != nil {
+		return nil, err
+	}
+	amount, err := exprInt(amountValue, "$dateAdd amount")
+	if err != nil {
+		return nil, err
+	}
+
+	switch unit {
+	case "month":
+		return NewDate(t.AddDate(0, amount, 0)), nil
+	case "year":
+		return NewDate(t.AddDate(amount, 0, 0)), nil
+	}
+	return NewDate(t.Add(time.Duration(amount) * dateUnits[unit])), nil
+}
+
+// dateDiffOperator counts whole units from startDate to endDate.
+func dateDiffOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, err := objectArgs(arg, "$dateDiff", "startDate", "endDate", "unit")
+	if err != nil {
+		return nil, err
+	}
+	start, err := dateArg(scope, args["startDate"], "$dateDiff")
+	if err != nil || start == nil {
+		return nil, err
+	}
+	end, err := dateArg(scope, args["endDate"], "$dateDiff")
+	if err != nil || end == nil {
+		return nil, err
+	}
+	unit, err := dateUnit(scope, args["unit"], "$dateDiff")
+	if err != nil {
+		return nil, err
+	}
+
+	var diff int64
+	switch unit {
+	case "month":
+		diff = int64((end.Year()-start.Year())*12 + int(end.Month()-start.Month()))
+	case "year":
+		diff = int64(end.Year() - start.Year())
+	default:
+		diff = int64(end.Sub(*start) / dateUnits[unit])
+	}
+	return intNumber(big.NewInt(diff)), nil
+}
+
+// switchOperator takes {"branches": [{"case": ..., "then": ...}], "default": ...}.
+func switchOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, err := objectArgs(arg, "$switch", "branches")
+	if err != nil {
+		return nil, err
+	}
+	branches, err := exprArray(args["branches"], "$switch branches")
+	if err != nil {
+		return nil, err
+	}
+	for _, branch := range branches {
+		b, err := objectArgs(branch, "$switch branch", "case", "then")
+		if err != nil {
+			return nil, err
+		}
+		cond, err := evalExpr(scope, b["case"])
+		if err != nil {
+			return nil, err
+		}
+		if truthy(cond) {
+			return evalExpr(scope, b["then"])
+		}
+	}
+	if def, ok := args["default"]; ok {
+		return evalExpr(scope, def)
+	}
+	return nil, errors.New("$switch found no matching branch and has no default")
+}
+
+func inOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgCount(scope, arg, "$in", 2)
+	if err != nil {
+		return nil, err
+	}
+	slice, err := exprArray(values[1], "$in")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range slice {
+		if compareValues(v, values[0]) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// arrayElemAtOperator takes [array, index]; negative indexes count from
+// the end.
+func arrayElemAtOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgCount(scope, arg, "$arrayElemAt", 2)
+	if err != nil || values[0] == nil {
+		return nil, err
+	}
+	slice, err := exprArray(values[0], "$arrayElemAt")
+	if err != nil {
+		return nil, err
+	}
+	i, err := exprInt(values[1], "$arrayElemAt")
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		i += len(slice)
+	}
+	if i < 0 || i >= len(slice) {
+		return nil, nil
+	}
+	return slice[i], nil
+}
+
+// sliceOperator takes [array, n], the first n elements or the last -n, or
+// [array, position, n].
+func sliceOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgs(scope, arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 2 && len(values) != 3 {
+		return nil, errors.New("$slice takes 2 or 3 arguments")
+	}
+	if values[0] == nil {
+		return nil, nil
+	}
+	slice, err := exprArray(values[0], "$slice")
+	if err != nil {
+		return nil, err
+	}
+	n, err := exprInt(values[len(values)-1], "$slice")
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if len(values) == 3 {
+		if start, err = exprInt(values[1], "$slice"); err != nil {
+			return nil, err
+		}
+		if start < 0 {
+			start += len(slice)
+		}
+	} else if n < 0 {
+		start, n = len(slice)+n, -n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > len(slice) {
+		start = len(slice)
+	}
+	end := len(slice)
+	if n >= 0 && n < end-start {
+		end = start + n
+	}
+	return append([]interface{}{}, slice[start:end]...), nil
+}
+
+func concatArraysOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgs(scope, arg)
+	if err != nil {
+		return nil, err
+	}
+	result := []interface{}{}
+	for _, v := range values {
+		if v == nil {
+			return nil, nil
+		}
+		slice, err := exprArray(v, "$concatArrays")
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, slice...)
+	}
+	return result, nil
+}
+
+func isArrayOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	values, err := evalArgCount(scope, arg, "$isArray", 1)
+	if err != nil {
+		return nil, err
+	}
+	_, ok := values[0].([]interface{})
+	return ok, nil
+}
+
+// arrayInput evaluates the input of $filter, $map and $reduce and the name
+// its elements are bound to, "this" by default.
+func arrayInput(scope *ExprScope, args map[interface{}]interface{}, name string) ([]interface{}, string, error) {
+	input, err := evalExpr(scope, args["input"])
+	if err != nil || input == nil {
+		return nil, "", err
+	}
+	slice, err := exprArray(input, name)
+	if err != nil {
+		return nil, "", err
+	}
+	as := "this"
+	if v, ok := args["as"]; ok {
+		if as, err = exprString(v, name+" as"); err != nil {
+			return nil, "", err
+		}
+	}
+	return slice, as, nil
+}
+
+// filterOperator takes {"input": [...], "as": "item", "cond": ...}.
+func filterOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, err := objectArgs(arg, "$filter", "input", "cond")
+	if err != nil {
+		return nil, err
+	}
+	slice, as, err := arrayInput(scope, args, "$filter")
+	if err != nil || slice == nil {
+		return nil, err
+	}
+	result := []interface{}{}
+	for _, v := range slice {
+		keep, err := evalExpr(scope.with(as, v), args["cond"])
+		if err != nil {
+			return nil, err
+		}
+		if truthy(keep) {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// mapOperator takes {"input": [...], "as": "item", "in": ...}.
+func mapOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, err := objectArgs(arg, "$map", "input", "in")
+	if err != nil {
+		return nil, err
+	}
+	slice, as, err := arrayInput(scope, args, "$map")
+	if err != nil || slice == nil {
+		return nil, err
+	}
+	result := make([]interface{}, len(slice))
+	for i, v := range slice {
+		if result[i], err = evalExpr(scope.with(as, v), args["in"]); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// reduceOperator takes {"input": [...], "initialValue": ..., "in": ...}, with
+// the running value in $$value and the element in $$this.
+func reduceOperator(scope *ExprScope, arg interface{}) (interface{}, error) {
+	args, err := objectArgs(arg, "$reduce", "input", "initialValue", "in")
+	if err != nil {
+		return nil, err
+	}
+	slice, _, err := arrayInput(scope, map[interface{}]interface{}{"input": args["input"]}, "$reduce")
+	if err != nil || slice == nil {
+		return nil, err
+	}
+	value, err := evalExpr(scope, args["initialValue"])
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range slice {
+		if value, err = evalExpr(scope.with("value", value).with("this", v), args["in"]); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+func strLen(s string) interface{} {
+	return uint64(utf8.RuneCountInString(s))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	"github.com/boltdb/bolt"
+)
+
+// findAndModify updates the first document matching a query and returns
+// it, in a single write transaction so that concurrent callers never claim
+// the same document. The request is
+//
+//	{"query": {...}, "sort": {...}, "update": {...}, "upsert": false, "new": false}
+//
+// where sort picks the first match, upsert inserts a document when nothing
+// matches and new returns the document after the update instead of before.
+// Nothing is returned when no document was found.
+func findAndModify(db string, collection string, reader io.Reader) ([]byte, error) {
+	request, err := decodeJson(reader)
+	if err != nil {
+		return nil, err
+	}
+	queryMap, ok := request["query"].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("findAndModify requires a query")
+	}
+	update, ok := request["update"].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("findAndModify requires an update object")
+	}
+	upsert, _ := request["upsert"].(bool)
+	returnNew, _ := request["new"].(bool)
+
+	var keys []sortKey
+	if sortSpec, ok := request["sort"]; ok {
+		if keys, err = parseSortKeys(sortSpec); err != nil {
+			return nil, err
+		}
+	} else {
+		queryMap = withoutField(queryMap, "limit")
+		queryMap["limit"] = uint64(1)
+	}
+	coll, err := parseCollation(queryMap["collation"])
+	if err != nil {
+		return nil, err
+	}
+
+	var result []byte
+	err = updateCollection(db, collection, func(bucket *bolt.Bucket) error {
+		var matches []map[interface{}]interface{}
+		_, err := runQuery(bucket, queryMap, func(bucket *bolt.Bucket, key []byte, value []byte, doc map[interface{}]interface{}) error {
+			matches = append(matches, doc)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(matches) == 0 {
+			if !upsert {
+				return nil
+			}
+			inserted, err := upsertDoc(bucket, queryMap, update)
+			if err == nil && returnNew {
+				result = inserted.Bytes()
+			}
+			return err
+		}
+
+		sortDocs(matches, keys, coll)
+		lookupId, err := docLookupId(matches[0])
+		if err != nil {
+			return err
+		}
+		original := bucket.Get(lookupId)
+		updated, err := updateDocValue(lookupId, original, update)
+		if err != nil {
+			return err
+		}
+		if returnNew {
+			result = updated.Bytes()
+		} else {
+			result = append([]byte{}, original...)
+		}
+		return putDocValue(bucket, lookupId, updated.Bytes())
+	})
+	return result, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func TestFindAndModify(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "work", "jobs",
+		`{"name": "low", "status": "pending", "priority": 1}`,
+		`{"name": "high", "status": "pending", "priority": 5}`,
+		`{"name": "done", "status": "done", "priority": 9}`,
+	)
+
+	claim := `{
+		"query": {"status": "pending"},
+		"sort": {"priority": -1},
+		"update": {"status": "running"}
+	}`
+	encDoc, err := findAndModify("work", "jobs", strings.NewReader(claim))
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc)
+	assert.Ok(t, err)
+	assert.Equals(t, "high", doc["name"])
+	assert.Equals(t, "pending", doc["status"])
+
+	encDoc, err = findAndModify("work", "jobs", strings.NewReader(`{
+		"query": {"status": "pending"},
+		"update": {"status": "running"},
+		"new": true
+	}`))
+	assert.Ok(t, err)
+	doc, err = decodeJson(encDoc)
+	assert.Ok(t, err)
+	assert.Equals(t, "low", doc["name"])
+	assert.Equals(t, "running", doc["status"])
+	assert.Equals(t, uint64(2), doc[revField])
+
+	encDoc, err = findAndModify("work", "jobs", strings.NewReader(claim))
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(encDoc))
+
+	encDoc, err = findAndModify("work", "jobs", strings.NewReader(`{
+		"query": {"name": "new", "priority": {"$gt": 3}},
+		"update": {"status": "pending"},
+		"upsert": true,
+		"new": true
+	}`))
+	assert.Ok(t, err)
+	doc, err = decodeJson(encDoc)
+	assert.Ok(t, err)
+	assert.Equals(t, "new", doc["name"])
+	assert.Equals(t, "pending", doc["status"])
+	_, hasPriority := doc["priority"]
+	assert.Cond(t, !hasPriority, "upserts should only copy equality conditions")
+}
+
+func TestUpsert(t *testing.T) {
+	defer withTestDir(t)()
+
+	update := `{"query": {"user": "ada"}, "update": {"visits": 1}, "upsert": true}`
+	_, err := updateQuery("site", "stats", strings.NewReader(update))
+	assert.Ok(t, err)
+	_, err = updateQuery("site", "stats", strings.NewReader(update))
+	assert.Ok(t, err)
+	encDocs, err := query("site", "stats", strings.NewReader(`{"user": "ada"}`))
+	assert.Ok(t, err)
+	docs := decodeDocs(t, encDocs)
+	assert.Equals(t, 1, len(docs))
+	assert.Equals(t, uint64(2), docs[0][revField])
+
+	id, _, err := NewId()
+	assert.Ok(t, err)
+	_, err = updateDoc("site", "stats", id, strings.NewReader(`{"visits": 1}`), 0, false)
+	assert.Equals(t, errDocNotFound, err)
+	encDoc, err := updateDoc("site", "stats", id, strings.NewReader(`{"visits": 1}`), 0, true)
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc)
+	assert.Ok(t, err)
+	assert.Equals(t, id, doc["_id"])
+	assert.Equals(t, uint64(1), doc[revField])
+}
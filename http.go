@@ -1,10 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo"
+	"github.com/ugorji/go/codec"
 )
 
 func badRequest(c *echo.Context, description string, err error) {
@@ -15,19 +24,79 @@ func ok(c *echo.Context) {
 	c.String(http.StatusOK, "Success\n")
 }
 
+func preconditionFailed(c *echo.Context, err error) {
+	c.String(http.StatusPreconditionFailed, fmt.Sprintf("%s\n", err))
+}
+
+// setETag tags a document response with the document's revision, so that
+// clients can make conditional requests with If-Match and If-None-Match.
+func setETag(c *echo.Context, doc []byte) string {
+	rev, err := docRev(doc)
+	if err != nil || rev == 0 {
+		return ""
+	}
+	etag := revETag(rev)
+	c.Response.Header().Set("ETag", etag)
+	return etag
+}
+
+func revETag(rev uint64) string {
+	return fmt.Sprintf(`"%d"`, rev)
+}
+
+// ifMatchRev reads the revision an If-Match header requires. A missing
+// header or "*" requires none.
+func ifMatchRev(c *echo.Context) (uint64, error) {
+	header := strings.TrimSpace(c.Request.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	rev, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	if err != nil || rev == 0 {
+		return 0, errRevisionMismatch
+	}
+	return rev, nil
+}
+
+// etagMatches reports whether an If-None-Match header lists etag.
+func etagMatches(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func okWithBody(c *echo.Context, body []byte) error {
+	return writeJson(c, http.StatusOK, body)
+}
+
+func writeJson(c *echo.Context, status int, body []byte) error {
 	c.Response.Header().Set(echo.HeaderContentType, echo.MIMEJSON+"; charset=utf-8")
-	c.Response.WriteHeader(http.StatusOK)
+	c.Response.WriteHeader(status)
 	_, err := c.Response.Write(body)
 	return err
 }
 
+// pathParam returns the i-th segment of the request path. The router drops
+// parameter names on routes ending in a static segment, such as
+// /:db/:collection/_aggregate, so their handlers read the path directly.
+func pathParam(c *echo.Context, i int) string {
+	segments := strings.Split(strings.Trim(c.Request.URL.Path, "/"), "/")
+	if i < len(segments) {
+		return segments[i]
+	}
+	return ""
+}
+
 func Welcome(c *echo.Context) {
 	c.String(http.StatusOK, "Welcome to RTD v0.1")
 }
 
 func Create(c *echo.Context) {
-	if _, err := getDb(c.Param("db")); err != nil {
+	if err := createDatabase(c.Param("db")); err != nil {
 		badRequest(c, "Error creating your database", err)
 	} else {
 		ok(c)
@@ -35,7 +104,7 @@ func Create(c *echo.Context) {
 }
 
 func Delete(c *echo.Context) {
-	if err := deleteDb(c.Param("db")); err != nil {
+	if err := deleteDatabase(c.Param("db")); err != nil {
 		badRequest(c, "Error deleting your database", err)
 	} else {
 		ok(c)
@@ -51,6 +120,15 @@ func Query(c *echo.Context) {
 	}
 }
 
+func Explain(c *echo.Context) {
+	report, err := explain(pathParam(c, 0), pathParam(c, 1), c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error explaining query", err)
+	} else {
+		okWithBody(c, report)
+	}
+}
+
 func UpdateQuery(c *echo.Context) {
 	docs, err := updateQuery(c.Param("db"), c.Param("collection"), c.Request.Body)
 	if err != nil {
@@ -60,11 +138,86 @@ func UpdateQuery(c *echo.Context) {
 	}
 }
 
+func Aggregate(c *echo.Context) {
+	docs, err := aggregate(pathParam(c, 0), pathParam(c, 1), c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error aggregating collection", err)
+	} else {
+		okWithBody(c, docs)
+	}
+}
+
+func FindAndModify(c *echo.Context) {
+	doc, err := findAndModify(pathParam(c, 0), pathParam(c, 1), c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error modifying document", err)
+	} else {
+		okWithBody(c, doc)
+	}
+}
+
+func MapReduce(c *echo.Context) {
+	result, err := mapReduce(pathParam(c, 0), pathParam(c, 1), c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error running map-reduce", err)
+	} else {
+		okWithBody(c, result)
+	}
+}
+
+// idempotencyKey reads the Idempotency-Key header, answering 400 itself
+// when it is too long to store.
+func idempotencyKey(c *echo.Context) (string, bool) {
+	key := c.Request.Header.Get("Idempotency-Key")
+	if len(key) > 255 {
+		c.String(http.StatusBadRequest, "Idempotency-Key must be at most 255 bytes\n")
+		return "", false
+	}
+	return key, true
+}
+
+// writeIdempotent answers with the response of an idempotent write, marking
+// replayed responses.
+func writeIdempotent(c *echo.Context, status int, body []byte, replayed bool, description string, err error) {
+	if err == errIdempotencyKeyReused {
+		c.String(http.StatusUnprocessableEntity, fmt.Sprintf("%s\n", err))
+		return
+	}
+	if err == errRevisionMismatch {
+		preconditionFailed(c, err)
+		return
+	}
+	if err != nil {
+		badRequest(c, description, err)
+		return
+	}
+	if replayed {
+		c.Response.Header().Set("Idempotent-Replayed", "true")
+	}
+	writeJson(c, status, body)
+}
+
 func InsertDoc(c *echo.Context) {
+	key, valid := idempotencyKey(c)
+	if !valid {
+		return
+	}
+	if key != "" {
+		status, body, replayed, err := insertDocIdempotent(c.Param("db"), c.Param("collection"), key, c.Request.Body)
+		if err == nil {
+			setETag(c, body)
+		}
+		writeIdempotent(c, status, body, replayed, "Error inserting document", err)
+		return
+	}
+
 	insertedDoc, err := insertDoc(c.Param("db"), c.Param("collection"), c.Request.Body)
-	if err != nil {
+	if err == errRevisionMismatch {
+		preconditionFailed(c, err)
+	} else if err != nil {
 		badRequest(c, "Error inserting document", err)
 	} else {
+		setETag(c, insertedDoc.Bytes())
 		okWithBody(c, insertedDoc.Bytes())
 	}
 }
@@ -73,22 +226,673 @@ func FindDoc(c *echo.Context) {
 	doc, err := findDoc(c.Param("db"), c.Param("collection"), c.Param("id"))
 	if err != nil {
 		badRequest(c, "Error finding document", err)
+		return
+	}
+	etag := setETag(c, doc)
+	if etag != "" && etagMatches(c.Request.Header.Get("If-None-Match"), etag) {
+		c.NoContent(http.StatusNotModified)
+		return
+	}
+	okWithBody(c, doc)
+}
+
+func MultiGet(c *echo.Context) {
+	docs, err := findDocs(pathParam(c, 0), pathParam(c, 1), c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error finding documents", err)
 	} else {
-		okWithBody(c, doc)
+		okWithBody(c, docs)
 	}
 }
 
 func UpdateDoc(c *echo.Context) {
-	doc, err := updateDoc(c.Param("db"), c.Param("collection"), c.Param("id"), c.Request.Body)
+	rev, err := ifMatchRev(c)
 	if err != nil {
+		preconditionFailed(c, err)
+		return
+	}
+	upsert := c.Request.URL.Query().Get("upsert") == "true"
+	doc, err := updateDoc(c.Param("db"), c.Param("collection"), c.Param("id"), c.Request.Body, rev, upsert)
+	if err == errRevisionMismatch {
+		preconditionFailed(c, err)
+	} else if err != nil {
 		badRequest(c, "Error updating document", err)
 	} else {
+		setETag(c, doc)
 		okWithBody(c, doc)
 	}
 }
 
 func DeleteDoc(c *echo.Context) {
-	c.String(http.StatusOK, fmt.Sprintf("DeleteDoc %s:%s:%s", c.Param("db"), c.Param("collection"), c.Param("id")))
+	rev, err := ifMatchRev(c)
+	if err != nil {
+		preconditionFailed(c, err)
+		return
+	}
+	err = deleteDoc(c.Param("db"), c.Param("collection"), c.Param("id"), rev)
+	switch err {
+	case nil:
+		ok(c)
+	case errRevisionMismatch:
+		preconditionFailed(c, err)
+	case errDocNotFound:
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", err))
+	default:
+		badRequest(c, "Error deleting document", err)
+	}
+}
+
+// Bulk applies a list of operations, given as a JSON array or one object
+// per line, with ?mode=transaction (the default), ordered or unordered. A
+// rolled back transaction or a malformed request answers 400 with the
+// outcome of each operation.
+func Bulk(c *echo.Context) {
+	key, valid := idempotencyKey(c)
+	if !valid {
+		return
+	}
+	if key != "" {
+		status, body, replayed, err := bulkIdempotent(pathParam(c, 0), c.Request.URL.Query().Get("mode"), key, c.Request.Body)
+		writeIdempotent(c, status, body, replayed, "Error running bulk operations", err)
+		return
+	}
+
+	result, err := bulk(pathParam(c, 0), c.Request.URL.Query().Get("mode"), c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error running bulk operations", err)
+		return
+	}
+	body, err := result.encode()
+	if err != nil {
+		badRequest(c, "Error running bulk operations", err)
+		return
+	}
+	status := http.StatusOK
+	if !result.Committed {
+		status = http.StatusBadRequest
+	}
+	writeJson(c, status, body)
+}
+
+// writeTransactionResult answers 412 when a check failed, 400 when an
+// operation failed and 200 when the transaction committed.
+func writeTransactionResult(c *echo.Context, result *BulkResult, err error) {
+	if err != nil && err != errTxCheckFailed {
+		if err == errTxNotFound {
+			c.String(http.StatusNotFound, fmt.Sprintf("%s\n", err))
+		} else {
+			badRequest(c, "Error running transaction", err)
+		}
+		return
+	}
+	body, encErr := result.encode()
+	if encErr != nil {
+		badRequest(c, "Error running transaction", encErr)
+		return
+	}
+	status := http.StatusOK
+	if err == errTxCheckFailed {
+		status = http.StatusPreconditionFailed
+	} else if !result.Committed {
+		status = http.StatusBadRequest
+	}
+	writeJson(c, status, body)
+}
+
+func RunTransaction(c *echo.Context) {
+	result, err := runTransaction(pathParam(c, 0), c.Request.Body)
+	writeTransactionResult(c, result, err)
+}
+
+func BeginTransaction(c *echo.Context) {
+	id, expires, err := beginTransaction(pathParam(c, 0), c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error starting transaction", err)
+		return
+	}
+	body, err := encodeDoc(map[interface{}]interface{}{"id": id, "expires": NewDate(expires)})
+	if err != nil {
+		badRequest(c, "Error starting transaction", err)
+		return
+	}
+	okWithBody(c, body.Bytes())
+}
+
+func AddToTransaction(c *echo.Context) {
+	err := addToTransaction(pathParam(c, 0), pathParam(c, 2), c.Request.Body)
+	if err == errTxNotFound {
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", err))
+	} else if err != nil {
+		badRequest(c, "Error adding to transaction", err)
+	} else {
+		ok(c)
+	}
+}
+
+func CommitTransaction(c *echo.Context) {
+	result, err := commitTransaction(pathParam(c, 0), pathParam(c, 2))
+	writeTransactionResult(c, result, err)
+}
+
+func AbortTransaction(c *echo.Context) {
+	if err := abortTransaction(pathParam(c, 0), pathParam(c, 2)); err != nil {
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", err))
+	} else {
+		ok(c)
+	}
+}
+
+// changeHeartbeat is how often an idle change feed sends a comment, so that
+// proxies keep the connection open.
+const changeHeartbeat = 15 * time.Second
+
+// Changes streams the changes of a database, or of one collection, as
+// server-sent events. The id of each event is its sequence number; a
+// client resumes after it with the Last-Event-ID header or ?since=.
+// ?fullDocument=true adds the document to insert and update events and
+// ?filter= limits the feed to documents matching a query.
+func Changes(c *echo.Context) {
+	db, collection := pathParam(c, 0), pathParam(c, 1)
+	if collection == "_changes" {
+		collection = ""
+	}
+	params := c.Request.URL.Query()
+	fullDoc := params.Get("fullDocument") == "true"
+
+	var filter map[interface{}]interface{}
+	if f := params.Get("filter"); f != "" {
+		var err error
+		if filter, err = decodeJson(strings.NewReader(f)); err != nil {
+			badRequest(c, "Error reading change filter", err)
+			return
+		}
+	}
+	token := c.Request.Header.Get("Last-Event-ID")
+	if since := params.Get("since"); since != "" {
+		token = since
+	}
+	var since uint64
+	if token != "" {
+		var err error
+		if since, err = strconv.ParseUint(token, 10, 64); err != nil {
+			badRequest(c, "Error reading resume token", err)
+			return
+		}
+	}
+
+	sub, err := newChangeSubscriber(db, collection, filter)
+	if err != nil {
+		badRequest(c, "Error reading change filter", err)
+		return
+	}
+	started := false
+	start := func() {
+		c.Response.Header().Set(echo.HeaderContentType, "text/event-stream")
+		c.Response.Header().Set("Cache-Control", "no-cache")
+		c.Response.WriteHeader(http.StatusOK)
+		started = true
+	}
+	flusher, _ := c.Response.Writer.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	send := func(change *Change) error {
+		if !started {
+			start()
+		}
+		data, err := change.encode(fullDoc && change.Op != ChangeDelete)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.Response, "id: %d\nevent: %s\ndata: %s\n\n", change.Seq, change.Op, data)
+		flush()
+		return err
+	}
+	failed := func(err error) {
+		if started {
+			return
+		}
+		if err == errResumeTooOld {
+			c.String(http.StatusGone, fmt.Sprintf("%s\n", err))
+		} else {
+			badRequest(c, "Error starting change feed", err)
+		}
+	}
+
+	if token != "" {
+		var err error
+		if since, err = replayChanges(sub, since, send); err != nil {
+			failed(err)
+			return
+		}
+	}
+	backlog, err := hub.subscribe(sub, since, token != "")
+	if err != nil {
+		failed(err)
+		return
+	}
+	defer hub.unsubscribe(sub)
+	if !started {
+		start()
+	}
+
+	for _, change := range backlog {
+		if send(change) != nil {
+			return
+		}
+	}
+	flush()
+
+	heartbeat := time.NewTicker(changeHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case change, ok := <-sub.Changes:
+			// A closed feed fell behind; the client reconnects and resumes.
+			if !ok || send(change) != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Response, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// CreateWebhook registers a webhook for a collection, from
+// {"url": ..., "filter": ..., "secret": ..., "retry": {"maxAttempts": ...,
+// "backoff": ..., "maxBackoff": ...}} with backoffs in seconds.
+func CreateWebhook(c *echo.Context) {
+	hook, err := createWebhook(pathParam(c, 0), pathParam(c, 1), c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error creating webhook", err)
+	} else {
+		okWithBody(c, hook)
+	}
+}
+
+// Webhooks lists the webhooks of a collection with their delivery status.
+func Webhooks(c *echo.Context) {
+	hooks, err := listWebhooks(pathParam(c, 0), pathParam(c, 1))
+	if err != nil {
+		badRequest(c, "Error listing webhooks", err)
+	} else {
+		okWithBody(c, hooks)
+	}
+}
+
+func DeleteWebhook(c *echo.Context) {
+	err := deleteWebhook(pathParam(c, 0), pathParam(c, 1), pathParam(c, 3))
+	if err == errWebhookNotFound {
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", err))
+	} else if err != nil {
+		badRequest(c, "Error deleting webhook", err)
+	} else {
+		ok(c)
+	}
+}
+
+// Oplog returns the oplog entries after ?since=, at most ?limit= of them,
+// oldest first. A client pages through it by passing the seq of the last
+// entry it got. The Oplog-Seq header holds the latest sequence number and
+// Oplog-Epoch the database's epoch.
+func Oplog(c *echo.Context) {
+	params := c.Request.URL.Query()
+	var since, limit uint64
+	var err error
+	if s := params.Get("since"); s != "" {
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			badRequest(c, "Error reading oplog position", err)
+			return
+		}
+	}
+	if l := params.Get("limit"); l != "" {
+		if limit, err = strconv.ParseUint(l, 10, 32); err != nil {
+			badRequest(c, "Error reading oplog limit", err)
+			return
+		}
+	}
+	entries, latest, epoch, err := oplogRange(pathParam(c, 0), since, int(limit))
+	if err == errResumeTooOld {
+		c.String(http.StatusGone, fmt.Sprintf("%s\n", err))
+	} else if err != nil {
+		badRequest(c, "Error reading oplog", err)
+	} else {
+		c.Response.Header().Set(oplogSeqHeader, strconv.FormatUint(latest, 10))
+		c.Response.Header().Set(oplogEpochHeader, epoch)
+		okWithBody(c, entries)
+	}
+}
+
+func Databases(c *echo.Context) {
+	names, err := listDatabases()
+	if err != nil {
+		badRequest(c, "Error listing databases", err)
+		return
+	}
+	list := make([]interface{}, len(names))
+	for i, name := range names {
+		list[i] = name
+	}
+	body, err := encodeDoc(map[interface{}]interface{}{"databases": list})
+	if err != nil {
+		badRequest(c, "Error listing databases", err)
+	} else {
+		okWithBody(c, body.Bytes())
+	}
+}
+
+// Collections lists the collections of a database.
+func Collections(c *echo.Context) {
+	db := c.Param("db")
+	if _, err := os.Stat(dbFileName(db)); os.IsNotExist(err) {
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", errDbNotFound))
+		return
+	}
+	names, err := listCollections(db)
+	if err != nil {
+		badRequest(c, "Error listing collections", err)
+		return
+	}
+	list := make([]interface{}, len(names))
+	for i, name := range names {
+		list[i] = name
+	}
+	body, err := encodeDoc(map[interface{}]interface{}{"collections": list})
+	if err != nil {
+		badRequest(c, "Error listing collections", err)
+	} else {
+		okWithBody(c, body.Bytes())
+	}
+}
+
+// Snapshot sends a consistent copy of a database file, which followers
+// start from.
+func Snapshot(c *echo.Context) {
+	c.Response.Header().Set(echo.HeaderContentType, "application/octet-stream")
+	if err := backupDb(pathParam(c, 0), c.Response, false); err != nil {
+		log.Printf("Error sending snapshot of %s: %s", pathParam(c, 0), err)
+	}
+}
+
+// Backup streams a consistent copy of a database file while writes go on,
+// compressed with gzip when ?gzip=true.
+func Backup(c *echo.Context) {
+	db := pathParam(c, 0)
+	if _, err := os.Stat(dbFileName(db)); os.IsNotExist(err) {
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", errDbNotFound))
+		return
+	}
+	compress := c.Request.URL.Query().Get("gzip") == "true"
+	sendBackup(c, db+".db", compress)
+	if err := backupDb(db, c.Response, compress); err != nil {
+		log.Printf("Error sending backup of %s: %s", db, err)
+	}
+}
+
+// BackupAll streams a tar of every database, compressed with gzip when
+// ?gzip=true.
+func BackupAll(c *echo.Context) {
+	compress := c.Request.URL.Query().Get("gzip") == "true"
+	sendBackup(c, "rtd-"+time.Now().UTC().Format("20060102T150405Z")+".tar", compress)
+	if err := backupAll(c.Response, compress); err != nil {
+		log.Printf("Error sending backup: %s", err)
+	}
+}
+
+func sendBackup(c *echo.Context, filename string, compress bool) {
+	contentType := "application/octet-stream"
+	if compress {
+		contentType, filename = "application/gzip", filename+".gz"
+	}
+	c.Response.Header().Set(echo.HeaderContentType, contentType)
+	c.Response.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Response.WriteHeader(http.StatusOK)
+}
+
+// Restore replaces a database, or creates it, with the file in the body, as
+// sent by Backup.
+func Restore(c *echo.Context) {
+	if err := restoreDb(pathParam(c, 0), c.Request.Body); err != nil {
+		badRequest(c, "Error restoring database", err)
+	} else {
+		ok(c)
+	}
+}
+
+// Clone creates the database {"name": ...} from a copy of this one.
+func Clone(c *echo.Context) {
+	body, err := decodeJson(c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error reading clone request", err)
+		return
+	}
+	name, _ := body["name"].(string)
+	err = createClone(pathParam(c, 0), name)
+	if err == errDbNotFound {
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", err))
+	} else if err == errDbExists {
+		c.String(http.StatusConflict, fmt.Sprintf("%s\n", err))
+	} else if err != nil {
+		badRequest(c, "Error cloning database", err)
+	} else {
+		ok(c)
+	}
+}
+
+// Compact copies a database into a new file without the space freed by
+// deletes and reports the size of the file before and after. Each server
+// compacts its own files, so it is not forwarded to a cluster leader.
+func Compact(c *echo.Context) {
+	result, err := compactDb(pathParam(c, 0))
+	if err == errDbNotFound {
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", err))
+		return
+	} else if err != nil {
+		badRequest(c, "Error compacting database", err)
+		return
+	}
+	encResult, err := encodeDoc(map[interface{}]interface{}{
+		"db":     result.Db,
+		"before": uint64(result.Before),
+		"after":  uint64(result.After),
+	})
+	if err != nil {
+		badRequest(c, "Error compacting database", err)
+	} else {
+		okWithBody(c, encResult.Bytes())
+	}
+}
+
+// Recover recovers a database as it was at {"seq": ..., "time": ...} from
+// the backups and oplog archive, into the database {"into": ...} when set.
+func Recover(c *echo.Context) {
+	body, err := decodeJson(c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error reading recovery request", err)
+		return
+	}
+	target, err := parseRecoveryTarget(body)
+	if err != nil {
+		badRequest(c, "Error reading recovery request", err)
+		return
+	}
+	into, _ := body["into"].(string)
+	r, err := recoverDb(pathParam(c, 0), into, target)
+	if err == errDbExists {
+		c.String(http.StatusConflict, fmt.Sprintf("%s\n", err))
+		return
+	} else if err == errNoBaseBackup {
+		c.String(http.StatusNotFound, fmt.Sprintf("%s\n", err))
+		return
+	} else if err != nil {
+		badRequest(c, "Error recovering database", err)
+		return
+	}
+	result := map[interface{}]interface{}{"db": r.Into, "backup": r.Backup, "seq": r.seq()}
+	if r.Last != nil {
+		result["time"] = NewDate(r.Last.Time)
+	}
+	encResult, err := encodeDoc(result)
+	if err != nil {
+		badRequest(c, "Error recovering database", err)
+	} else {
+		okWithBody(c, encResult.Bytes())
+	}
+}
+
+// Replication reports the role of this server and, on a follower, how far
+// behind the primary each database is.
+func Replication(c *echo.Context) {
+	status := map[interface{}]interface{}{"role": "primary"}
+	if follower != nil {
+		status = follower.status()
+	}
+	body, err := encodeDoc(status)
+	if err != nil {
+		badRequest(c, "Error reading replication status", err)
+	} else {
+		okWithBody(c, body.Bytes())
+	}
+}
+
+// forwardedHeader marks writes forwarded to the cluster leader, so that
+// servers that disagree on the leader do not pass a write back and forth.
+const forwardedHeader = "Rtd-Forwarded"
+
+// writable refuses writes on a follower and forwards them to the leader on
+// the other servers of a cluster.
+func writable(h func(*echo.Context)) func(*echo.Context) {
+	return func(c *echo.Context) {
+		if following != "" {
+			c.String(http.StatusForbidden, fmt.Sprintf("This server is a read-only follower of %s\n", following))
+			return
+		}
+		if cluster != nil && !cluster.awaitLeadership() {
+			leader := cluster.leaderURL()
+			target, err := url.Parse(leader)
+			if leader == "" || err != nil || c.Request.Header.Get(forwardedHeader) != "" {
+				c.String(http.StatusServiceUnavailable, "The cluster has no leader, retry shortly\n")
+				return
+			}
+			c.Request.Header.Set(forwardedHeader, "true")
+			httputil.NewSingleHostReverseProxy(target).ServeHTTP(c.Response, c.Request)
+			return
+		}
+		h(c)
+	}
+}
+
+// collectionRoute refuses paths naming a reserved collection, so that the
+// buckets the server keeps beside the collections can't be read or written
+// as documents.
+func collectionRoute(h func(*echo.Context)) func(*echo.Context) {
+	return func(c *echo.Context) {
+		if !validCollectionName(pathParam(c, 1)) {
+			badRequest(c, "Error opening collection", errReservedCollection)
+			return
+		}
+		h(c)
+	}
+}
+
+// raftMessage answers a Raft message from a peer, read into req.
+func raftMessage(c *echo.Context, req interface{}, handle func() (interface{}, error)) {
+	if cluster == nil {
+		c.String(http.StatusNotFound, "This server is not in a cluster\n")
+		return
+	}
+	if err := codec.NewDecoder(c.Request.Body, jh).Decode(req); err != nil {
+		badRequest(c, "Error reading cluster message", err)
+		return
+	}
+	resp, err := handle()
+	if err != nil {
+		c.String(http.StatusInternalServerError, fmt.Sprintf("%s\n", err))
+		return
+	}
+	var body []byte
+	if err := codec.NewEncoderBytes(&body, jh).Encode(resp); err != nil {
+		c.String(http.StatusInternalServerError, fmt.Sprintf("%s\n", err))
+		return
+	}
+	okWithBody(c, body)
+}
+
+func RaftVote(c *echo.Context) {
+	req := &VoteRequest{}
+	raftMessage(c, req, func() (interface{}, error) {
+		return cluster.handleVote(req), nil
+	})
+}
+
+func RaftAppend(c *echo.Context) {
+	req := &AppendRequest{}
+	raftMessage(c, req, func() (interface{}, error) {
+		return cluster.handleAppend(req)
+	})
+}
+
+func RaftSnapshot(c *echo.Context) {
+	req := &SnapshotRequest{}
+	raftMessage(c, req, func() (interface{}, error) {
+		return cluster.handleSnapshot(req)
+	})
+}
+
+func ClusterStatus(c *echo.Context) {
+	if cluster == nil {
+		c.String(http.StatusNotFound, "This server is not in a cluster\n")
+		return
+	}
+	body, err := encodeDoc(cluster.status())
+	if err != nil {
+		badRequest(c, "Error reading cluster status", err)
+	} else {
+		okWithBody(c, body.Bytes())
+	}
+}
+
+// AddMember adds the server {"id": ..., "url": ...} to the cluster.
+func AddMember(c *echo.Context) {
+	if cluster == nil {
+		c.String(http.StatusNotFound, "This server is not in a cluster\n")
+		return
+	}
+	member, err := decodeJson(c.Request.Body)
+	if err != nil {
+		badRequest(c, "Error reading cluster member", err)
+		return
+	}
+	id, _ := member["id"].(string)
+	u, _ := member["url"].(string)
+	if id == "" || u == "" {
+		badRequest(c, "Error reading cluster member", errors.New("A member needs an id and a url"))
+		return
+	}
+	if err := cluster.changeMembers(id, strings.TrimRight(u, "/"), true); err != nil {
+		badRequest(c, "Error adding cluster member", err)
+	} else {
+		ok(c)
+	}
+}
+
+func RemoveMember(c *echo.Context) {
+	if cluster == nil {
+		c.String(http.StatusNotFound, "This server is not in a cluster\n")
+		return
+	}
+	if err := cluster.changeMembers(pathParam(c, 2), "", false); err != nil {
+		badRequest(c, "Error removing cluster member", err)
+	} else {
+		ok(c)
+	}
 }
 
 func StartHttp(bind string) {
@@ -96,18 +900,51 @@ func StartHttp(bind string) {
 
 	// root
 	e.Get("/", Welcome)
+	e.Get("/_databases", Databases)
+	e.Get("/_replication", Replication)
+	e.Get("/_backup", BackupAll)
+	e.Get("/_cluster", ClusterStatus)
+	e.Post("/_cluster/members", writable(AddMember))
+	e.Delete("/_cluster/members/:id", writable(RemoveMember))
+	e.Post("/_raft/vote", RaftVote)
+	e.Post("/_raft/append", RaftAppend)
+	e.Post("/_raft/snapshot", RaftSnapshot)
 
 	// DB
-	e.Post("/:db", Create)
-	e.Delete("/:db", Delete)
+	e.Get("/:db", Collections)
+	e.Post("/:db", writable(Create))
+	e.Delete("/:db", writable(Delete))
+	e.Post("/:db/_bulk", writable(Bulk))
+	e.Post("/:db/_transaction", writable(RunTransaction))
+	e.Get("/:db/_changes", Changes)
+	e.Get("/:db/_oplog", Oplog)
+	e.Get("/:db/_snapshot", Snapshot)
+	e.Get("/:db/_backup", Backup)
+	e.Put("/:db/_restore", writable(Restore))
+	e.Post("/:db/_clone", writable(Clone))
+	e.Post("/:db/_recover", writable(Recover))
+	e.Post("/:db/_compact", Compact)
+	e.Post("/:db/_transactions", writable(BeginTransaction))
+	e.Post("/:db/_transactions/:txn", writable(AddToTransaction))
+	e.Post("/:db/_transactions/:txn/_commit", writable(CommitTransaction))
+	e.Delete("/:db/_transactions/:txn", writable(AbortTransaction))
 
 	// Documents
-	e.Get("/:db/:collection", Query)
-	e.Put("/:db/:collection", UpdateQuery)
-	e.Post("/:db/:collection", InsertDoc)
-	e.Get("/:db/:collection/:id", FindDoc)
-	e.Put("/:db/:collection/:id", UpdateDoc)
-	e.Delete("/:db/:collection/:id", DeleteDoc)
+	e.Get("/:db/:collection", collectionRoute(Query))
+	e.Get("/:db/:collection/_explain", collectionRoute(Explain))
+	e.Get("/:db/:collection/_changes", collectionRoute(Changes))
+	e.Put("/:db/:collection", collectionRoute(writable(UpdateQuery)))
+	e.Post("/:db/:collection", collectionRoute(writable(InsertDoc)))
+	e.Post("/:db/:collection/_aggregate", collectionRoute(Aggregate))
+	e.Post("/:db/:collection/_mapreduce", collectionRoute(writable(MapReduce)))
+	e.Post("/:db/:collection/_findAndModify", collectionRoute(writable(FindAndModify)))
+	e.Post("/:db/:collection/_mget", collectionRoute(MultiGet))
+	e.Get("/:db/:collection/_webhooks", collectionRoute(Webhooks))
+	e.Post("/:db/:collection/_webhooks", collectionRoute(writable(CreateWebhook)))
+	e.Delete("/:db/:collection/_webhooks/:id", collectionRoute(writable(DeleteWebhook)))
+	e.Get("/:db/:collection/:id", collectionRoute(FindDoc))
+	e.Put("/:db/:collection/:id", collectionRoute(writable(UpdateDoc)))
+	e.Delete("/:db/:collection/:id", collectionRoute(writable(DeleteDoc)))
 
 	e.Run(bind)
 }
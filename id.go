@@ -4,10 +4,15 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 )
 
+// uuidEpoch is the number of 100 nanosecond intervals between the UUID
+// epoch, 15 Oct 1582, and the Unix epoch.
+const uuidEpoch = 122192928000000000
+
 func NewId() (string, []byte, error) {
 	id := uuid.NewUUID()
 	lookupId, err := buildLookupId(id)
@@ -32,3 +37,48 @@ func buildLookupId(id uuid.UUID) ([]byte, error) {
 	binary.Write(writer, binary.BigEndian, id)
 	return writer.Bytes(), nil
 }
+
+// IdTime returns the creation time encoded at the start of a lookup id.
+func IdTime(lookupId []byte) time.Time {
+	return UUIDTimeToTime(uuid.Time(binary.BigEndian.Uint64(lookupId)))
+}
+
+// maxUUIDTime is the latest time a UUID can hold, in its 60 bits.
+const maxUUIDTime = 1<<60 - 1
+
+const uuidTicksPerSecond = 10000000
+
+// TimeToUUIDTime rounds t down to the 100 nanosecond precision of UUID times,
+// clamped to the times a UUID can hold.
+func TimeToUUIDTime(t time.Time) uuid.Time {
+	sec := t.Unix() + uuidEpoch/uuidTicksPerSecond
+	if sec < 0 {
+		return 0
+	}
+	if sec > maxUUIDTime/uuidTicksPerSecond {
+		return maxUUIDTime
+	}
+	ticks := sec*uuidTicksPerSecond + int64(t.Nanosecond()/100)
+	if ticks > maxUUIDTime {
+		return maxUUIDTime
+	}
+	return uuid.Time(ticks)
+}
+
+func UUIDTimeToTime(t uuid.Time) time.Time {
+	sec, nsec := t.UnixTime()
+	return time.Unix(sec, nsec).UTC()
+}
+
+// TimeKey returns the smallest lookup id created at or after t, for seeking
+// a cursor to a creation time.
+func TimeKey(t uuid.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t))
+	return key
+}
+
+// IdString returns the string form of the UUID in a lookup id.
+func IdString(lookupId []byte) string {
+	return uuid.UUID(lookupId[8:]).String()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Writes sent with an Idempotency-Key header are recorded with their
+// response in the "_idempotency" bucket of their database, in the same
+// transaction as the write. A retry with the same key gets the recorded
+// response instead of writing again. Records are kept for
+// idempotencyRetention.
+//
+// The bucket holds a "keys" bucket mapping keys to records and an "expiry"
+// bucket of creation times followed by keys, for pruning old records in
+// order.
+const idempotencyBucket = "_idempotency"
+
+var idempotencyRetention = 24 * time.Hour
+
+var errIdempotencyKeyReused = errors.New("Idempotency key was already used for a different request")
+
+// An IdempotentWrite performs a write in tx and returns the status and body
+// of its response.
+type IdempotentWrite func(tx *bolt.Tx) (int, []byte, error)
+
+// idempotent runs write unless key has a record for the same request, in
+// which case it returns the recorded response with replayed set. Failed
+// writes are not recorded, so they can be retried.
+func idempotent(db string, key string, request string, write IdempotentWrite) (status int, body []byte, replayed bool, err error) {
+	now := time.Now()
+	err = updateDb(db, func(tx *bolt.Tx) error {
+		keys, expiry, err := idempotencyBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if err := pruneIdempotencyKeys(keys, expiry, now.Add(-idempotencyRetention)); err != nil {
+			return err
+		}
+
+		if record := keys.Get([]byte(key)); record != nil {
+			doc, err := decodeJson(record)
+			if err != nil {
+				return err
+			}
+			if doc["request"] != request {
+				return errIdempotencyKeyReused
+			}
+			s, _ := intValue(doc["status"])
+			b, _ := doc["body"].(string)
+			status, body, replayed = int(s), []byte(b), true
+			return nil
+		}
+
+		if status, body, err = write(tx); err != nil {
+			return err
+		}
+		record, err := encodeDoc(map[interface{}]interface{}{
+			"request": request,
+			"status":  uint64(status),
+			"body":    string(body),
+			"created": NewDate(now),
+		})
+		if err != nil {
+			return err
+		}
+		if err := keys.Put([]byte(key), record.Bytes()); err != nil {
+			return err
+		}
+		return expiry.Put(expiryKey(now, key), nil)
+	})
+	return status, body, replayed, err
+}
+
+func idempotencyBuckets(tx *bolt.Tx) (*StateBucket, *StateBucket, error) {
+	keys, err := openState(tx, idempotencyBucket, "keys")
+	if err != nil {
+		return nil, nil, err
+	}
+	expiry, err := openState(tx, idempotencyBucket, "expiry")
+	return keys, expiry, err
+}
+
+func expiryKey(t time.Time, key string) []byte {
+	k := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return append(k, key...)
+}
+
+// pruneIdempotencyKeys removes the records created before cutoff.
+func pruneIdempotencyKeys(keys *StateBucket, expiry *StateBucket, cutoff time.Time) error {
+	end := expiryKey(cutoff, "")
+	var expired [][]byte
+	c := expiry.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+		expired = append(expired, append([]byte{}, k...))
+	}
+	for _, k := range expired {
+		if err := keys.Delete(k[8:]); err != nil {
+			return err
+		}
+		if err := expiry.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestFingerprint identifies a request by its endpoint and body, so that
+// a key reused for a different request is refused rather than replayed.
+func requestFingerprint(endpoint string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return endpoint + " " + hex.EncodeToString(sum[:])
+}
+
+func insertDocIdempotent(db string, collection string, key string, reader io.Reader) (int, []byte, bool, error) {
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	doc, lookupId, err := parseNewDoc(body)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return idempotent(db, key, requestFingerprint("insert "+collection, body), func(tx *bolt.Tx) (int, []byte, error) {
+		bucket, err := openCollection(tx, collection)
+		if err != nil {
+			return 0, nil, err
+		}
+		encDoc, err := putDoc(bucket, lookupId, doc)
+		if err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, encDoc.Bytes(), nil
+	})
+}
+
+// bulkIdempotent runs a bulk request under an idempotency key. A rolled
+// back transaction writes nothing, so it is not recorded either.
+func bulkIdempotent(db string, mode string, key string, reader io.Reader) (int, []byte, bool, error) {
+	mode, err := bulkMode(mode)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	ops, result, err := parseBulk(bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if result != nil {
+		encResult, err := result.encode()
+		return http.StatusBadRequest, encResult, false, err
+	}
+
+	result = &BulkResult{}
+	status, encResult, replayed, err := idempotent(db, key, requestFingerprint("bulk "+mode, body), func(tx *bolt.Tx) (int, []byte, error) {
+		if err := applyBulkOps(tx, ops, mode, result); err != nil {
+			return 0, nil, err
+		}
+		encResult, err := result.encode()
+		return http.StatusOK, encResult, err
+	})
+	if err == errBulkRolledBack {
+		encResult, err := result.encode()
+		return http.StatusBadRequest, encResult, false, err
+	}
+	return status, encResult, replayed, err
+}
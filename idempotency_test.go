@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestIdempotentInsert(t *testing.T) {
+	defer withTestDir(t)()
+
+	status, first, replayed, err := insertDocIdempotent("app", "users", "key-1", strings.NewReader(`{"name": "ada"}`))
+	assert.Ok(t, err)
+	assert.Equals(t, http.StatusOK, status)
+	assert.Cond(t, !replayed, "the first request should not be a replay")
+
+	_, retry, replayed, err := insertDocIdempotent("app", "users", "key-1", strings.NewReader(`{"name": "ada"}`))
+	assert.Ok(t, err)
+	assert.Cond(t, replayed, "the retry should be a replay")
+	assert.Equals(t, string(first), string(retry))
+	assert.Equals(t, 1, countDocs(t, "app", "users", `{}`))
+
+	_, _, _, err = insertDocIdempotent("app", "users", "key-1", strings.NewReader(`{"name": "bob"}`))
+	assert.Equals(t, errIdempotencyKeyReused, err)
+
+	_, _, replayed, err = insertDocIdempotent("app", "users", "key-2", strings.NewReader(`{"name": "ada"}`))
+	assert.Ok(t, err)
+	assert.Cond(t, !replayed, "a new key should write")
+	assert.Equals(t, 2, countDocs(t, "app", "users", `{}`))
+}
+
+func TestIdempotencyRetention(t *testing.T) {
+	defer withTestDir(t)()
+	defer func(retention time.Duration) { idempotencyRetention = retention }(idempotencyRetention)
+	idempotencyRetention = time.Millisecond
+
+	_, _, _, err := insertDocIdempotent("app", "users", "key", strings.NewReader(`{"name": "ada"}`))
+	assert.Ok(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, _, replayed, err := insertDocIdempotent("app", "users", "key", strings.NewReader(`{"name": "ada"}`))
+	assert.Ok(t, err)
+	assert.Cond(t, !replayed, "expired keys should be forgotten")
+	assert.Equals(t, 2, countDocs(t, "app", "users", `{}`))
+}
+
+func TestIdempotentBulk(t *testing.T) {
+	defer withTestDir(t)()
+	ops := `[{"op": "insert", "collection": "users", "doc": {"name": "ada"}}]`
+
+	status, first, _, err := bulkIdempotent("app", "", "key", strings.NewReader(ops))
+	assert.Ok(t, err)
+	assert.Equals(t, http.StatusOK, status)
+	_, retry, replayed, err := bulkIdempotent("app", "", "key", strings.NewReader(ops))
+	assert.Ok(t, err)
+	assert.Cond(t, replayed, "the retry should be a replay")
+	assert.Equals(t, string(first), string(retry))
+	assert.Equals(t, 1, countDocs(t, "app", "users", `{}`))
+
+	failing := `[{"op": "update", "collection": "users", "id": "00000000-0000-1000-8000-000000000000", "update": {"a": 1}}]`
+	status, _, _, err = bulkIdempotent("app", "", "failing", strings.NewReader(failing))
+	assert.Ok(t, err)
+	assert.Equals(t, http.StatusBadRequest, status)
+	_, _, replayed, err = bulkIdempotent("app", "", "failing", strings.NewReader(failing))
+	assert.Ok(t, err)
+	assert.Cond(t, !replayed, "rolled back transactions should not be recorded")
+}
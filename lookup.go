@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// fieldIndex maps the values of one field to the documents holding them.
+// Array values are indexed under each element, like the query matcher, and
+// documents without the field are indexed under null. Strings are compared
+// under the pipeline's collation.
+type fieldIndex struct {
+	coll *Collation
+	docs map[string][]map[interface{}]interface{}
+}
+
+func buildFieldIndex(docs []map[interface{}]interface{}, path string, coll *Collation) *fieldIndex {
+	index := &fieldIndex{coll: coll, docs: map[string][]map[interface{}]interface{}{}}
+	for _, doc := range docs {
+		for _, v := range fieldValues(doc, path) {
+			key := collatedGroupKey(v, coll)
+			index.docs[key] = append(index.docs[key], doc)
+		}
+	}
+	return index
+}
+
+// find returns the documents matching any of the values, without duplicates.
+func (index *fieldIndex) find(values []interface{}) []map[interface{}]interface{} {
+	found := []map[interface{}]interface{}{}
+	seen := map[string]bool{}
+	for _, v := range values {
+		for _, doc := range index.docs[collatedGroupKey(v, index.coll)] {
+			id := groupKey(doc["_id"])
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			found = append(found, doc)
+		}
+	}
+	return found
+}
+
+// fieldValues returns the values of a field to match, null when the
+// document has no such field.
+func fieldValues(doc map[interface{}]interface{}, path string) []interface{} {
+	if value, ok := lookupField(doc, path); ok {
+		return matchValues(value)
+	}
+	return []interface{}{nil}
+}
+
+// matchValues expands arrays so that each element can be matched.
+func matchValues(value interface{}) []interface{} {
+	if slice, ok := value.([]interface{}); ok {
+		return slice
+	}
+	return []interface{}{value}
+}
+
+func stringArg(spec map[interface{}]interface{}, stage string, name string) (string, error) {
+	value, ok := spec[name].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("%s requires %s", stage, name)
+	}
+	return value, nil
+}
+
+// lookupStage joins each document with the documents of another collection
+// in the same database whose foreignField matches its localField.
+func lookupStage(arg interface{}, coll *Collation) (Stage, error) {
+	spec, ok := arg.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("$lookup requires an object")
+	}
+	var from, localField, foreignField, as string
+	var err error
+	for name, dest := range map[string]*string{"from": &from, "localField": &localField, "foreignField": &foreignField, "as": &as} {
+		if *dest, err = stringArg(spec, "$lookup", name); err != nil {
+			return nil, err
+		}
+	}
+	if !validCollectionName(from) {
+		return nil, errReservedCollection
+	}
+
+	return func(tx *bolt.Tx, docs []map[interface{}]interface{}) ([]map[interface{}]interface{}, error) {
+		foreignDocs, err := loadCollection(tx, from)
+		if err != nil {
+			return nil, err
+		}
+		index := buildFieldIndex(foreignDocs, foreignField, coll)
+
+		for i, doc := range docs {
+			joined := copyDoc(doc)
+			setField(joined, as, docsToValues(index.find(fieldValues(doc, localField))))
+			docs[i] = joined
+		}
+		return docs, nil
+	}, nil
+}
+
+// graphLookupStage recursively follows connectFromField to connectToField
+// in another collection, starting from the startWith expression.
+func graphLookupStage(arg interface{}, coll *Collation) (Stage, error) {
+	spec, ok := arg.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("$graphLookup requires an object")
+	}
+	var from, connectFromField, connectToField, as string
+	var err error
+	for name, dest := range map[string]*string{"from": &from, "connectFromField": &connectFromField, "connectToField": &connectToField, "as": &as} {
+		if *dest, err = stringArg(spec, "$graphLookup", name); err != nil {
+			return nil, err
+		}
+	}
+	if !validCollectionName(from) {
+		return nil, errReservedCollection
+	}
+	startWith, ok := spec["startWith"]
+	if !ok {
+		return nil, errors.New("$graphLookup requires startWith")
+	}
+	maxDepth := int64(-1)
+	if v, ok := spec["maxDepth"]; ok {
+		if maxDepth, ok = intValue(v); !ok || maxDepth < 0 {
+			return nil, errors.New("$graphLookup maxDepth must be a non-negative integer")
+		}
+	}
+	depthField, _ := spec["depthField"].(string)
+
+	return func(tx *bolt.Tx, docs []map[interface{}]interface{}) ([]map[interface{}]interface{}, error) {
+		foreignDocs, err := loadCollection(tx, from)
+		if err != nil {
+			return nil, err
+		}
+		index := buildFieldIndex(foreignDocs, connectToField, coll)
+
+		for i, doc := range docs {
+			var found []interface{}
+			visited := map[string]bool{}
+			start, err := evalExpr(NewExprScope(doc, nil), startWith)
+			if err != nil {
+				return nil, err
+			}
+			values := matchValues(start)
+			for depth := int64(0); len(values) > 0 && (maxDepth < 0 || depth <= maxDepth); depth++ {
+				var next []interface{}
+				for _, match := range index.find(values) {
+					key := groupKey(match["_id"])
+					if visited[key] {
+						continue
+					}
+					visited[key] = true
+
+					if depthField != "" {
+						match = copyDoc(match)
+						match[depthField] = uint64(depth)
+					}
+					found = append(found, match)
+					if value, ok := lookupField(match, connectFromField); ok {
+						next = append(next, matchValues(value)...)
+					}
+				}
+				values = next
+			}
+
+			joined := copyDoc(doc)
+			if found == nil {
+				found = []interface{}{}
+			}
+			setField(joined, as, found)
+			docs[i] = joined
+		}
+		return docs, nil
+	}, nil
+}
+
+func docsToValues(docs []map[interface{}]interface{}) []interface{} {
+	values := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		values[i] = doc
+	}
+	return values
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// mapReduceBucket holds the state of map-reduce jobs, one nested bucket per
+// output collection. It records the oplog sequence number each source
+// collection was reduced up to, the key every source document emitted and,
+// for every emitted key, the output document id and unfinalized value.
+// Incremental runs read the source's changes from the oplog: keys that only
+// gained documents re-reduce their new values into the previous result, and
+// keys that lost or changed a document are reduced again from their
+// documents.
+const mapReduceBucket = "_mapreduce"
+
+const (
+	progressBucket      = "progress"
+	sourceKeysBucket    = "sources"
+	membersBucket       = "members"
+	reducedValuesBucket = "reduced"
+)
+
+var errMapReducePruned = errors.New("The changes since the last map-reduce run were pruned from the oplog, run it again without incremental")
+
+type MapReduceJob struct {
+	key         interface{}
+	value       interface{}
+	reduce      interface{}
+	finalize    interface{}
+	query       map[interface{}]interface{}
+	out         string
+	incremental bool
+}
+
+type mapReduceGroup struct {
+	key    interface{}
+	values []interface{}
+
+	// dirty marks a key that lost or changed a document since the last
+	// run, so its previous result can't be re-reduced.
+	dirty bool
+}
+
+func parseMapReduceJob(body map[interface{}]interface{}) (*MapReduceJob, error) {
+	mapSpec, ok := body["map"].(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("map-reduce requires a map object with key and value expressions")
+	}
+	job := &MapReduceJob{key: mapSpec["key"], value: mapSpec["value"]}
+	if job.key == nil || job.value == nil {
+		return nil, errors.New("map-reduce requires a map object with key and value expressions")
+	}
+
+	job.reduce, ok = body["reduce"]
+	if !ok {
+		return nil, errors.New("map-reduce requires a reduce expression")
+	}
+	job.finalize = body["finalize"]
+
+	if query, ok := body["query"]; ok {
+		job.query, ok = query.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("map-reduce query must be an object")
+		}
+		if err := checkQuery(job.query); err != nil {
+			return nil, err
+		}
+	}
+
+	job.out, ok = body["out"].(string)
+	if !ok || job.out == "" {
+		return nil, errors.New("map-reduce requires an out collection")
+	}
+	if !validCollectionName(job.out) {
+		return nil, errReservedCollection
+	}
+	job.incremental, _ = body["incremental"].(bool)
+	return job, nil
+}
+
+func mapReduce(db string, collection string, jobReader io.Reader) ([]byte, error) {
+	body, err := decodeJson(jobReader)
+	if err != nil {
+		return nil, err
+	}
+	job, err := parseMapReduceJob(body)
+	if err != nil {
+		return nil, err
+	}
+	if job.out == collection {
+		return nil, errors.New("map-reduce cannot write to its source collection")
+	}
+
+	var result *bytes.Buffer
+	err = updateDb(db, func(tx *bolt.Tx) error {
+		stats, err := job.run(tx, collection)
+		if err != nil {
+			return err
+		}
+		result, err = encodeDoc(stats)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.Bytes(), nil
+}
+
+func (job *MapReduceJob) run(tx *bolt.Tx, collection string) (map[interface{}]interface{}, error) {
+	states, err := openState(tx, mapReduceBucket)
+	if err != nil {
+		return nil, err
+	}
+	out, err := openCollection(tx, job.out)
+	if err != nil {
+		return nil, err
+	}
+	if !job.incremental {
+		if err := clearCollection(out); err != nil {
+			return nil, err
+		}
+		if states.NestedBucket(job.out) != nil {
+			if err := states.DeleteBucket(job.out); err != nil {
+				return nil, err
+			}
+		}
+	}
+	state, err := states.CreateBucketIfNotExists(job.out)
+	if err != nil {
+		return nil, err
+	}
+	reducedValues, err := state.CreateBucketIfNotExists(reducedValuesBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, order, processed, err := job.mapDocs(tx, collection, state)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, gk := range order {
+		group := groups[gk]
+		var id string
+		var lookupId []byte
+		previous := reducedValues.Get([]byte(gk))
+		if previous != nil {
+			prevDoc, err := decodeJson(previous)
+			if err != nil {
+				return nil, err
+			}
+			id, _ = prevDoc["_id"].(string)
+			if lookupId, err = ParseId(id); err != nil {
+				return nil, err
+			}
+			if !group.dirty {
+				group.values = append([]interface{}{prevDoc["value"]}, group.values...)
+			}
+		} else if id, lookupId, err = NewId(); err != nil {
+			return nil, err
+		}
+		if group.dirty {
+			if group.values, err = job.memberValues(tx, state, gk); err != nil {
+				return nil, err
+			}
+		}
+
+		// A key left without documents has no result.
+		if len(group.values) == 0 {
+			if err := reducedValues.Delete([]byte(gk)); err != nil {
+				return nil, err
+			}
+			if err := deleteDocValue(out, lookupId); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		reduced, err := evalExpr(NewExprScope(nil, map[string]interface{}{"key": group.key, "values": group.values}), job.reduce)
+		if err != nil {
+			return nil, err
+		}
+		encState, err := encodeDoc(map[interface{}]interface{}{"_id": id, "key": group.key, "value": reduced})
+		if err != nil {
+			return nil, err
+		}
+		if err := reducedValues.Put([]byte(gk), encState.Bytes()); err != nil {
+			return nil, err
+		}
+
+		value := reduced
+		if job.finalize != nil {
+			value, err = evalExpr(NewExprScope(nil, map[string]interface{}{"key": group.key, "value": reduced}), job.finalize)
+			if err != nil {
+				return nil, err
+			}
+		}
+		encDoc, err := encodeDoc(map[interface{}]interface{}{"_id": id, "key": group.key, "value": value})
+		if err != nil {
+			return nil, err
+		}
+		if err := putDocValue(out, lookupId, encDoc.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[interface{}]interface{}{
+		"out":       job.out,
+		"processed": processed,
+		"keys":      uint64(len(order)),
+	}, nil
+}
+
+// mapDocs emits a key and value for each matching source document changed
+// since the last run, or for every one on the first run, and moves the
+// documents between the keys they emit. Keys a document left, or emitted
+// a different value for, are marked dirty.
+func (job *MapReduceJob) mapDocs(tx *bolt.Tx, collection string, state *StateBucket) (map[string]*mapReduceGroup, []string, uint64, error) {
+	groups := map[string]*mapReduceGroup{}
+	var order []string
+	var processed uint64
+	group := func(gk string, key interface{}) *mapReduceGroup {
+		g, ok := groups[gk]
+		if !ok {
+			g = &mapReduceGroup{key: key}
+			groups[gk] = g
+			order = append(order, gk)
+		}
+		return g
+	}
+
+	source, err := collectionBucket(tx, collection)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	progress, err := state.CreateBucketIfNotExists(progressBucket)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sourceKeys, err := state.CreateBucketIfNotExists(sourceKeysBucket)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	members, err := state.CreateBucketIfNotExists(membersBucket)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	// The output collection's own writes come after seq.
+	seq := oplogSeq(tx)
+	ids, err := changedDocs(tx, collection, source, progress.Get([]byte(collection)))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	for _, lookupId := range ids {
+		if prevGk := sourceKeys.Get(lookupId); prevGk != nil {
+			prevGk = append([]byte{}, prevGk...)
+			if err := removeMember(members, prevGk, lookupId); err != nil {
+				return nil, nil, 0, err
+			}
+			if err := sourceKeys.Delete(lookupId); err != nil {
+				return nil, nil, 0, err
+			}
+			reducedKey, err := reducedKey(state, prevGk)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			group(string(prevGk), reducedKey).dirty = true
+		}
+
+		var v []byte
+		if source != nil {
+			v = source.Get(lookupId)
+		}
+		if v == nil {
+			continue
+		}
+		doc, err := decodeJson(v)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if job.query != nil {
+			match, err := queryMatch(doc, job.query, nil)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			if !match {
+				continue
+			}
+		}
+		processed++
+
+		key, value, err := job.mapDoc(doc)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		gk := groupKey(key)
+		if err := addMember(members, []byte(gk), lookupId, collection); err != nil {
+			return nil, nil, 0, err
+		}
+		if err := sourceKeys.Put(lookupId, []byte(gk)); err != nil {
+			return nil, nil, 0, err
+		}
+		g := group(gk, key)
+		g.values = append(g.values, value)
+	}
+
+	if err := progress.Put([]byte(collection), oplogKey(seq)); err != nil {
+		return nil, nil, 0, err
+	}
+	return groups, order, processed, nil
+}
+
+// changedDocs returns the keys of the source documents changed after the
+// sequence number in since, in key order, or of every document when since
+// is nil.
+func changedDocs(tx *bolt.Tx, collection string, source *bolt.Bucket, since []byte) ([][]byte, error) {
+	var ids [][]byte
+	if since == nil {
+		if source == nil {
+			return nil, nil
+		}
+		err := source.ForEach(func(k []byte, v []byte) error {
+			ids = append(ids, append([]byte{}, k...))
+			return nil
+		})
+		return ids, err
+	}
+
+	changes, err := readOplog(tx, uint64Value(since), 0)
+	if err == errResumeTooOld {
+		return nil, errMapReducePruned
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, change := range changes {
+		if change.Collection != collection || seen[change.Id] {
+			continue
+		}
+		seen[change.Id] = true
+		lookupId, err := ParseId(change.Id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, lookupId)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i], ids[j]) < 0 })
+	return ids, nil
+}
+
+func (job *MapReduceJob) mapDoc(doc map[interface{}]interface{}) (interface{}, interface{}, error) {
+	scope := NewExprScope(doc, nil)
+	key, err := evalExpr(scope, job.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := evalExpr(scope, job.value)
+	return key, value, err
+}
+
+// memberValues maps again the documents that emit a key, in key order.
+func (job *MapReduceJob) memberValues(tx *bolt.Tx, state *StateBucket, gk string) ([]interface{}, error) {
+	var values []interface{}
+	keyMembers := state.NestedBucket(membersBucket).NestedBucket(gk)
+	if keyMembers == nil {
+		return values, nil
+	}
+	err := keyMembers.ForEach(func(lookupId []byte, collection []byte) error {
+		source := tx.Bucket(collection)
+		if source == nil {
+			return nil
+		}
+		v := source.Get(lookupId)
+		if v == nil {
+			return nil
+		}
+		doc, err := decodeJson(v)
+		if err != nil {
+			return err
+		}
+		_, value, err := job.mapDoc(doc)
+		values = append(values, value)
+		return err
+	})
+	return values, err
+}
+
+func addMember(members *StateBucket, gk []byte, lookupId []byte, collection string) error {
+	keyMembers, err := members.CreateBucketIfNotExists(string(gk))
+	if err != nil {
+		return err
+	}
+	return keyMembers.Put(lookupId, []byte(collection))
+}
+
+func removeMember(members *StateBucket, gk []byte, lookupId []byte) error {
+	keyMembers := members.NestedBucket(string(gk))
+	if keyMembers == nil {
+		return nil
+	}
+	if err := keyMembers.Delete(lookupId); err != nil {
+		return err
+	}
+	if k, _ := keyMembers.Cursor().First(); k == nil {
+		return members.DeleteBucket(string(gk))
+	}
+	return nil
+}
+
+// reducedKey returns the key a previous run reduced under gk.
+func reducedKey(state *StateBucket, gk []byte) (interface{}, error) {
+	previous := state.NestedBucket(reducedValuesBucket).Get(gk)
+	if previous == nil {
+		return nil, nil
+	}
+	prevDoc, err := decodeJson(previous)
+	if err != nil {
+		return nil, err
+	}
+	return prevDoc["key"], nil
+}
+
+// clearCollection deletes every document of a collection, one at a time so
+// that the deletes reach the oplog.
+func clearCollection(bucket *bolt.Bucket) error {
+	var keys [][]byte
+	bucket.ForEach(func(k []byte, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	for _, k := range keys {
+		if err := deleteDocValue(bucket, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
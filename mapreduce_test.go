@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hooklift/assert"
+	"github.com/ugorji/go/codec"
+)
+
+func TestMapReduceIncremental(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "shop", "orders",
+		`{"customer": "ann", "total": 10}`,
+		`{"customer": "bob", "total": 5}`,
+		`{"customer": "ann", "total": 20}`,
+	)
+
+	job := `{
+		"map": {"key": "$customer", "value": "$total"},
+		"reduce": {"$sum": "$$values"},
+		"finalize": {"$multiply": ["$$value", 2]},
+		"out": "totals",
+		"incremental": true
+	}`
+	totals := func() map[interface{}]interface{} {
+		encDocs, err := query("shop", "totals", strings.NewReader(`{}`))
+		assert.Ok(t, err)
+		result := map[interface{}]interface{}{}
+		for _, doc := range decodeDocs(t, encDocs) {
+			result[doc["key"]] = doc["value"]
+		}
+		return result
+	}
+
+	_, err := mapReduce("shop", "orders", strings.NewReader(job))
+	assert.Ok(t, err)
+	assert.Equals(t, map[interface{}]interface{}{"ann": uint64(60), "bob": uint64(10)}, totals())
+
+	insertTestDocs(t, "shop", "orders", `{"customer": "bob", "total": 1}`)
+	stats, err := mapReduce("shop", "orders", strings.NewReader(job))
+	assert.Ok(t, err)
+	statsDoc, err := decodeJson(stats)
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(1), statsDoc["processed"])
+	assert.Equals(t, map[interface{}]interface{}{"ann": uint64(60), "bob": uint64(12)}, totals())
+}
+
+func TestMapReduceIncrementalChanges(t *testing.T) {
+	defer withTestDir(t)()
+	oldId, _, err := NewId()
+	assert.Ok(t, err)
+	insertTestDocs(t, "shop", "orders",
+		`{"customer": "ann", "total": 10}`,
+		`{"customer": "bob", "total": 5}`,
+		`{"customer": "cy", "total": 7}`,
+	)
+
+	job := `{"map": {"key": "$customer", "value": "$total"}, "reduce": {"$sum": "$$values"}, "out": "totals", "incremental": true}`
+	run := func(job string) map[interface{}]interface{} {
+		_, err := mapReduce("shop", "orders", strings.NewReader(job))
+		assert.Ok(t, err)
+		encDocs, err := query("shop", "totals", strings.NewReader(`{}`))
+		assert.Ok(t, err)
+		result := map[interface{}]interface{}{}
+		for _, doc := range decodeDocs(t, encDocs) {
+			result[doc["key"]] = doc["value"]
+		}
+		return result
+	}
+	run(job)
+
+	// Updates, deletes and documents with ids older than the last run all
+	// reach the output, which matches a full run.
+	_, err = updateQuery("shop", "orders", strings.NewReader(`{"query": {"customer": "ann"}, "update": {"total": 11}}`))
+	assert.Ok(t, err)
+	_, err = updateQuery("shop", "orders", strings.NewReader(`{"query": {"customer": "bob"}, "update": {"customer": "ann"}}`))
+	assert.Ok(t, err)
+	_, err = bulk("shop", "", strings.NewReader(`[{"op": "delete", "collection": "orders", "query": {"customer": "cy"}}]`))
+	assert.Ok(t, err)
+	insertTestDocs(t, "shop", "orders", `{"_id": "`+oldId+`", "customer": "dee", "total": 3}`)
+
+	expected := map[interface{}]interface{}{"ann": uint64(16), "dee": uint64(3)}
+	assert.Equals(t, expected, run(job))
+	assert.Equals(t, expected, run(strings.Replace(job, `"incremental": true`, `"incremental": false`, 1)))
+
+	// An incremental run can't skip changes pruned from the oplog.
+	defer func(retention time.Duration) { oplogRetention = retention }(oplogRetention)
+	oplogRetention = time.Nanosecond
+	insertTestDocs(t, "shop", "orders", `{"customer": "eve", "total": 1}`, `{"customer": "eve", "total": 2}`)
+	_, err = mapReduce("shop", "orders", strings.NewReader(job))
+	assert.Equals(t, errMapReducePruned, err)
+}
+
+func TestMapReduceStateReplicates(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "shop", "orders", `{"customer": "ann", "total": 10}`, `{"customer": "bob", "total": 5}`)
+	job := `{"map": {"key": "$customer", "value": "$total"}, "reduce": {"$sum": "$$values"}, "out": "totals", "incremental": true}`
+
+	// The state a run writes is collected for the cluster log with its
+	// changes, and survives a trip through the log's encoding.
+	run := func(since uint64, index uint64) {
+		var entry []byte
+		err := updateDb("shop", func(tx *bolt.Tx) error {
+			body, err := decodeJson(strings.NewReader(job))
+			if err != nil {
+				return err
+			}
+			mr, err := parseMapReduceJob(body)
+			if err != nil {
+				return err
+			}
+			if _, err := mr.run(tx, "orders"); err != nil {
+				return err
+			}
+			changes, err := readOplog(tx, since, 0)
+			if err != nil {
+				return err
+			}
+			raftEntry := &RaftEntry{Type: RaftChanges, Db: "copy", State: txChangeSet(tx).state}
+			for _, change := range changes {
+				raftEntry.Changes = append(raftEntry.Changes, change.entry(true))
+			}
+			return codec.NewEncoderBytes(&entry, jh).Encode(raftEntry)
+		})
+		assert.Ok(t, err)
+		var decoded RaftEntry
+		assert.Ok(t, codec.NewDecoderBytes(entry, jh).Decode(&decoded))
+		assert.Cond(t, len(decoded.State) > 0, "a run should write state")
+		assert.Ok(t, applyClusterEntry(index, &decoded))
+	}
+	run(0, 1)
+
+	insertTestDocs(t, "shop", "orders", `{"customer": "bob", "total": 1}`)
+	seq := dbSeq(t, "shop")
+	run(seq-1, 2)
+
+	// The copy continues from the replicated state.
+	insertTestDocs(t, "copy", "orders", `{"customer": "ann", "total": 2}`)
+	stats, err := mapReduce("copy", "orders", strings.NewReader(job))
+	assert.Ok(t, err)
+	statsDoc, err := decodeJson(stats)
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(1), statsDoc["processed"])
+	encDocs, err := query("copy", "totals", strings.NewReader(`{}`))
+	assert.Ok(t, err)
+	totals := map[interface{}]interface{}{}
+	for _, doc := range decodeDocs(t, encDocs) {
+		totals[doc["key"]] = doc["value"]
+	}
+	assert.Equals(t, map[interface{}]interface{}{"ann": uint64(12), "bob": uint64(6)}, totals)
+}
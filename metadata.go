@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Every document written through insertDoc, updateDoc and updateQuery
+// carries metadata maintained by the database: its creation time, taken
+// from the time in its UUID, the time of its last write and a revision
+// number that starts at 1 and grows with every write. The times are dates,
+// so they can be queried and sorted like any other field.
+const (
+	createdAtField = "_createdAt"
+	updatedAtField = "_updatedAt"
+	revField       = "_rev"
+)
+
+var metadataFields = []string{createdAtField, updatedAtField, revField}
+
+// errRevisionMismatch is returned by conditional writes to a document that
+// has changed or no longer exists.
+var errRevisionMismatch = errors.New("Document revision does not match")
+
+// metadataRev returns the revision a client names in the _rev field of a
+// document or update, 0 when it names none. Clients can't set the metadata
+// fields, so documents read back from the database can be written again as
+// they are: _createdAt and _updatedAt are ignored and _rev, like If-Match,
+// requires the document to still be at that revision.
+func metadataRev(doc map[interface{}]interface{}) (uint64, error) {
+	v, ok := doc[revField]
+	if !ok || v == nil {
+		return 0, nil
+	}
+	rev, ok := intValue(v)
+	if !ok || rev < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer", revField)
+	}
+	return uint64(rev), nil
+}
+
+// takeMetadata removes the metadata fields of a document a client sent and
+// returns the revision it named.
+func takeMetadata(doc map[interface{}]interface{}) (uint64, error) {
+	rev, err := metadataRev(doc)
+	if err != nil {
+		return 0, err
+	}
+	for _, field := range metadataFields {
+		delete(doc, field)
+	}
+	return rev, nil
+}
+
+func isMetadataField(field interface{}) bool {
+	for _, f := range metadataFields {
+		if field == f {
+			return true
+		}
+	}
+	return false
+}
+
+// touchDoc stamps doc for a write at now. Documents written before metadata
+// was kept get their creation time from their key and start counting
+// revisions from here.
+func touchDoc(doc map[interface{}]interface{}, lookupId []byte, now time.Time) {
+	if _, ok := doc[createdAtField]; !ok {
+		doc[createdAtField] = NewDate(IdTime(lookupId))
+	}
+	doc[updatedAtField] = NewDate(now)
+
+	rev, _ := intValue(doc[revField])
+	doc[revField] = uint64(rev + 1)
+}
+
+// docRev returns the revision of an encoded document, 0 for a missing
+// document or one written before revisions were kept.
+func docRev(encDoc []byte) (uint64, error) {
+	if encDoc == nil {
+		return 0, nil
+	}
+	doc, err := decodeJson(encDoc)
+	if err != nil {
+		return 0, err
+	}
+	rev, _ := intValue(doc[revField])
+	return uint64(rev), nil
+}
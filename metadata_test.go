@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func TestDocMetadata(t *testing.T) {
+	defer withTestDir(t)()
+	before := time.Now().Add(-time.Second)
+
+	encDoc, err := insertDoc("blog", "posts", strings.NewReader(`{"title": "a"}`))
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc.Bytes())
+	assert.Ok(t, err)
+	id := doc["_id"].(string)
+	assert.Equals(t, uint64(1), doc[revField])
+	created, ok := dateValue(doc[createdAtField])
+	assert.Cond(t, ok && created.After(before), "_createdAt should be the time of the UUID")
+	lookupId, err := ParseId(id)
+	assert.Ok(t, err)
+	assert.Equals(t, IdTime(lookupId), created)
+
+	_, err = updateDoc("blog", "posts", id, strings.NewReader(`{"title": "b"}`), 1, false)
+	assert.Ok(t, err)
+	encDocs, err := updateQuery("blog", "posts", strings.NewReader(`{"query": {"title": "b"}, "update": {"title": "c"}}`))
+	assert.Ok(t, err)
+	doc = decodeDocs(t, encDocs)[0]
+	assert.Equals(t, uint64(3), doc[revField])
+	assert.Equals(t, NewDate(created), doc[createdAtField])
+	updated, ok := dateValue(doc[updatedAtField])
+	assert.Cond(t, ok && !updated.Before(created), "_updatedAt should follow _createdAt")
+
+	// Replacing a document by id keeps counting its revisions.
+	encDoc, err = insertDoc("blog", "posts", strings.NewReader(`{"_id": "`+id+`", "title": "d"}`))
+	assert.Ok(t, err)
+	doc, err = decodeJson(encDoc.Bytes())
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(4), doc[revField])
+
+	encDocs, err = query("blog", "posts", strings.NewReader(`{"_rev": {"$gte": 4}}`))
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(decodeDocs(t, encDocs)))
+
+	// Metadata sent by clients is not stored, and _rev is a precondition.
+	_, err = updateDoc("blog", "posts", id, strings.NewReader(`{"_rev": 1, "title": "e"}`), 0, false)
+	assert.Equals(t, errRevisionMismatch, err)
+	encDoc, err = insertDoc("blog", "posts", strings.NewReader(`{"_createdAt": {"$date": 0}, "_updatedAt": {"$date": 0}}`))
+	assert.Ok(t, err)
+	doc, err = decodeJson(encDoc.Bytes())
+	assert.Ok(t, err)
+	created, _ = dateValue(doc[createdAtField])
+	assert.Cond(t, created.After(before), "clients should not set _createdAt")
+	assert.Equals(t, uint64(1), doc[revField])
+
+	// Documents read back can be written again as they are.
+	found, err := findDoc("blog", "posts", id)
+	assert.Ok(t, err)
+	_, err = insertDoc("blog", "posts", bytes.NewReader(found))
+	assert.Ok(t, err)
+	_, err = insertDoc("blog", "posts", bytes.NewReader(found))
+	assert.Equals(t, errRevisionMismatch, err)
+	result, err := bulk("copy", "", strings.NewReader(`[{"op": "insert", "collection": "posts", "doc": `+string(found)+`}]`))
+	assert.Ok(t, err)
+	assert.Cond(t, result.Committed, "a document read back should load into another database")
+}
+
+func TestCreatedAtFullScan(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "blog", "posts", `{"n": 1}`, `{"n": 2}`)
+
+	// Every key is in range, so the full scan is as cheap and must compare
+	// the string bound as a date.
+	since := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+	encDocs, err := query("blog", "posts", strings.NewReader(`{"_createdAt": {"$gte": "`+since+`"}}`))
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(decodeDocs(t, encDocs)))
+}
+
+func TestConditionalUpdate(t *testing.T) {
+	defer withTestDir(t)()
+	encDoc, err := insertDoc("blog", "posts", strings.NewReader(`{"title": "a"}`))
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc.Bytes())
+	assert.Ok(t, err)
+	id := doc["_id"].(string)
+
+	_, err = updateDoc("blog", "posts", id, strings.NewReader(`{"title": "b"}`), 1, false)
+	assert.Ok(t, err)
+	_, err = updateDoc("blog", "posts", id, strings.NewReader(`{"title": "c"}`), 1, false)
+	assert.Equals(t, errRevisionMismatch, err)
+
+	missing, _, err := NewId()
+	assert.Ok(t, err)
+	_, err = updateDoc("blog", "posts", missing, strings.NewReader(`{"title": "c"}`), 1, false)
+	assert.Equals(t, errRevisionMismatch, err)
+
+	assert.Cond(t, etagMatches(`"1", W/"2"`, revETag(2)), "weak etags should match")
+	assert.Cond(t, etagMatches(`*`, revETag(7)), "* should match any etag")
+	assert.Cond(t, !etagMatches(`"1"`, revETag(2)), "other revisions should not match")
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Numbers decode from JSON as uint64 when they are non-negative integers,
+// int64 when they are negative integers and float64 otherwise. Integers
+// outside of those ranges lose precision in the decoder, so values that
+// need arbitrary precision are written in extended JSON as
+// {"$numberDecimal": "12345678901234567890.5"}.
+//
+// All of these are one numeric type to the query engine: they compare and
+// group by their exact value, and arithmetic stays exact when it can. An
+// operation on a decimal yields a decimal, integers stay integers unless
+// they overflow, and anything involving a float64 yields a float64.
+const decimalKey = "$numberDecimal"
+
+// decimalDigits bounds the digits of decimal quotients that do not
+// terminate, matching the precision of IEEE 754 decimal128.
+const decimalDigits = 34
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case uint64, int64, float64:
+		return true
+	}
+	_, ok := decimalValue(v)
+	return ok
+}
+
+func decimalValue(v interface{}) (*big.Rat, bool) {
+	obj, ok := v.(map[interface{}]interface{})
+	if !ok || len(obj) != 1 {
+		return nil, false
+	}
+	s, ok := obj[decimalKey].(string)
+	if !ok {
+		return nil, false
+	}
+	return new(big.Rat).SetString(s)
+}
+
+func NewDecimal(r *big.Rat) map[interface{}]interface{} {
+	return map[interface{}]interface{}{decimalKey: formatDecimal(r)}
+}
+
+// formatDecimal writes r exactly when it has a terminating decimal
+// expansion, and rounded to decimalDigits places otherwise.
+func formatDecimal(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	// The expansion terminates after as many places as the larger power of
+	// 2 or 5 in the denominator, if those are its only factors.
+	denom := new(big.Int).Set(r.Denom())
+	places := 0
+	for _, factor := range []*big.Int{big.NewInt(2), big.NewInt(5)} {
+		n := 0
+		for new(big.Int).Rem(denom, factor).Sign() == 0 {
+			denom.Quo(denom, factor)
+			n++
+		}
+		if n > places {
+			places = n
+		}
+	}
+	if denom.Cmp(big.NewInt(1)) != 0 {
+		places = decimalDigits
+	}
+	s := r.FloatString(places)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// ratValue converts any number to its exact rational value. NaN and the
+// infinities have none.
+func ratValue(v interface{}) (*big.Rat, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return new(big.Rat).SetInt(new(big.Int).SetUint64(v)), true
+	case int64:
+		return new(big.Rat).SetInt64(v), true
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, false
+		}
+		return new(big.Rat).SetFloat64(v), true
+	}
+	return decimalValue(v)
+}
+
+// compareNumbers orders numbers by their exact value. NaN sorts before
+// every other number.
+func compareNumbers(a interface{}, b interface{}) int {
+	aFloat, aIsFloat := a.(float64)
+	bFloat, bIsFloat := b.(float64)
+	if aIsFloat && bIsFloat {
+		switch {
+		case aFloat < bFloat:
+			return -1
+		case aFloat > bFloat:
+			return 1
+		case aFloat == bFloat:
+			return 0
+		}
+	}
+	if aIsFloat && (math.IsNaN(aFloat) || math.IsInf(aFloat, 0)) ||
+		bIsFloat && (math.IsNaN(bFloat) || math.IsInf(bFloat, 0)) {
+		return compareSpecialFloats(a, b)
+	}
+
+	aInt, aIsInt := exactInt(a)
+	bInt, bIsInt := exactInt(b)
+	if aIsInt && bIsInt {
+		return aInt.Cmp(bInt)
+	}
+
+	aRat, _ := ratValue(a)
+	bRat, _ := ratValue(b)
+	return aRat.Cmp(bRat)
+}
+
+func compareSpecialFloats(a interface{}, b interface{}) int {
+	rank := func(v interface{}) int {
+		f, ok := v.(float64)
+		switch {
+		case ok && math.IsNaN(f):
+			return 0
+		case ok && math.IsInf(f, -1):
+			return 1
+		case ok && math.IsInf(f, 1):
+			return 3
+		}
+		return 2
+	}
+	return rank(a) - rank(b)
+}
+
+func exactInt(v interface{}) (*big.Int, bool) {
+	switch v := v.(type) {
+	case uint64:
+		return new(big.Int).SetUint64(v), true
+	case int64:
+		return big.NewInt(v), true
+	}
+	return nil, false
+}
+
+// numberKey is the same for numbers of equal value, whatever their type.
+func numberKey(v interface{}) string {
+	r, ok := ratValue(v)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	return r.RatString()
+}
+
+// intNumber returns i as the type the JSON decoder would produce, falling
+// back to a float64 when it does not fit.
+func intNumber(i *big.Int) interface{} {
+	if i.Sign() >= 0 && i.IsUint64() {
+		return i.Uint64()
+	}
+	if i.IsInt64() {
+		return i.Int64()
+	}
+	f, _ := new(big.Float).SetInt(i).Float64()
+	return f
+}
+
+// A numberOp is an arithmetic operation on each representation of a
+// number. The integer form reports whether its result is exact.
+type numberOp struct {
+	ints    func(a, b *big.Int) (*big.Int, bool)
+	rats    func(a, b *big.Rat) *big.Rat
+	floats  func(a, b float64) float64
+	divides bool
+}
+
+var (
+	errNotNumber    = errors.New("Arithmetic requires numbers")
+	errDivideByZero = errors.New("Division by zero")
+)
+
+var (
+	addOp = numberOp{
+		ints:   func(a, b *big.Int) (*big.Int, bool) { return new(big.Int).Add(a, b), true },
+		rats:   func(a, b *big.Rat) *big.Rat { return new(big.Rat).Add(a, b) },
+		floats: func(a, b float64) float64 { return a + b },
+	}
+	subtractOp = numberOp{
+		ints:   func(a, b *big.Int) (*big.Int, bool) { return new(big.Int).Sub(a, b), true },
+		rats:   func(a, b *big.Rat) *big.Rat { return new(big.Rat).Sub(a, b) },
+		floats: func(a, b float64) float64 { return a - b },
+	}
+	multiplyOp = numberOp{
+		ints:   func(a, b *big.Int) (*big.Int, bool) { return new(big.Int).Mul(a, b), true },
+		rats:   func(a, b *big.Rat) *big.Rat { return new(big.Rat).Mul(a, b) },
+		floats: func(a, b float64) float64 { return a * b },
+	}
+	// Integer division stays integral only when it is exact.
+	divideOp = numberOp{
+		ints: func(a, b *big.Int) (*big.Int, bool) {
+			q, m := new(big.Int).QuoRem(a, b, new(big.Int))
+			return q, m.Sign() == 0
+		},
+		rats:    func(a, b *big.Rat) *big.Rat { return new(big.Rat).Quo(a, b) },
+		floats:  func(a, b float64) float64 { return a / b },
+		divides: true,
+	}
+	modOp = numberOp{
+		ints: func(a, b *big.Int) (*big.Int, bool) { return new(big.Int).Rem(a, b), true },
+		rats: func(a, b *big.Rat) *big.Rat {
+			q := new(big.Int).Quo(new(big.Int).Mul(a.Num(), b.Denom()), new(big.Int).Mul(a.Denom(), b.Num()))
+			return new(big.Rat).Sub(a, new(big.Rat).Mul(b, new(big.Rat).SetInt(q)))
+		},
+		floats:  math.Mod,
+		divides: true,
+	}
+)
+
+// apply combines two numbers, keeping the result as exact as its operands.
+func (op numberOp) apply(a interface{}, b interface{}) (interface{}, error) {
+	if !isNumber(a) || !isNumber(b) {
+		return nil, errNotNumber
+	}
+	if op.divides && isZero(b) {
+		return nil, errDivideByZero
+	}
+
+	_, aDecimal := decimalValue(a)
+	_, bDecimal := decimalValue(b)
+	if aDecimal || bDecimal {
+		aRat, aOk := ratValue(a)
+		bRat, bOk := ratValue(b)
+		if !aOk || !bOk {
+			return nil, errNotNumber
+		}
+		return NewDecimal(op.rats(aRat, bRat)), nil
+	}
+
+	aInt, aIsInt := exactInt(a)
+	bInt, bIsInt := exactInt(b)
+	if aIsInt && bIsInt {
+		if result, exact := op.ints(aInt, bInt); exact {
+			return intNumber(result), nil
+		}
+	}
+
+	aFloat, _ := floatValue(a)
+	bFloat, _ := floatValue(b)
+	return op.floats(aFloat, bFloat), nil
+}
+
+func isZero(v interface{}) bool {
+	r, ok := ratValue(v)
+	return ok && r.Sign() == 0
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/hooklift/assert"
+)
+
+func decimal(s string) map[interface{}]interface{} {
+	return map[interface{}]interface{}{decimalKey: s}
+}
+
+func TestCompareNumbers(t *testing.T) {
+	assert.Equals(t, 0, compareNumbers(uint64(1), float64(1)))
+	assert.Equals(t, 0, compareNumbers(int64(-2), float64(-2)))
+	assert.Equals(t, -1, compareNumbers(int64(-1), uint64(0)))
+	assert.Equals(t, 1, compareNumbers(uint64(math.MaxUint64), int64(math.MaxInt64)))
+	assert.Equals(t, 1, compareNumbers(uint64(1<<53+1), float64(1<<53)))
+	assert.Equals(t, 0, compareNumbers(decimal("1.50"), float64(1.5)))
+	assert.Equals(t, -1, compareNumbers(decimal("18446744073709551615.5"), decimal("18446744073709551616")))
+	assert.Equals(t, -1, compareNumbers(math.NaN(), math.Inf(-1)))
+	assert.Equals(t, groupKey(uint64(3)), groupKey(decimal("3.0")))
+}
+
+func TestNumberArithmetic(t *testing.T) {
+	sum, err := addOp.apply(uint64(1), int64(-3))
+	assert.Ok(t, err)
+	assert.Equals(t, int64(-2), sum)
+
+	sum, err = addOp.apply(uint64(math.MaxUint64), uint64(1))
+	assert.Ok(t, err)
+	assert.Equals(t, float64(1<<64), sum)
+
+	quotient, err := divideOp.apply(uint64(7), uint64(2))
+	assert.Ok(t, err)
+	assert.Equals(t, 3.5, quotient)
+
+	quotient, err = divideOp.apply(decimal("1"), uint64(3))
+	assert.Ok(t, err)
+	assert.Equals(t, decimal("0.3333333333333333333333333333333333"), quotient)
+
+	product, err := multiplyOp.apply(decimal("0.1"), uint64(3))
+	assert.Ok(t, err)
+	assert.Equals(t, decimal("0.3"), product)
+
+	_, err = modOp.apply(uint64(1), float64(0))
+	assert.Cond(t, err != nil, "mod by zero should fail")
+}
+
+func TestQueryNegativeNumbers(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "bank", "accounts",
+		`{"name": "ann", "balance": -5}`,
+		`{"name": "bob", "balance": 2.0}`,
+		`{"name": "cat", "balance": {"$numberDecimal": "2.5"}}`,
+	)
+
+	for q, expected := range map[string]int{
+		`{"balance": -5}`:              1,
+		`{"balance": 2}`:               1,
+		`{"balance": {"$lt": 0}}`:      1,
+		`{"balance": {"$gt": 2}}`:      1,
+		`{"balance": {"$gte": -5.0}}`:  3,
+		`{"balance": [2.5, -5, 1000]}`: 2,
+	} {
+		encDocs, err := query("bank", "accounts", strings.NewReader(q))
+		assert.Ok(t, err)
+		assert.Equals(t, expected, len(decodeDocs(t, encDocs)))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/boltdb/bolt"
+)
+
+// Every document change is appended to the "_oplog" bucket of its database,
+// in the transaction that makes it, under a sequence number from
+// NextSequence. Values are the time of the change, as 8 bytes of Unix
+// nanoseconds, followed by the JSON entry
+//
+//	{"op": "update", "collection": "users", "_id": "...", "doc": {...}}
+//
+// where doc is the document after the change, or before it for a delete.
+// Entries older than oplogRetention are pruned as new ones are written,
+// except for the latest, which keeps the sequence readable after restarts.
+const oplogBucket = "_oplog"
+
+// Each database file also records an epoch in the "_epoch" bucket. Restoring
+// or recovering a database gives it a new epoch, since the sequence numbers
+// it hands out afterwards repeat ones it has handed out before; other
+// servers compare epochs to tell the two histories apart. Databases that
+// were never restored have no epoch.
+const epochBucket = "_epoch"
+
+var epochKey = []byte("epoch")
+
+// oplogPage is the number of entries read at once, and the default limit of
+// a range read.
+const oplogPage = 1000
+
+var oplogRetention = 7 * 24 * time.Hour
+
+var errResumeTooOld = errors.New("Sequence number is unknown or its changes were pruned from the oplog")
+
+func oplogKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// logChange appends change to the oplog of tx and sets its sequence number.
+func logChange(tx *bolt.Tx, change *Change) error {
+	oplog, err := tx.CreateBucketIfNotExists([]byte(oplogBucket))
+	if err != nil {
+		return err
+	}
+	if oplogRetention > 0 {
+		if err := pruneOplog(oplog, change.Time.Add(-oplogRetention)); err != nil {
+			return err
+		}
+	}
+	if change.Seq, err = oplog.NextSequence(); err != nil {
+		return err
+	}
+	encEntry, err := encodeDoc(map[interface{}]interface{}{
+		"op":         change.Op,
+		"collection": change.Collection,
+		"_id":        change.Id,
+		"doc":        change.doc,
+	})
+	if err != nil {
+		return err
+	}
+	value := make([]byte, 8, 8+encEntry.Len())
+	binary.BigEndian.PutUint64(value, uint64(change.Time.UnixNano()))
+	return oplog.Put(oplogKey(change.Seq), append(value, encEntry.Bytes()...))
+}
+
+// pruneOplog removes the entries written before cutoff, keeping the latest.
+func pruneOplog(oplog *bolt.Bucket, cutoff time.Time) error {
+	var expired [][]byte
+	c := oplog.Cursor()
+	last, _ := c.Last()
+	for k, v := c.First(); k != nil && !bytes.Equal(k, last); k, v = c.Next() {
+		if int64(binary.BigEndian.Uint64(v)) >= cutoff.UnixNano() {
+			break
+		}
+		expired = append(expired, append([]byte{}, k...))
+	}
+	for _, k := range expired {
+		if err := oplog.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeChange(key []byte, value []byte) (*Change, error) {
+	entry, err := decodeJson(value[8:])
+	if err != nil {
+		return nil, err
+	}
+	change := &Change{
+		Seq:  binary.BigEndian.Uint64(key),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(value))).UTC(),
+	}
+	change.Op, _ = entry["op"].(string)
+	change.Collection, _ = entry["collection"].(string)
+	change.Id, _ = entry["_id"].(string)
+	change.doc, _ = entry["doc"].(map[interface{}]interface{})
+	return change, nil
+}
+
+// oplogSeq returns the sequence number of the latest change in tx.
+func oplogSeq(tx *bolt.Tx) uint64 {
+	oplog := tx.Bucket([]byte(oplogBucket))
+	if oplog == nil {
+		return 0
+	}
+	if k, _ := oplog.Cursor().Last(); k != nil {
+		return binary.BigEndian.Uint64(k)
+	}
+	return 0
+}
+
+// readOplog returns up to limit changes after since, or all of them when
+// limit is 0. It fails with errResumeTooOld when changes after since were
+// pruned or since is past the latest change.
+func readOplog(tx *bolt.Tx, since uint64, limit int) ([]*Change, error) {
+	oplog := tx.Bucket([]byte(oplogBucket))
+	if oplog == nil {
+		if since > 0 {
+			return nil, errResumeTooOld
+		}
+		return nil, nil
+	}
+	c := oplog.Cursor()
+	first, _ := c.First()
+	if since > oplogSeq(tx) || (first != nil && since+1 < binary.BigEndian.Uint64(first)) {
+		return nil, errResumeTooOld
+	}
+
+	var changes []*Change
+	for k, v := c.Seek(oplogKey(since + 1)); k != nil; k, v = c.Next() {
+		if limit > 0 && len(changes) == limit {
+			break
+		}
+		change, err := decodeChange(k, v)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// dbEpoch returns the epoch of the database of tx.
+func dbEpoch(tx *bolt.Tx) string {
+	if bucket := tx.Bucket([]byte(epochBucket)); bucket != nil {
+		return string(bucket.Get(epochKey))
+	}
+	return ""
+}
+
+// renewEpoch gives the database file at path a new epoch.
+func renewEpoch(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(epochBucket))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(epochKey, []byte(uuid.NewRandom().String()))
+	})
+}
+
+// oplogRange returns the encoded oplog entries after since, at most limit of
+// them, the sequence number of the latest change and the database's epoch.
+func oplogRange(db string, since uint64, limit int) ([]byte, uint64, string, error) {
+	if limit <= 0 {
+		limit = oplogPage
+	}
+	var changes []*Change
+	var latest uint64
+	var epoch string
+	err := readDb(db, func(tx *bolt.Tx) error {
+		var err error
+		latest, epoch = oplogSeq(tx), dbEpoch(tx)
+		changes, err = readOplog(tx, since, limit)
+		return err
+	})
+	if err != nil {
+		return nil, 0, "", err
+	}
+	var result []byte
+	for _, change := range changes {
+		encChange, err := change.encode(true)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		result = append(result, encChange...)
+	}
+	return result, latest, epoch, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hooklift/assert"
+)
+
+func oplogChanges(t *testing.T, db string, since uint64) ([]*Change, error) {
+	var changes []*Change
+	err := readDb(db, func(tx *bolt.Tx) error {
+		var err error
+		changes, err = readOplog(tx, since, 0)
+		return err
+	})
+	return changes, err
+}
+
+func TestOplog(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "log", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+	_, err := updateQuery("log", "users", strings.NewReader(`{"query": {"name": "ada"}, "update": {"admin": true}}`))
+	assert.Ok(t, err)
+	_, err = bulk("log", "", strings.NewReader(`[{"op": "delete", "collection": "users", "query": {"name": "bob"}}]`))
+	assert.Ok(t, err)
+
+	changes, err := oplogChanges(t, "log", 0)
+	assert.Ok(t, err)
+	assert.Equals(t, 4, len(changes))
+	for i, op := range []string{ChangeInsert, ChangeInsert, ChangeUpdate, ChangeDelete} {
+		assert.Equals(t, uint64(i+1), changes[i].Seq)
+		assert.Equals(t, op, changes[i].Op)
+		assert.Equals(t, "users", changes[i].Collection)
+	}
+	assert.Equals(t, true, changes[2].doc["admin"])
+	assert.Equals(t, "bob", changes[3].doc["name"])
+
+	// Range reads page from a sequence number.
+	entries, latest, _, err := oplogRange("log", 2, 1)
+	assert.Ok(t, err)
+	entry, err := decodeJson(entries)
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(3), entry["seq"])
+	assert.Equals(t, ChangeUpdate, entry["op"])
+	assert.Equals(t, uint64(4), latest)
+
+	// Rolled back transactions use no sequence numbers.
+	result, err := bulk("log", "", strings.NewReader(`[
+		{"op": "insert", "collection": "users", "doc": {"name": "cy"}},
+		{"op": "update", "collection": "users", "id": "`+changes[3].Id+`", "update": {"a": 1}}
+	]`))
+	assert.Ok(t, err)
+	assert.Cond(t, !result.Committed, "the bulk transaction should roll back")
+
+	// Sequence numbers carry on after the database is reopened.
+	dbs["log"].Close()
+	delete(dbs, "log")
+	sub, err := newChangeSubscriber("log", "", nil)
+	assert.Ok(t, err)
+	backlog, err := hub.subscribe(sub, 3, true)
+	assert.Ok(t, err)
+	defer hub.unsubscribe(sub)
+	assert.Equals(t, 1, len(backlog))
+	insertTestDocs(t, "log", "users", `{"name": "dee"}`)
+	assert.Equals(t, uint64(5), nextChange(t, sub).Seq)
+
+	_, _, _, err = oplogRange("log", 6, 0)
+	assert.Equals(t, errResumeTooOld, err)
+	entries, _, _, err = oplogRange("log", 5, 0)
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(entries))
+}
+
+func TestOplogRetention(t *testing.T) {
+	defer withTestDir(t)()
+	defer func(retention time.Duration) { oplogRetention = retention }(oplogRetention)
+
+	insertTestDocs(t, "log", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+	oplogRetention = time.Nanosecond
+	insertTestDocs(t, "log", "users", `{"name": "cy"}`)
+
+	// Entries are pruned before a new one is written, except the latest.
+	changes, err := oplogChanges(t, "log", 1)
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(changes))
+	_, err = oplogChanges(t, "log", 0)
+	assert.Equals(t, errResumeTooOld, err)
+
+	time.Sleep(time.Millisecond)
+	insertTestDocs(t, "log", "users", `{"name": "dee"}`)
+	_, err = oplogChanges(t, "log", 1)
+	assert.Equals(t, errResumeTooOld, err)
+	changes, err = oplogChanges(t, "log", 2)
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(4), changes[1].Seq)
+	entries, _, _, err := oplogRange("log", 3, 0)
+	assert.Ok(t, err)
+	assert.Cond(t, bytes.Contains(entries, []byte(`"dee"`)), "the range should hold the latest insert")
+}
+
+func TestReservedCollections(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`)
+
+	_, err := insertDoc("app", oplogBucket, strings.NewReader(`{"name": "eve"}`))
+	assert.Equals(t, errReservedCollection, err)
+	_, err = query("app", idempotencyBucket, strings.NewReader(`{}`))
+	assert.Equals(t, errReservedCollection, err)
+	_, err = aggregate("app", "users", strings.NewReader(`{"pipeline": [{"$lookup": {"from": "_webhooks", "localField": "a", "foreignField": "b", "as": "c"}}]}`))
+	assert.Equals(t, errReservedCollection, err)
+	_, err = mapReduce("app", "users", strings.NewReader(`{"map": {"key": "$name", "value": 1}, "reduce": {"$sum": "$$values"}, "out": "_cluster"}`))
+	assert.Equals(t, errReservedCollection, err)
+	result, err := bulk("app", "", strings.NewReader(`[{"op": "insert", "collection": "_oplog", "doc": {"a": 1}}]`))
+	assert.Ok(t, err)
+	assert.Cond(t, !result.Committed, "a bulk write to the oplog should roll back")
+
+	changes, err := oplogChanges(t, "app", 0)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(changes))
+	names, err := listCollections("app")
+	assert.Ok(t, err)
+	assert.Equals(t, []string{"users"}, names)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/boltdb/bolt"
+)
+
+// Query plan types. Collections have no secondary indexes, so a query is
+// answered by a single key lookup, a scan of the keys created in a time
+// range, or a full scan.
+const (
+	IdLookupPlan  = "idLookup"
+	TimeRangePlan = "timeRange"
+	FullScanPlan  = "fullScan"
+)
+
+type QueryPlan struct {
+	Type string
+	Cost float64
+
+	lookupId []byte
+	start    []byte // first key to scan, nil for the first key in the bucket
+	end      []byte // key to stop before, nil for the end of the bucket
+	filter   map[interface{}]interface{}
+	coll     *Collation
+}
+
+type QueryStats struct {
+	Plan         *QueryPlan
+	Candidates   []*QueryPlan
+	KeysExamined uint64
+	DocsExamined uint64
+	Returned     uint64
+}
+
+// planSampleKeys is the number of keys read to estimate the size of a
+// collection.
+const planSampleKeys = 1000
+
+// planQuery picks the cheapest way to find the documents matching query.
+// Conditions a plan answers from the keys are removed from its filter.
+func planQuery(bucket *bolt.Bucket, query map[interface{}]interface{}, coll *Collation) ([]*QueryPlan, error) {
+	// An id names at most one document, so no other plan is costed.
+	if id, ok := query["_id"].(string); ok {
+		lookupId, err := ParseId(id)
+		if err != nil {
+			return nil, err
+		}
+		return []*QueryPlan{{
+			Type:     IdLookupPlan,
+			Cost:     1,
+			lookupId: lookupId,
+			filter:   withoutField(query, "_id"),
+			coll:     coll,
+		}}, nil
+	}
+
+	var candidates []*QueryPlan
+	keyCount := estimateKeys(bucket)
+	candidates = append(candidates, &QueryPlan{Type: FullScanPlan, Cost: keyCount, filter: createdAtDates(query)})
+
+	// The creation time also starts every document key, so ranges on it can
+	// be answered from the keys alone.
+	if start, end, ok := createdAtRange(query[createdAtField]); ok {
+		candidates = append(candidates, &QueryPlan{
+			Type:   TimeRangePlan,
+			Cost:   1 + keyCount*timeRangeFraction(bucket, start, end),
+			start:  start,
+			end:    end,
+			filter: withoutField(query, createdAtField),
+		})
+	}
+
+	best := 0
+	for i, plan := range candidates {
+		plan.coll = coll
+		if plan.Cost < candidates[best].Cost {
+			best = i
+		}
+	}
+	candidates[0], candidates[best] = candidates[best], candidates[0]
+	return candidates, nil
+}
+
+func withoutField(query map[interface{}]interface{}, field string) map[interface{}]interface{} {
+	filter := make(map[interface{}]interface{}, len(query))
+	for k, v := range query {
+		if k != field {
+			filter[k] = v
+		}
+	}
+	return filter
+}
+
+// createdAtDates converts creation time bounds given as RFC 3339 strings
+// to dates, so that a scan compares them with the stored times.
+func createdAtDates(query map[interface{}]interface{}) map[interface{}]interface{} {
+	ops, ok := queryOperators(query[createdAtField])
+	if !ok {
+		return query
+	}
+	dates := make(map[interface{}]interface{}, len(ops))
+	for op, v := range ops {
+		if t, ok := queryTime(v); ok {
+			v = NewDate(t)
+		}
+		dates[op] = v
+	}
+	filter := withoutField(query, createdAtField)
+	filter[createdAtField] = dates
+	return filter
+}
+
+// createdAtRange converts range operators on the creation time into key
+// bounds. UUID times have a precision of 100ns, so bounds are rounded to
+// keep the range exact.
+func createdAtRange(queryV interface{}) ([]byte, []byte, bool) {
+	ops, ok := queryOperators(queryV)
+	if !ok {
+		return nil, nil, false
+	}
+
+	var start, end uuid.Time
+	hasStart, hasEnd := false, false
+	for op, v := range ops {
+		t, ok := queryTime(v)
+		if !ok {
+			return nil, nil, false
+		}
+		floor := TimeToUUIDTime(t)
+		if t.Before(UUIDTimeToTime(0)) {
+			floor = -1
+		}
+		ceil := floor
+		if t.Sub(UUIDTimeToTime(floor)) > 0 {
+			ceil++
+		}
+
+		switch op {
+		case "$gt":
+			start, hasStart = maxTime(start, floor+1, hasStart), true
+		case "$gte":
+			start, hasStart = maxTime(start, ceil, hasStart), true
+		case "$lt":
+			end, hasEnd = minTime(end, ceil, hasEnd), true
+		case "$lte":
+			end, hasEnd = minTime(end, floor+1, hasEnd), true
+		default:
+			return nil, nil, false
+		}
+	}
+
+	// Bounds before the first UUID time keep the range empty or whole.
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	var startKey, endKey []byte
+	if hasStart {
+		startKey = TimeKey(start)
+	}
+	if hasEnd {
+		endKey = TimeKey(end)
+	}
+	return startKey, endKey, true
+}
+
+func maxTime(a uuid.Time, b uuid.Time, set bool) uuid.Time {
+	if set && a > b {
+		return a
+	}
+	return b
+}
+
+func minTime(a uuid.Time, b uuid.Time, set bool) uuid.Time {
+	if set && a < b {
+		return a
+	}
+	return b
+}
+
+// queryTime reads a time given as a date or an RFC 3339 string.
+func queryTime(v interface{}) (time.Time, bool) {
+	if t, ok := dateValue(v); ok {
+		return t, true
+	}
+	s, ok := v.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+// keyTime returns the UUID time a key starts with, which counts from 1582 in
+// steps of 100ns.
+func keyTime(k []byte) float64 {
+	return float64(binary.BigEndian.Uint64(k))
+}
+
+// estimateKeys estimates the number of keys in a bucket from its first
+// planSampleKeys keys, assuming documents were created evenly between the
+// first and last key.
+func estimateKeys(bucket *bolt.Bucket) float64 {
+	if bucket == nil {
+		return 0
+	}
+	c := bucket.Cursor()
+	first, _ := c.First()
+	if first == nil {
+		return 0
+	}
+	n, k := 1, first
+	for ; n < planSampleKeys; n++ {
+		next, _ := c.Next()
+		if next == nil {
+			return float64(n)
+		}
+		k = next
+	}
+	sampled := keyTime(k) - keyTime(first)
+	last, _ := c.Last()
+	if sampled <= 0 {
+		return float64(n)
+	}
+	return float64(n) * (keyTime(last) - keyTime(first)) / sampled
+}
+
+// timeRangeFraction estimates the share of keys in a range, assuming
+// documents were created evenly between the first and last key.
+func timeRangeFraction(bucket *bolt.Bucket, start []byte, end []byte) float64 {
+	if bucket == nil {
+		return 0
+	}
+	c := bucket.Cursor()
+	firstKey, _ := c.First()
+	lastKey, _ := c.Last()
+	if firstKey == nil {
+		return 0
+	}
+
+	first := keyTime(firstKey)
+	last := keyTime(lastKey)
+	from, to := first, last
+	if start != nil {
+		from = keyTime(start)
+	}
+	if end != nil {
+		to = keyTime(end)
+	}
+	if from < first {
+		from = first
+	}
+	if to > last {
+		to = last
+	}
+	if last == first {
+		if from <= first && to >= last {
+			return 1
+		}
+		return 0
+	}
+	if to < from {
+		return 0
+	}
+	return (to - from) / (last - first)
+}
+
+// execute calls handler with every document the plan finds that matches its
+// filter, until handler returns false or an error.
+func (plan *QueryPlan) execute(bucket *bolt.Bucket, stats *QueryStats, handler func([]byte, []byte, map[interface{}]interface{}) (bool, error)) error {
+	if bucket == nil {
+		return nil
+	}
+
+	visit := func(k []byte, v []byte) (bool, error) {
+		stats.KeysExamined++
+		stats.DocsExamined++
+		doc, err := decodeJson(v)
+		if err != nil {
+			return false, err
+		}
+		match, err := queryMatch(withCreatedAt(doc, k), plan.filter, plan.coll)
+		if err != nil || !match {
+			return err == nil, err
+		}
+		stats.Returned++
+		return handler(k, v, doc)
+	}
+
+	if plan.Type == IdLookupPlan {
+		v := bucket.Get(plan.lookupId)
+		if v == nil {
+			return nil
+		}
+		_, err := visit(plan.lookupId, v)
+		return err
+	}
+
+	c := bucket.Cursor()
+	k, v := c.First()
+	if plan.start != nil {
+		k, v = c.Seek(plan.start)
+	}
+	for ; k != nil; k, v = c.Next() {
+		if plan.end != nil && bytes.Compare(k, plan.end) >= 0 {
+			break
+		}
+		more, err := visit(k, v)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// withCreatedAt gives a document written before metadata was kept the
+// creation time in its key, which is what the time range plan answers
+// from, so that every plan finds the same documents.
+func withCreatedAt(doc map[interface{}]interface{}, k []byte) map[interface{}]interface{} {
+	if _, ok := doc[createdAtField]; ok {
+		return doc
+	}
+	dated := make(map[interface{}]interface{}, len(doc)+1)
+	for field, v := range doc {
+		dated[field] = v
+	}
+	dated[createdAtField] = NewDate(IdTime(k))
+	return dated
+}
+
+func (plan *QueryPlan) describe() map[interface{}]interface{} {
+	desc := map[interface{}]interface{}{"type": plan.Type, "cost": plan.Cost}
+	if plan.start != nil {
+		desc["start"] = IdTime(plan.start).Format(time.RFC3339Nano)
+	}
+	if plan.end != nil {
+		desc["end"] = IdTime(plan.end).Format(time.RFC3339Nano)
+	}
+	return desc
+}
+
+func explain(db string, collection string, queryReader io.Reader) ([]byte, error) {
+	queryMap, err := decodeJson(queryReader)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats *QueryStats
+	started := time.Now()
+	err = readCollection(db, collection, func(bucket *bolt.Bucket) error {
+		stats, err = runQuery(bucket, queryMap, func(*bolt.Bucket, []byte, []byte, map[interface{}]interface{}) error {
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(started)
+
+	var candidates []interface{}
+	for _, plan := range stats.Candidates {
+		candidates = append(candidates, plan.describe())
+	}
+	encDoc, err := encodeDoc(map[interface{}]interface{}{
+		"plan":         stats.Plan.describe(),
+		"candidates":   candidates,
+		"keysExamined": stats.KeysExamined,
+		"docsExamined": stats.DocsExamined,
+		"returned":     stats.Returned,
+		"elapsed":      fmt.Sprint(elapsed),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encDoc.Bytes(), nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/boltdb/bolt"
+	"github.com/hooklift/assert"
+)
+
+func explainQuery(t *testing.T, db string, collection string, query string) map[interface{}]interface{} {
+	report, err := explain(db, collection, strings.NewReader(query))
+	assert.Ok(t, err)
+	doc, err := decodeJson(report)
+	assert.Ok(t, err)
+	return doc
+}
+
+func TestPlannerTimeRange(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "blog", "posts", `{"n": 1}`, `{"n": 2}`, `{"n": 3}`)
+	time.Sleep(time.Millisecond)
+	since := time.Now().Format(time.RFC3339Nano)
+	time.Sleep(time.Millisecond)
+	insertTestDocs(t, "blog", "posts", `{"n": 4}`, `{"n": 5}`)
+
+	report := explainQuery(t, "blog", "posts", `{"_createdAt": {"$gte": "`+since+`"}, "n": {"$gt": 4}}`)
+	assert.Equals(t, TimeRangePlan, report["plan"].(map[interface{}]interface{})["type"])
+	assert.Equals(t, uint64(2), report["keysExamined"])
+	assert.Equals(t, uint64(1), report["returned"])
+
+	report = explainQuery(t, "blog", "posts", `{"n": {"$in": [1, 2]}}`)
+	assert.Equals(t, FullScanPlan, report["plan"].(map[interface{}]interface{})["type"])
+	assert.Equals(t, uint64(5), report["keysExamined"])
+	assert.Equals(t, uint64(2), report["returned"])
+}
+
+func TestPlannerIdLookup(t *testing.T) {
+	defer withTestDir(t)()
+	encDoc, err := insertDoc("blog", "posts", strings.NewReader(`{"n": 1}`))
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc.Bytes())
+	assert.Ok(t, err)
+	insertTestDocs(t, "blog", "posts", `{"n": 2}`, `{"n": 3}`)
+
+	id := doc["_id"].(string)
+	report := explainQuery(t, "blog", "posts", `{"_id": "`+id+`"}`)
+	assert.Equals(t, IdLookupPlan, report["plan"].(map[interface{}]interface{})["type"])
+	assert.Equals(t, uint64(1), report["keysExamined"])
+	assert.Equals(t, 1, len(report["candidates"].([]interface{})))
+
+	docs, err := query("blog", "posts", strings.NewReader(`{"_id": "`+id+`", "n": 2}`))
+	assert.Ok(t, err)
+	assert.Equals(t, 0, len(docs))
+
+	var count int
+	err = iterateQuery("blog", "posts", map[interface{}]interface{}{"limit": uint64(2)}, readCollection, func(*bolt.Bucket, []byte, []byte, map[interface{}]interface{}) error {
+		count++
+		return nil
+	})
+	assert.Ok(t, err)
+	assert.Equals(t, 2, count)
+}
+
+func TestPlannersAgree(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "blog", "posts", `{"n": 1}`)
+	time.Sleep(time.Millisecond)
+	since := time.Now().Format(time.RFC3339Nano)
+	time.Sleep(time.Millisecond)
+	insertTestDocs(t, "blog", "posts", `{"n": 2}`)
+
+	// A document written before metadata was kept has no _createdAt field.
+	_, lookupId, err := NewId()
+	assert.Ok(t, err)
+	err = updateDb("blog", func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("posts")).Put(lookupId, []byte(`{"n": 3}`))
+	})
+	assert.Ok(t, err)
+
+	query := map[interface{}]interface{}{createdAtField: map[interface{}]interface{}{"$gte": since}}
+	err = readDb("blog", func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("posts"))
+		candidates, err := planQuery(bucket, query, nil)
+		assert.Ok(t, err)
+		assert.Equals(t, 2, len(candidates))
+		for _, plan := range candidates {
+			var found []interface{}
+			err := plan.execute(bucket, &QueryStats{}, func(k []byte, v []byte, doc map[interface{}]interface{}) (bool, error) {
+				found = append(found, doc["n"])
+				return true, nil
+			})
+			assert.Ok(t, err)
+			assert.Equals(t, []interface{}{uint64(2), uint64(3)}, found)
+		}
+		return nil
+	})
+	assert.Ok(t, err)
+}
+
+func TestPlannersAgreeAtExtremes(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "blog", "posts", `{"n": 1}`, `{"n": 2}`)
+
+	for q, expected := range map[string]int{
+		`{"$gte": "1500-01-01T00:00:00Z"}`:                                2,
+		`{"$lt": "2300-01-01T00:00:00Z"}`:                                 2,
+		`{"$gt": "1500-01-01T00:00:00Z", "$lte": "9999-12-31T00:00:00Z"}`: 2,
+		`{"$lte": "1500-01-01T00:00:00Z"}`:                                0,
+		`{"$gte": "9999-12-31T00:00:00Z"}`:                                0,
+	} {
+		ops, err := decodeJson(strings.NewReader(q))
+		assert.Ok(t, err)
+		query := map[interface{}]interface{}{createdAtField: ops}
+		err = readDb("blog", func(tx *bolt.Tx) error {
+			bucket := tx.Bucket([]byte("posts"))
+			candidates, err := planQuery(bucket, query, nil)
+			assert.Ok(t, err)
+			assert.Equals(t, 2, len(candidates))
+			for _, plan := range candidates {
+				found := 0
+				err := plan.execute(bucket, &QueryStats{}, func(k []byte, v []byte, doc map[interface{}]interface{}) (bool, error) {
+					found++
+					return true, nil
+				})
+				assert.Ok(t, err)
+				assert.Equals(t, expected, found)
+			}
+			return nil
+		})
+		assert.Ok(t, err)
+	}
+}
+
+func TestEstimateKeys(t *testing.T) {
+	defer withTestDir(t)()
+	err := updateDb("blog", func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("posts"))
+		if err != nil {
+			return err
+		}
+		assert.Equals(t, float64(0), estimateKeys(bucket))
+		for i := 0; i < 3*planSampleKeys; i++ {
+			// Documents created evenly, one every microsecond.
+			k := append(TimeKey(uuid.Time(uuidEpoch+i*10)), make([]byte, 8)...)
+			if err := bucket.Put(k, []byte(`{}`)); err != nil {
+				return err
+			}
+			if i == 9 {
+				assert.Equals(t, float64(10), estimateKeys(bucket))
+			}
+		}
+		estimate := estimateKeys(bucket)
+		assert.Cond(t, estimate > 2.9*planSampleKeys && estimate < 3.1*planSampleKeys, "the estimate should extrapolate the sample")
+		return nil
+	})
+	assert.Ok(t, err)
+}
+
+func TestUnknownQueryOperators(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "blog", "posts", `{"n": 1}`)
+
+	for _, q := range []string{
+		`{"n": {"$regex": "a"}}`,
+		`{"n": {"$gte ": 1}}`,
+		`{"n": {"$in": 1}}`,
+		`{"$or": [{"n": 1}]}`,
+	} {
+		_, err := query("blog", "posts", strings.NewReader(q))
+		assert.Cond(t, err != nil, q+" should be rejected")
+		_, err = explain("blog", "posts", strings.NewReader(q))
+		assert.Cond(t, err != nil, q+" should be rejected by explain")
+	}
+	assert.Equals(t, 1, countDocs(t, "blog", "posts", `{"n": {"$gte": 1, "$exists": true}}`))
+}
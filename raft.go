@@ -0,0 +1,930 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ugorji/go/codec"
+)
+
+// RaftNode is a member of a Raft cluster: it elects a leader with its
+// peers, replicates the leader's log and applies committed entries in log
+// order. Membership changes are log entries too, made one server at a time
+// and in effect as soon as they are appended. Once enough entries are
+// applied the log is compacted; a peer that needs compacted entries is sent
+// a snapshot instead, which it installs from the leader.
+//
+// The term, vote and log are kept in a bolt file of their own. What the
+// entries do, how messages travel and how snapshots are copied is up to
+// the apply, transport and install functions. An installed snapshot may be
+// newer than the index it was sent for, and entries are applied again after
+// a restart, so apply must skip the entries the state already has.
+type RaftNode struct {
+	id        string
+	store     *bolt.DB
+	transport RaftTransport
+	apply     func(index uint64, entry *RaftEntry) error
+	install   func(leader string) error
+
+	heartbeat       time.Duration
+	electionTimeout time.Duration
+	snapshotEntries uint64
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+	// applyMutex keeps snapshot installs and entry applies apart.
+	applyMutex sync.Mutex
+
+	state    string
+	term     uint64
+	votedFor string
+	leader   string
+
+	// members maps ids to URLs, as of the latest configuration entry, which
+	// is at configIndex.
+	members     map[string]string
+	configIndex uint64
+
+	// entries follow the snapshot, which stands for the first
+	// snapshotIndex entries.
+	entries         []*RaftEntry
+	snapshotIndex   uint64
+	snapshotTerm    uint64
+	snapshotMembers map[string]string
+
+	commitIndex uint64
+	lastApplied uint64
+
+	// Leader state: progress of each peer, and the index of the entry
+	// that must be applied before the leader takes proposals.
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	lastAck     map[string]time.Time
+	replicating map[string]bool
+	readyIndex  uint64
+
+	electionDue time.Time
+	installing  bool
+	stopped     bool
+}
+
+const (
+	RaftFollower  = "follower"
+	RaftCandidate = "candidate"
+	RaftLeader    = "leader"
+)
+
+// Entry types. Types other than noop and config are left to apply.
+const (
+	RaftNoop   = "noop"
+	RaftConfig = "config"
+)
+
+type RaftEntry struct {
+	Term    uint64                        `codec:"term"`
+	Type    string                        `codec:"type"`
+	Db      string                        `codec:"db,omitempty"`
+	Source  string                        `codec:"source,omitempty"`
+	Changes []map[interface{}]interface{} `codec:"changes,omitempty"`
+	State   []*StateWrite                 `codec:"state,omitempty"`
+	Members map[string]string             `codec:"members,omitempty"`
+	Webhook map[interface{}]interface{}   `codec:"webhook,omitempty"`
+}
+
+type VoteRequest struct {
+	Term      uint64 `codec:"term"`
+	Candidate string `codec:"candidate"`
+	LastIndex uint64 `codec:"lastIndex"`
+	LastTerm  uint64 `codec:"lastTerm"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `codec:"term"`
+	Granted bool   `codec:"granted"`
+}
+
+type AppendRequest struct {
+	Term      uint64       `codec:"term"`
+	Leader    string       `codec:"leader"`
+	PrevIndex uint64       `codec:"prevIndex"`
+	PrevTerm  uint64       `codec:"prevTerm"`
+	Entries   []*RaftEntry `codec:"entries"`
+	Commit    uint64       `codec:"commit"`
+}
+
+// An AppendResponse holds, on failure, the index the leader should try
+// next.
+type AppendResponse struct {
+	Term     uint64 `codec:"term"`
+	Success  bool   `codec:"success"`
+	Match    uint64 `codec:"match"`
+	Conflict uint64 `codec:"conflict"`
+}
+
+type SnapshotRequest struct {
+	Term    uint64            `codec:"term"`
+	Leader  string            `codec:"leader"`
+	Index   uint64            `codec:"index"`
+	LogTerm uint64            `codec:"logTerm"`
+	Members map[string]string `codec:"members"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `codec:"term"`
+}
+
+// A RaftTransport sends messages to the peer at a URL.
+type RaftTransport interface {
+	Vote(url string, req *VoteRequest) (*VoteResponse, error)
+	Append(url string, req *AppendRequest) (*AppendResponse, error)
+	Snapshot(url string, req *SnapshotRequest) (*SnapshotResponse, error)
+}
+
+var (
+	errNotLeader          = errors.New("Not the cluster leader")
+	errLeaderNotReady     = errors.New("Cluster leader is still applying earlier entries")
+	errMembershipChanging = errors.New("A membership change is already in progress")
+	errRaftStopped        = errors.New("Cluster node is stopped")
+)
+
+var (
+	raftMetaBucket = []byte("meta")
+	raftLogBucket  = []byte("log")
+)
+
+// raftAppendLimit is the most entries sent to a peer in one message.
+const raftAppendLimit = 64
+
+// NewRaftNode opens the state of a node kept at path. A node without any
+// state starts with peers as its members; a node joining an existing
+// cluster starts with none and waits for the leader to contact it.
+func NewRaftNode(id string, path string, peers map[string]string, transport RaftTransport,
+	apply func(uint64, *RaftEntry) error, install func(string) error) (*RaftNode, error) {
+	store, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	r := &RaftNode{
+		id:              id,
+		store:           store,
+		transport:       transport,
+		apply:           apply,
+		install:         install,
+		heartbeat:       100 * time.Millisecond,
+		electionTimeout: 500 * time.Millisecond,
+		snapshotEntries: 1000,
+		state:           RaftFollower,
+		nextIndex:       map[string]uint64{},
+		matchIndex:      map[string]uint64{},
+		lastAck:         map[string]time.Time{},
+		replicating:     map[string]bool{},
+	}
+	r.cond = sync.NewCond(&r.mutex)
+	if err := r.load(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if r.snapshotMembers == nil && len(r.entries) == 0 && len(peers) > 0 {
+		r.snapshotMembers = peers
+		if err := r.saveSnapshot(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	r.updateMembers()
+	r.commitIndex, r.lastApplied = r.snapshotIndex, r.snapshotIndex
+	return r, nil
+}
+
+func (r *RaftNode) start() {
+	r.mutex.Lock()
+	r.resetElection()
+	r.mutex.Unlock()
+	go r.tick()
+	go r.applyCommitted()
+}
+
+func (r *RaftNode) stop() {
+	r.mutex.Lock()
+	r.stopped = true
+	r.state = RaftFollower
+	r.cond.Broadcast()
+	r.mutex.Unlock()
+	r.applyMutex.Lock()
+	r.store.Close()
+	r.applyMutex.Unlock()
+}
+
+func (r *RaftNode) load() error {
+	return r.store.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(raftMetaBucket)
+		if err != nil {
+			return err
+		}
+		logBucket, err := tx.CreateBucketIfNotExists(raftLogBucket)
+		if err != nil {
+			return err
+		}
+		r.term = uint64Value(meta.Get([]byte("term")))
+		r.votedFor = string(meta.Get([]byte("votedFor")))
+		r.snapshotIndex = uint64Value(meta.Get([]byte("snapshotIndex")))
+		r.snapshotTerm = uint64Value(meta.Get([]byte("snapshotTerm")))
+		if members := meta.Get([]byte("snapshotMembers")); members != nil {
+			if err := codec.NewDecoderBytes(append([]byte{}, members...), jh).Decode(&r.snapshotMembers); err != nil {
+				return err
+			}
+		}
+		return logBucket.ForEach(func(k []byte, v []byte) error {
+			var entry RaftEntry
+			if err := codec.NewDecoderBytes(append([]byte{}, v...), jh).Decode(&entry); err != nil {
+				return err
+			}
+			r.entries = append(r.entries, &entry)
+			return nil
+		})
+	})
+}
+
+func uint64Value(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// saveState persists the term and vote. Like the other writes to the
+// store, it runs with r.mutex held.
+func (r *RaftNode) saveState() error {
+	return r.store.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(raftMetaBucket)
+		if err := meta.Put([]byte("term"), oplogKey(r.term)); err != nil {
+			return err
+		}
+		return meta.Put([]byte("votedFor"), []byte(r.votedFor))
+	})
+}
+
+func (r *RaftNode) saveSnapshot() error {
+	var members []byte
+	if err := codec.NewEncoderBytes(&members, jh).Encode(r.snapshotMembers); err != nil {
+		return err
+	}
+	return r.store.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(raftMetaBucket)
+		if err := meta.Put([]byte("snapshotIndex"), oplogKey(r.snapshotIndex)); err != nil {
+			return err
+		}
+		if err := meta.Put([]byte("snapshotTerm"), oplogKey(r.snapshotTerm)); err != nil {
+			return err
+		}
+		if err := meta.Put([]byte("snapshotMembers"), members); err != nil {
+			return err
+		}
+		// Drop the entries the snapshot stands for.
+		c := tx.Bucket(raftLogBucket).Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= r.snapshotIndex; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// appendEntries adds entries to the end of the log.
+func (r *RaftNode) appendEntries(entries []*RaftEntry) error {
+	index := r.lastIndex()
+	err := r.store.Update(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket(raftLogBucket)
+		for i, entry := range entries {
+			var encEntry []byte
+			if err := codec.NewEncoderBytes(&encEntry, jh).Encode(entry); err != nil {
+				return err
+			}
+			if err := logBucket.Put(oplogKey(index+uint64(i)+1), encEntry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.entries = append(r.entries, entries...)
+	r.updateMembers()
+	return nil
+}
+
+// truncate removes the entries from index on.
+func (r *RaftNode) truncate(index uint64) error {
+	err := r.store.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(raftLogBucket).Cursor()
+		for k, _ := c.Seek(oplogKey(index)); k != nil; k, _ = c.Seek(oplogKey(index)) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.entries = r.entries[:index-r.snapshotIndex-1]
+	r.updateMembers()
+	return nil
+}
+
+func (r *RaftNode) lastIndex() uint64 {
+	return r.snapshotIndex + uint64(len(r.entries))
+}
+
+func (r *RaftNode) entry(index uint64) *RaftEntry {
+	if index <= r.snapshotIndex || index > r.lastIndex() {
+		return nil
+	}
+	return r.entries[index-r.snapshotIndex-1]
+}
+
+// logTerm returns the term of the entry at index, or 0 if it is not in the
+// log.
+func (r *RaftNode) logTerm(index uint64) uint64 {
+	if index == r.snapshotIndex {
+		return r.snapshotTerm
+	}
+	if entry := r.entry(index); entry != nil {
+		return entry.Term
+	}
+	return 0
+}
+
+// updateMembers takes the membership from the latest configuration entry.
+func (r *RaftNode) updateMembers() {
+	r.members, r.configIndex = r.snapshotMembers, r.snapshotIndex
+	for i := len(r.entries) - 1; i >= 0; i-- {
+		if r.entries[i].Type == RaftConfig {
+			r.members, r.configIndex = r.entries[i].Members, r.snapshotIndex+uint64(i)+1
+			break
+		}
+	}
+	if r.members == nil {
+		r.members = map[string]string{}
+	}
+}
+
+// membersAt returns the membership in effect at index.
+func (r *RaftNode) membersAt(index uint64) map[string]string {
+	for i := index; i > r.snapshotIndex; i-- {
+		if entry := r.entry(i); entry.Type == RaftConfig {
+			return entry.Members
+		}
+	}
+	return r.snapshotMembers
+}
+
+func (r *RaftNode) isMember() bool {
+	_, ok := r.members[r.id]
+	return ok
+}
+
+func (r *RaftNode) quorum(n int) bool {
+	return n*2 > len(r.members)
+}
+
+func (r *RaftNode) resetElection() {
+	timeout := r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout)))
+	r.electionDue = time.Now().Add(timeout)
+}
+
+func (r *RaftNode) setTerm(term uint64) {
+	if term > r.term {
+		r.term, r.votedFor = term, ""
+		if err := r.saveState(); err != nil {
+			log.Printf("Error saving cluster state: %s", err)
+		}
+	}
+}
+
+func (r *RaftNode) becomeFollower(term uint64) {
+	r.setTerm(term)
+	if r.state != RaftFollower {
+		r.state = RaftFollower
+		r.cond.Broadcast()
+	}
+}
+
+// tick starts elections when the leader goes quiet and, on the leader,
+// sends heartbeats and steps down when a majority stops answering.
+func (r *RaftNode) tick() {
+	lastHeartbeat := time.Time{}
+	for {
+		time.Sleep(r.heartbeat / 4)
+		r.mutex.Lock()
+		if r.stopped {
+			r.mutex.Unlock()
+			return
+		}
+		now := time.Now()
+		if r.state == RaftLeader {
+			if now.Sub(lastHeartbeat) >= r.heartbeat {
+				lastHeartbeat = now
+				r.replicateAll()
+			}
+			acked := 0
+			for id := range r.members {
+				if id == r.id || now.Sub(r.lastAck[id]) < 2*r.electionTimeout {
+					acked++
+				}
+			}
+			if !r.quorum(acked) {
+				log.Printf("Cluster leader %s lost contact with a majority, stepping down", r.id)
+				r.becomeFollower(r.term)
+				r.resetElection()
+			}
+		} else if r.isMember() && !r.installing && now.After(r.electionDue) {
+			r.startElection()
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func (r *RaftNode) startElection() {
+	r.state = RaftCandidate
+	r.term++
+	r.votedFor = r.id
+	r.leader = ""
+	if err := r.saveState(); err != nil {
+		log.Printf("Error saving cluster state: %s", err)
+		return
+	}
+	r.resetElection()
+
+	votes := 1
+	if r.quorum(votes) {
+		r.becomeLeader()
+		return
+	}
+	req := &VoteRequest{Term: r.term, Candidate: r.id, LastIndex: r.lastIndex(), LastTerm: r.logTerm(r.lastIndex())}
+	for id, url := range r.members {
+		if id == r.id {
+			continue
+		}
+		go func(url string) {
+			resp, err := r.transport.Vote(url, req)
+			if err != nil {
+				return
+			}
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if resp.Term > r.term {
+				r.becomeFollower(resp.Term)
+			} else if resp.Granted && r.state == RaftCandidate && r.term == req.Term {
+				votes++
+				if r.quorum(votes) {
+					r.becomeLeader()
+				}
+			}
+		}(url)
+	}
+}
+
+func (r *RaftNode) becomeLeader() {
+	log.Printf("Cluster node %s is the leader for term %d", r.id, r.term)
+	r.state, r.leader = RaftLeader, r.id
+	now := time.Now()
+	for id := range r.members {
+		r.nextIndex[id] = r.lastIndex() + 1
+		r.matchIndex[id] = 0
+		r.lastAck[id] = now
+	}
+	// Committing an entry of its own term commits those of earlier terms;
+	// proposals wait until it is applied.
+	if err := r.appendEntries([]*RaftEntry{{Term: r.term, Type: RaftNoop}}); err != nil {
+		log.Printf("Error appending to the cluster log: %s", err)
+		r.becomeFollower(r.term)
+		return
+	}
+	r.readyIndex = r.lastIndex()
+	r.advanceCommit()
+	r.replicateAll()
+}
+
+func (r *RaftNode) replicateAll() {
+	for id := range r.members {
+		if id != r.id {
+			go r.replicate(id)
+		}
+	}
+}
+
+// replicate sends a peer the entries it is missing, or a snapshot when they
+// were compacted, and keeps going until it is up to date.
+func (r *RaftNode) replicate(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	url, ok := r.members[id]
+	if r.state != RaftLeader || !ok || r.replicating[id] {
+		return
+	}
+	r.replicating[id] = true
+	defer func() { r.replicating[id] = false }()
+
+	for r.state == RaftLeader && !r.stopped {
+		term := r.term
+		next, ok := r.nextIndex[id]
+		if !ok || next == 0 {
+			next = r.lastIndex() + 1
+		}
+
+		if next <= r.snapshotIndex {
+			req := &SnapshotRequest{Term: term, Leader: r.id, Index: r.snapshotIndex, LogTerm: r.snapshotTerm, Members: r.snapshotMembers}
+			r.mutex.Unlock()
+			resp, err := r.transport.Snapshot(url, req)
+			r.mutex.Lock()
+			if err != nil {
+				return
+			}
+			if resp.Term > r.term {
+				r.becomeFollower(resp.Term)
+				return
+			}
+			r.lastAck[id] = time.Now()
+			r.matchIndex[id], r.nextIndex[id] = req.Index, req.Index+1
+			continue
+		}
+
+		end := r.lastIndex()
+		if end-next+1 > raftAppendLimit {
+			end = next + raftAppendLimit - 1
+		}
+		var entries []*RaftEntry
+		for i := next; i <= end; i++ {
+			entries = append(entries, r.entry(i))
+		}
+		req := &AppendRequest{Term: term, Leader: r.id, PrevIndex: next - 1, PrevTerm: r.logTerm(next - 1), Entries: entries, Commit: r.commitIndex}
+		r.mutex.Unlock()
+		resp, err := r.transport.Append(url, req)
+		r.mutex.Lock()
+		if err != nil {
+			return
+		}
+		if resp.Term > r.term {
+			r.becomeFollower(resp.Term)
+			return
+		}
+		if r.state != RaftLeader || r.term != term {
+			return
+		}
+		r.lastAck[id] = time.Now()
+		if !resp.Success {
+			if resp.Conflict > 0 && resp.Conflict < next {
+				r.nextIndex[id] = resp.Conflict
+			} else {
+				r.nextIndex[id] = next - 1
+			}
+			continue
+		}
+		if resp.Match > r.matchIndex[id] {
+			r.matchIndex[id] = resp.Match
+		}
+		r.nextIndex[id] = resp.Match + 1
+		r.advanceCommit()
+		if r.nextIndex[id] > r.lastIndex() {
+			return
+		}
+	}
+}
+
+// advanceCommit commits the latest entry of the current term that a
+// majority of members have.
+func (r *RaftNode) advanceCommit() {
+	for index := r.lastIndex(); index > r.commitIndex && r.logTerm(index) == r.term; index-- {
+		n := 0
+		for id := range r.members {
+			if id == r.id || r.matchIndex[id] >= index {
+				n++
+			}
+		}
+		if r.quorum(n) {
+			r.commitIndex = index
+			r.cond.Broadcast()
+			break
+		}
+	}
+	// A leader removed from the cluster leaves once the removal commits.
+	if !r.isMember() && r.commitIndex >= r.configIndex {
+		log.Printf("Cluster node %s was removed, stepping down", r.id)
+		r.becomeFollower(r.term)
+	}
+}
+
+// applyCommitted applies committed entries in order and compacts the log.
+func (r *RaftNode) applyCommitted() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for {
+		for !r.stopped && r.lastApplied >= r.commitIndex {
+			r.cond.Wait()
+		}
+		if r.stopped {
+			return
+		}
+		index := r.lastApplied + 1
+		entry := r.entry(index)
+		r.mutex.Unlock()
+
+		r.applyMutex.Lock()
+		var err error
+		if entry != nil && entry.Type != RaftNoop && entry.Type != RaftConfig {
+			err = r.apply(index, entry)
+		}
+		r.applyMutex.Unlock()
+
+		r.mutex.Lock()
+		if err != nil {
+			log.Printf("Error applying cluster log entry %d: %s", index, err)
+			r.mutex.Unlock()
+			time.Sleep(r.heartbeat)
+			r.mutex.Lock()
+			continue
+		}
+		if r.lastApplied == index-1 {
+			r.lastApplied = index
+			r.cond.Broadcast()
+		}
+		if r.lastApplied-r.snapshotIndex >= r.snapshotEntries {
+			r.compact()
+		}
+	}
+}
+
+// compact replaces the applied entries with a snapshot. The applied state
+// itself is already kept by apply.
+func (r *RaftNode) compact() {
+	index := r.lastApplied
+	r.snapshotMembers = r.membersAt(index)
+	r.snapshotTerm = r.logTerm(index)
+	r.entries = append([]*RaftEntry{}, r.entries[index-r.snapshotIndex:]...)
+	r.snapshotIndex = index
+	if err := r.saveSnapshot(); err != nil {
+		log.Printf("Error compacting the cluster log: %s", err)
+	}
+	r.updateMembers()
+}
+
+func (r *RaftNode) handleVote(req *VoteRequest) *VoteResponse {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if req.Term > r.term {
+		r.becomeFollower(req.Term)
+	}
+	granted := false
+	lastTerm := r.logTerm(r.lastIndex())
+	upToDate := req.LastTerm > lastTerm || (req.LastTerm == lastTerm && req.LastIndex >= r.lastIndex())
+	if req.Term == r.term && (r.votedFor == "" || r.votedFor == req.Candidate) && upToDate {
+		r.votedFor = req.Candidate
+		if err := r.saveState(); err == nil {
+			granted = true
+			r.resetElection()
+		}
+	}
+	return &VoteResponse{Term: r.term, Granted: granted}
+}
+
+// follow takes req's sender as the leader of term.
+func (r *RaftNode) follow(term uint64, leader string) {
+	if term > r.term || r.state != RaftFollower {
+		r.becomeFollower(term)
+	}
+	r.leader = leader
+	r.resetElection()
+}
+
+func (r *RaftNode) handleAppend(req *AppendRequest) (*AppendResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if req.Term < r.term {
+		return &AppendResponse{Term: r.term}, nil
+	}
+	r.follow(req.Term, req.Leader)
+
+	if req.PrevIndex > r.lastIndex() {
+		return &AppendResponse{Term: r.term, Conflict: r.lastIndex() + 1}, nil
+	}
+	prev, entries := req.PrevIndex, req.Entries
+	if prev < r.snapshotIndex {
+		// The snapshot holds committed entries, which match the leader's.
+		skip := r.snapshotIndex - prev
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		prev, entries = prev+skip, entries[skip:]
+	} else if r.logTerm(prev) != req.PrevTerm {
+		conflict, term := prev, r.logTerm(prev)
+		for conflict-1 > r.snapshotIndex && r.logTerm(conflict-1) == term {
+			conflict--
+		}
+		return &AppendResponse{Term: r.term, Conflict: conflict}, nil
+	}
+
+	for i, entry := range entries {
+		index := prev + uint64(i) + 1
+		if index <= r.lastIndex() {
+			if r.logTerm(index) == entry.Term {
+				continue
+			}
+			if err := r.truncate(index); err != nil {
+				return nil, err
+			}
+		}
+		if err := r.appendEntries(entries[i:]); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	match := prev + uint64(len(entries))
+	if commit := req.Commit; commit > r.commitIndex {
+		if commit > match {
+			commit = match
+		}
+		if commit > r.commitIndex {
+			r.commitIndex = commit
+			r.cond.Broadcast()
+		}
+	}
+	return &AppendResponse{Term: r.term, Success: true, Match: match}, nil
+}
+
+func (r *RaftNode) handleSnapshot(req *SnapshotRequest) (*SnapshotResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if req.Term < r.term {
+		return &SnapshotResponse{Term: r.term}, nil
+	}
+	r.follow(req.Term, req.Leader)
+	if req.Index <= r.lastApplied {
+		return &SnapshotResponse{Term: r.term}, nil
+	}
+	leaderURL := req.Members[req.Leader]
+
+	r.installing = true
+	r.mutex.Unlock()
+	r.applyMutex.Lock()
+	err := r.install(leaderURL)
+	r.applyMutex.Unlock()
+	r.mutex.Lock()
+	r.installing = false
+	r.resetElection()
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the entries after the snapshot if they agree with it.
+	if r.logTerm(req.Index) == req.LogTerm && req.Index < r.lastIndex() {
+		r.entries = append([]*RaftEntry{}, r.entries[req.Index-r.snapshotIndex:]...)
+	} else {
+		if err := r.truncate(r.snapshotIndex + 1); err != nil {
+			return nil, err
+		}
+		r.entries = nil
+	}
+	r.snapshotIndex, r.snapshotTerm, r.snapshotMembers = req.Index, req.LogTerm, req.Members
+	if err := r.saveSnapshot(); err != nil {
+		return nil, err
+	}
+	r.updateMembers()
+	if r.commitIndex < req.Index {
+		r.commitIndex = req.Index
+	}
+	r.lastApplied = req.Index
+	r.cond.Broadcast()
+	return &SnapshotResponse{Term: r.term}, nil
+}
+
+// propose appends an entry to the leader's log and returns its index once
+// it is committed. An entry proposed by a leader that loses its leadership
+// may still commit, and is then applied like any other.
+//
+// Writes propose from inside their bolt transaction, which the apply loop
+// may be waiting for, so propose fails rather than wait for a new leader to
+// catch up; callers wait with awaitLeadership first.
+func (r *RaftNode) propose(entry *RaftEntry) (uint64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.state == RaftLeader && r.lastApplied < r.readyIndex {
+		return 0, errLeaderNotReady
+	}
+	return r.proposeLocked(entry)
+}
+
+func (r *RaftNode) proposeLocked(entry *RaftEntry) (uint64, error) {
+	if r.stopped {
+		return 0, errRaftStopped
+	}
+	if r.state != RaftLeader {
+		return 0, errNotLeader
+	}
+	entry.Term = r.term
+	if err := r.appendEntries([]*RaftEntry{entry}); err != nil {
+		return 0, err
+	}
+	index := r.lastIndex()
+	r.advanceCommit()
+	r.replicateAll()
+	for r.commitIndex < index && r.state == RaftLeader && r.term == entry.Term && !r.stopped {
+		r.cond.Wait()
+	}
+	if r.commitIndex >= index && r.logTerm(index) == entry.Term {
+		return index, nil
+	}
+	return 0, errNotLeader
+}
+
+// awaitLeadership waits until a new leader has applied the entries of
+// earlier terms, and reports whether this node is the leader.
+func (r *RaftNode) awaitLeadership() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for r.state == RaftLeader && r.lastApplied < r.readyIndex && !r.stopped {
+		r.cond.Wait()
+	}
+	return r.state == RaftLeader
+}
+
+// proposeApplied proposes an entry and waits until this node applied it.
+func (r *RaftNode) proposeApplied(entry *RaftEntry) error {
+	if !r.awaitLeadership() {
+		return errNotLeader
+	}
+	index, err := r.propose(entry)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for r.lastApplied < index && !r.stopped {
+		r.cond.Wait()
+	}
+	return nil
+}
+
+// changeMembers proposes a membership with one server added or removed.
+func (r *RaftNode) changeMembers(id string, url string, add bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for r.state == RaftLeader && r.lastApplied < r.readyIndex && !r.stopped {
+		r.cond.Wait()
+	}
+	if r.state != RaftLeader {
+		return errNotLeader
+	}
+	if r.configIndex > r.commitIndex {
+		return errMembershipChanging
+	}
+	members := map[string]string{}
+	for k, v := range r.members {
+		members[k] = v
+	}
+	if add {
+		members[id] = url
+		r.nextIndex[id], r.matchIndex[id], r.lastAck[id] = r.lastIndex()+1, 0, time.Now()
+	} else {
+		delete(members, id)
+	}
+	_, err := r.proposeLocked(&RaftEntry{Type: RaftConfig, Members: members})
+	return err
+}
+
+func (r *RaftNode) leaderURL() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.state == RaftLeader {
+		return ""
+	}
+	return r.members[r.leader]
+}
+
+func (r *RaftNode) status() map[interface{}]interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	members := map[interface{}]interface{}{}
+	for id, url := range r.members {
+		members[id] = url
+	}
+	return map[interface{}]interface{}{
+		"id":            r.id,
+		"state":         r.state,
+		"term":          r.term,
+		"leader":        r.leader,
+		"members":       members,
+		"lastIndex":     r.lastIndex(),
+		"commitIndex":   r.commitIndex,
+		"lastApplied":   r.lastApplied,
+		"snapshotIndex": r.snapshotIndex,
+	}
+}
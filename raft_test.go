@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// memTransport delivers Raft messages between nodes of one process. Nodes
+// marked down neither send nor receive.
+type memTransport struct {
+	mutex sync.Mutex
+	nodes map[string]*RaftNode
+	down  map[string]bool
+}
+
+// nodeTransport sends the messages of one node.
+type nodeTransport struct {
+	from string
+	net  *memTransport
+}
+
+var errNodeDown = errors.New("Node is down")
+
+func (t *nodeTransport) node(url string) (*RaftNode, error) {
+	t.net.mutex.Lock()
+	defer t.net.mutex.Unlock()
+	if t.net.down[t.from] || t.net.down[url] || t.net.nodes[url] == nil {
+		return nil, errNodeDown
+	}
+	return t.net.nodes[url], nil
+}
+
+func (t *nodeTransport) Vote(url string, req *VoteRequest) (*VoteResponse, error) {
+	node, err := t.node(url)
+	if err != nil {
+		return nil, err
+	}
+	return node.handleVote(req), nil
+}
+
+func (t *nodeTransport) Append(url string, req *AppendRequest) (*AppendResponse, error) {
+	node, err := t.node(url)
+	if err != nil {
+		return nil, err
+	}
+	return node.handleAppend(req)
+}
+
+func (t *nodeTransport) Snapshot(url string, req *SnapshotRequest) (*SnapshotResponse, error) {
+	node, err := t.node(url)
+	if err != nil {
+		return nil, err
+	}
+	return node.handleSnapshot(req)
+}
+
+// testMachine records the entries applied by a node; a snapshot install
+// copies the leader's record.
+type testMachine struct {
+	mutex     sync.Mutex
+	applied   []string
+	lastIndex uint64
+}
+
+func (m *testMachine) values() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string{}, m.applied...)
+}
+
+type testCluster struct {
+	t         *testing.T
+	dir       string
+	transport *memTransport
+	machines  map[string]*testMachine
+}
+
+func (tc *testCluster) start(id string, peers map[string]string) *RaftNode {
+	machine := &testMachine{}
+	tc.machines[id] = machine
+	apply := func(index uint64, entry *RaftEntry) error {
+		machine.mutex.Lock()
+		defer machine.mutex.Unlock()
+		if index > machine.lastIndex {
+			machine.applied = append(machine.applied, entry.Db)
+			machine.lastIndex = index
+		}
+		return nil
+	}
+	install := func(leader string) error {
+		source := tc.machines[leader]
+		source.mutex.Lock()
+		values, lastIndex := append([]string{}, source.applied...), source.lastIndex
+		source.mutex.Unlock()
+		machine.mutex.Lock()
+		defer machine.mutex.Unlock()
+		machine.applied, machine.lastIndex = values, lastIndex
+		return nil
+	}
+	node, err := NewRaftNode(id, filepath.Join(tc.dir, id+".raft"), peers, &nodeTransport{id, tc.transport}, apply, install)
+	assert.Ok(tc.t, err)
+	node.heartbeat, node.electionTimeout, node.snapshotEntries = 10*time.Millisecond, 50*time.Millisecond, 5
+	tc.transport.mutex.Lock()
+	tc.transport.nodes[id] = node
+	tc.transport.mutex.Unlock()
+	node.start()
+	return node
+}
+
+func (tc *testCluster) leader(nodes ...*RaftNode) *RaftNode {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, node := range nodes {
+			if node.awaitLeadership() {
+				return node
+			}
+		}
+	}
+	tc.t.Fatal("no leader elected")
+	return nil
+}
+
+func (tc *testCluster) propose(leader *RaftNode, values ...string) {
+	for _, value := range values {
+		_, err := leader.propose(&RaftEntry{Type: "test", Db: value})
+		assert.Ok(tc.t, err)
+	}
+}
+
+// converged waits until the machines of ids applied the same values.
+func (tc *testCluster) converged(expected []string, ids ...string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		same := true
+		for _, id := range ids {
+			if fmt.Sprint(tc.machines[id].values()) != fmt.Sprint(expected) {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+	}
+	for _, id := range ids {
+		tc.t.Logf("%s applied %v", id, tc.machines[id].values())
+	}
+	tc.t.Fatalf("nodes did not apply %v", expected)
+}
+
+func TestRaft(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+	tc := &testCluster{t: t, dir: dir, transport: &memTransport{nodes: map[string]*RaftNode{}, down: map[string]bool{}}, machines: map[string]*testMachine{}}
+
+	// Node ids double as their URLs.
+	peers := map[string]string{"n1": "n1", "n2": "n2", "n3": "n3"}
+	nodes := map[string]*RaftNode{}
+	for id := range peers {
+		nodes[id] = tc.start(id, peers)
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.stop()
+		}
+	}()
+
+	leader := tc.leader(nodes["n1"], nodes["n2"], nodes["n3"])
+	tc.propose(leader, "a", "b", "c")
+	tc.converged([]string{"a", "b", "c"}, "n1", "n2", "n3")
+
+	// A follower does not take proposals.
+	var followers []*RaftNode
+	for _, node := range nodes {
+		if node != leader {
+			followers = append(followers, node)
+		}
+	}
+	_, err = followers[0].propose(&RaftEntry{Type: "test", Db: "x"})
+	assert.Equals(t, errNotLeader, err)
+
+	// The others elect a new leader when the leader goes down, and
+	// compact their logs as they go.
+	tc.transport.mutex.Lock()
+	tc.transport.down[leader.id] = true
+	tc.transport.mutex.Unlock()
+	newLeader := tc.leader(followers...)
+	tc.propose(newLeader, "d", "e", "f", "g")
+	expected := []string{"a", "b", "c", "d", "e", "f", "g"}
+	tc.converged(expected, followers[0].id, followers[1].id)
+	newLeader.mutex.Lock()
+	assert.Cond(t, newLeader.snapshotIndex > 0, "the leader should have compacted its log")
+	newLeader.mutex.Unlock()
+
+	// The old leader steps down and catches up once it is back.
+	tc.transport.mutex.Lock()
+	delete(tc.transport.down, leader.id)
+	tc.transport.mutex.Unlock()
+	tc.converged(expected, leader.id)
+
+	// A new member gets a snapshot of the compacted entries, then the
+	// rest of the log.
+	nodes["n4"] = tc.start("n4", nil)
+	assert.Ok(t, newLeader.changeMembers("n4", "n4", true))
+	tc.propose(newLeader, "h")
+	expected = append(expected, "h")
+	tc.converged(expected, "n1", "n2", "n3", "n4")
+
+	// A removed member no longer counts towards a majority.
+	assert.Ok(t, newLeader.changeMembers(leader.id, "", false))
+	tc.transport.mutex.Lock()
+	tc.transport.down[leader.id] = true
+	tc.transport.mutex.Unlock()
+	tc.propose(newLeader, "i")
+	newLeader.mutex.Lock()
+	assert.Equals(t, 3, len(newLeader.members))
+	newLeader.mutex.Unlock()
+}
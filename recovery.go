@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The oplog of every database is archived into oplog/<db> in the backup
+// directory, as segments named after the sequence numbers of their first
+// and last changes, such as 00000000000000000001-00000000000000000042.json,
+// holding the entries as the oplog endpoint sends them. Base backups record
+// the sequence number of their latest change, so a database can be
+// recovered as it was at any time since its oldest backup by replaying the
+// archive, then its own oplog, over the latest backup taken before then.
+//
+// When the oplog of a database no longer continues its archive, because the
+// database was deleted and created again or restored from a file, the
+// archive is moved aside under a name starting with a dot and a new one is
+// started.
+const oplogArchiveDir = "oplog"
+
+var oplogArchiveInterval time.Duration
+
+var (
+	errNoBackupDir    = errors.New("No backup directory is configured")
+	errNoBaseBackup   = errors.New("No backup of the database was taken before the recovery target")
+	errArchiveDiffers = errors.New("The oplog archive does not continue the base backup")
+)
+
+type oplogSegment struct {
+	path        string
+	first, last uint64
+}
+
+func oplogArchivePath(dir string, db string) string {
+	return filepath.Join(dir, oplogArchiveDir, db)
+}
+
+// listSegments returns the segments of an oplog archive in sequence order.
+func listSegments(path string) ([]*oplogSegment, error) {
+	entries, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var segments []*oplogSegment
+	for _, entry := range entries {
+		segment := &oplogSegment{path: filepath.Join(path, entry.Name())}
+		if _, err := fmt.Sscanf(entry.Name(), "%d-%d.json", &segment.first, &segment.last); err != nil {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+func readSegment(segment *oplogSegment) ([]*Change, error) {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	changes, err := readChanges(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %s", segment.path, err)
+	}
+	return changes, nil
+}
+
+func sameChange(a *Change, b *Change) bool {
+	return a.Seq == b.Seq && a.Op == b.Op && a.Collection == b.Collection && a.Id == b.Id && a.Time.Equal(b.Time)
+}
+
+// archiveOplog archives the changes of every database made since the last
+// run.
+func archiveOplog(dir string) error {
+	names, err := listDatabases()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := archiveDbOplog(dir, name); err != nil {
+			return fmt.Errorf("Error archiving the oplog of %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func archiveDbOplog(dir string, db string) error {
+	path := oplogArchivePath(dir, db)
+	segments, err := listSegments(path)
+	if err != nil {
+		return err
+	}
+	var last *Change
+	if len(segments) > 0 {
+		changes, err := readSegment(segments[len(segments)-1])
+		if err != nil {
+			return err
+		} else if len(changes) == 0 {
+			return fmt.Errorf("%s is empty", segments[len(segments)-1].path)
+		}
+		last = changes[len(changes)-1]
+	}
+
+	for {
+		var changes []*Change
+		var broken string
+		err := readDb(db, func(tx *bolt.Tx) error {
+			var since uint64
+			if last != nil {
+				if broken = oplogBreak(tx, last); broken != "" {
+					return nil
+				}
+				since = last.Seq
+			}
+			var err error
+			changes, err = readOplog(tx, since, oplogPage)
+			if err == errResumeTooOld && last == nil {
+				// A new archive starts with the oldest change left.
+				k, _ := tx.Bucket([]byte(oplogBucket)).Cursor().First()
+				changes, err = readOplog(tx, binary.BigEndian.Uint64(k)-1, oplogPage)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if broken != "" {
+			aside := filepath.Join(dir, oplogArchiveDir, fmt.Sprintf(".%s-%s", db, time.Now().UTC().Format(backupNameFormat)))
+			if err := os.Rename(path, aside); err != nil {
+				return err
+			}
+			log.Printf("The oplog of %s does not continue its archive, %s, moved it to %s", db, broken, aside)
+			last = nil
+			continue
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		if err := writeSegment(path, changes); err != nil {
+			return err
+		}
+		last = changes[len(changes)-1]
+		if len(changes) < oplogPage {
+			return nil
+		}
+	}
+}
+
+// oplogBreak tells why the oplog of tx does not continue from the change
+// last, or returns "" when it does: it must have last, or the changes right
+// after it if last was pruned since it was archived.
+func oplogBreak(tx *bolt.Tx, last *Change) string {
+	if oplogSeq(tx) < last.Seq {
+		return "the database is behind it"
+	}
+	value := tx.Bucket([]byte(oplogBucket)).Get(oplogKey(last.Seq))
+	if value == nil {
+		if _, err := readOplog(tx, last.Seq, 1); err == errResumeTooOld {
+			return "changes were pruned before they were archived"
+		}
+		return ""
+	}
+	change, err := decodeChange(oplogKey(last.Seq), value)
+	if err != nil || !sameChange(change, last) {
+		return "the database was replaced"
+	}
+	return ""
+}
+
+// writeSegment writes changes as a segment of the archive at path, under a
+// name starting with a dot until it is complete.
+func writeSegment(path string, changes []*Change) error {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d-%020d.json", changes[0].Seq, changes[len(changes)-1].Seq)
+	partial := filepath.Join(path, "."+name)
+	err := writeDbFile(partial, func(w io.Writer) error {
+		for _, change := range changes {
+			encChange, err := change.encode(true)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(encChange); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.Rename(partial, filepath.Join(path, name))
+}
+
+// runOplogArchive archives the oplog of every database every interval.
+func runOplogArchive(dir string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := archiveOplog(dir); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// A RecoveryTarget is the last change a recovery replays: the one with
+// sequence number Seq, the last one made before Time, or the earlier of
+// both when both are set. With neither, every available change is
+// replayed.
+type RecoveryTarget struct {
+	Seq  uint64
+	Time time.Time
+}
+
+func (target *RecoveryTarget) includes(change *Change) bool {
+	return (target.Seq == 0 || change.Seq <= target.Seq) && (target.Time.IsZero() || change.Time.Before(target.Time))
+}
+
+// A Recovery replays changes over a copy of a base backup.
+type Recovery struct {
+	Db     string
+	Into   string
+	Backup string
+	// Last is the last change replayed, or the latest one of the backup.
+	Last *Change
+
+	file   *bolt.DB
+	target *RecoveryTarget
+	done   bool
+}
+
+// findBaseBackup returns the latest backup of db with only changes the
+// recovery target includes.
+func findBaseBackup(dir string, db string, target *RecoveryTarget) (*BackupSet, *BackupFile, error) {
+	sets, err := listBackups(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for i := len(sets) - 1; i >= 0; i-- {
+		for _, file := range sets[i].Files {
+			if file.Db != db || file.Time.IsZero() {
+				continue
+			}
+			if (target.Seq == 0 || file.Seq <= target.Seq) && (target.Time.IsZero() || !file.Time.After(target.Time)) {
+				return sets[i], file, nil
+			}
+		}
+	}
+	return nil, nil, errNoBaseBackup
+}
+
+// recoverDb recovers db as it was at target into the database into, which
+// is db itself when empty, from the backups and oplog archive in
+// backupDir. A database other than db must not exist yet.
+func recoverDb(db string, into string, target *RecoveryTarget) (*Recovery, error) {
+	if into == "" {
+		into = db
+	}
+	if !validDbName(db) || !validDbName(into) {
+		return nil, errInvalidDbName
+	}
+	if backupDir == "" {
+		return nil, errNoBackupDir
+	}
+	if cluster != nil {
+		return nil, errRestoreInCluster
+	}
+	if _, err := os.Stat(dbFileName(into)); err == nil && into != db {
+		return nil, errDbExists
+	}
+	set, base, err := findBaseBackup(backupDir, db, target)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recovery{Db: db, Into: into, Backup: set.Name, target: target}
+	path := dbFileName(into) + ".recover"
+	err = writeDbFile(path, func(w io.Writer) error {
+		file, err := os.Open(filepath.Join(backupDir, set.Name, base.File))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(w, file)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = r.replay(path, base)
+	if err == nil {
+		err = renewEpoch(path)
+	}
+	if err == nil && into == db {
+		err = replaceDb(into, path)
+	} else if err == nil {
+		err = addDb(into, path)
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return r, nil
+}
+
+// replay applies the archived changes after the base backup, then those of
+// the database's own oplog, to the file at path.
+func (r *Recovery) replay(path string, base *BackupFile) error {
+	var err error
+	r.file, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer r.file.Close()
+	err = r.file.View(func(tx *bolt.Tx) error {
+		if oplogSeq(tx) != base.Seq {
+			return fmt.Errorf("Backup of %s does not end at change %d", base.Db, base.Seq)
+		}
+		if base.Seq > 0 {
+			r.Last, err = decodeChange(oplogKey(base.Seq), tx.Bucket([]byte(oplogBucket)).Get(oplogKey(base.Seq)))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	segments, err := listSegments(oplogArchivePath(backupDir, r.Db))
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if r.done {
+			return nil
+		} else if segment.last < r.seq() {
+			continue
+		}
+		changes, err := readSegment(segment)
+		if err != nil {
+			return err
+		}
+		if err := r.apply(changes); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(dbFileName(r.Db)); os.IsNotExist(err) {
+		return nil
+	}
+	for !r.done {
+		var changes []*Change
+		err := readDb(r.Db, func(tx *bolt.Tx) error {
+			since := r.seq()
+			if since > 0 {
+				// From the last change replayed, to check it is the same.
+				since--
+			}
+			var err error
+			changes, err = readOplog(tx, since, oplogPage)
+			if err == errResumeTooOld && oplogSeq(tx) >= r.seq() {
+				changes, err = readOplog(tx, r.seq(), oplogPage)
+			}
+			if err == errResumeTooOld && oplogSeq(tx) > r.seq() {
+				return fmt.Errorf("Changes after %d are missing from the oplog archive", r.seq())
+			} else if err == errResumeTooOld {
+				// The database is not the one archived any more.
+				changes, err = nil, nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		seq := r.seq()
+		if err := r.apply(changes); err == errArchiveDiffers {
+			// The database was created again with as many changes.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if r.seq() == seq {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *Recovery) seq() uint64 {
+	if r.Last == nil {
+		return 0
+	}
+	return r.Last.Seq
+}
+
+// apply replays changes in one transaction, up to the recovery target.
+func (r *Recovery) apply(changes []*Change) error {
+	return r.file.Update(func(tx *bolt.Tx) error {
+		for _, change := range changes {
+			switch {
+			case change.Seq < r.seq():
+				continue
+			case r.Last != nil && change.Seq == r.Last.Seq:
+				if !sameChange(change, r.Last) {
+					return errArchiveDiffers
+				}
+				continue
+			case change.Seq != r.seq()+1:
+				return fmt.Errorf("Changes %d to %d are missing from the oplog archive", r.seq()+1, change.Seq-1)
+			case !r.target.includes(change):
+				r.done = true
+				return nil
+			}
+			if err := replayChange(tx, change); err != nil {
+				return err
+			}
+			r.Last = change
+		}
+		return nil
+	})
+}
+
+// replayChange writes change in tx and logs it with its own sequence number
+// and time.
+func replayChange(tx *bolt.Tx, change *Change) error {
+	lookupId, err := ParseId(change.Id)
+	if err != nil {
+		return err
+	}
+	bucket, err := tx.CreateBucketIfNotExists([]byte(change.Collection))
+	if err != nil {
+		return err
+	}
+	if change.Op == ChangeDelete {
+		err = bucket.Delete(lookupId)
+	} else {
+		var encDoc []byte
+		if encDoc, err = encodeChangeDoc(change); err == nil {
+			err = bucket.Put(lookupId, encDoc)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	logged := *change
+	if err := logChange(tx, &logged); err != nil {
+		return err
+	}
+	if logged.Seq != change.Seq {
+		return errArchiveDiffers
+	}
+	return nil
+}
+
+// parseRecoveryTarget reads {"seq": ..., "time": ...}, where time is a date
+// or an RFC 3339 string.
+func parseRecoveryTarget(body map[interface{}]interface{}) (*RecoveryTarget, error) {
+	target := &RecoveryTarget{}
+	if v, ok := body["seq"]; ok {
+		seq, ok := intValue(v)
+		if !ok || seq < 1 {
+			return nil, fmt.Errorf("Invalid sequence number %v", v)
+		}
+		target.Seq = uint64(seq)
+	}
+	if v, ok := body["time"]; ok {
+		var err error
+		if s, isString := v.(string); isString {
+			target.Time, err = time.Parse(time.RFC3339Nano, strings.TrimSpace(s))
+		} else if t, isDate := dateValue(v); isDate {
+			target.Time = t
+		} else {
+			err = fmt.Errorf("Invalid time %v", v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
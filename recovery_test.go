@@ -0,0 +1,115 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hooklift/assert"
+)
+
+func allChanges(t *testing.T, db string) []*Change {
+	changes, err := oplogChanges(t, db, 0)
+	assert.Ok(t, err)
+	return changes
+}
+
+func TestRecovery(t *testing.T) {
+	defer withTestDir(t)()
+	defer func(dir string) { backupDir = dir }(backupDir)
+	backupDir = filepath.Join(rootDir, "backups")
+
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+	_, err := takeBackup(backupDir, time.Now())
+	assert.Ok(t, err)
+	insertTestDocs(t, "app", "users", `{"name": "cy"}`)
+	assert.Ok(t, archiveOplog(backupDir))
+	assert.Ok(t, archiveOplog(backupDir))
+	insertTestDocs(t, "app", "users", `{"name": "dan"}`)
+	changes := allChanges(t, "app")
+	assert.Equals(t, 4, len(changes))
+	segments, err := listSegments(oplogArchivePath(backupDir, "app"))
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(segments))
+
+	// From the archive, over the backup.
+	r, err := recoverDb("app", "at3", &RecoveryTarget{Seq: 3})
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(3), r.seq())
+	assert.Equals(t, 3, countDocs(t, "at3", "users", `{}`))
+	assert.Equals(t, 3, len(allChanges(t, "at3")))
+	assert.Cond(t, sameChange(changes[2], allChanges(t, "at3")[2]), "replayed changes should keep their sequence and time")
+
+	// Only changes made before the time.
+	r, err = recoverDb("app", "before3", &RecoveryTarget{Time: changes[2].Time})
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(2), r.seq())
+	assert.Equals(t, 2, countDocs(t, "before3", "users", `{}`))
+
+	// The latest changes are read from the database's own oplog.
+	insertTestDocs(t, "app", "users", `{"name": "eve"}`)
+	r, err = recoverDb("app", "", &RecoveryTarget{Seq: 4})
+	assert.Ok(t, err)
+	assert.Equals(t, 4, countDocs(t, "app", "users", `{}`))
+	assert.Equals(t, uint64(4), r.seq())
+
+	_, err = recoverDb("app", "at3", &RecoveryTarget{})
+	assert.Equals(t, errDbExists, err)
+	_, err = recoverDb("app", "old", &RecoveryTarget{Time: changes[0].Time})
+	assert.Equals(t, errNoBaseBackup, err)
+
+	// A database created again starts a new archive, while the deleted one
+	// still recovers from the backup and the old archive.
+	assert.Ok(t, deleteDb("app"))
+	insertTestDocs(t, "app", "users", `{"name": "fay"}`)
+	assert.Ok(t, archiveOplog(backupDir))
+	segments, err = listSegments(oplogArchivePath(backupDir, "app"))
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(segments))
+	assert.Equals(t, uint64(1), segments[0].last)
+	sets, err := listBackups(backupDir)
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(sets))
+}
+
+func TestRecoveryDeletedDb(t *testing.T) {
+	defer withTestDir(t)()
+	defer func(dir string) { backupDir = dir }(backupDir)
+	backupDir = filepath.Join(rootDir, "backups")
+
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`)
+	_, err := takeBackup(backupDir, time.Now())
+	assert.Ok(t, err)
+	insertTestDocs(t, "app", "users", `{"name": "bob"}`, `{"name": "cy"}`)
+	assert.Ok(t, archiveOplog(backupDir))
+	assert.Ok(t, deleteDb("app"))
+
+	r, err := recoverDb("app", "", &RecoveryTarget{})
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(3), r.seq())
+	assert.Equals(t, 3, countDocs(t, "app", "users", `{}`))
+}
+
+func TestArchivePrunedGap(t *testing.T) {
+	defer withTestDir(t)()
+	defer func(dir string) { backupDir = dir }(backupDir)
+	backupDir = filepath.Join(rootDir, "backups")
+
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`)
+	assert.Ok(t, archiveOplog(backupDir))
+	insertTestDocs(t, "app", "users", `{"name": "bob"}`, `{"name": "cy"}`)
+	assert.Ok(t, updateDb("app", func(tx *bolt.Tx) error {
+		return pruneOplog(tx.Bucket([]byte(oplogBucket)), time.Now())
+	}))
+
+	// The archive can't cover the pruned change, so a new one starts.
+	assert.Ok(t, archiveOplog(backupDir))
+	segments, err := listSegments(oplogArchivePath(backupDir, "app"))
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(segments))
+	assert.Equals(t, uint64(3), segments[0].first)
+	aside, err := filepath.Glob(filepath.Join(backupDir, oplogArchiveDir, ".app-*"))
+	assert.Ok(t, err)
+	assert.Equals(t, 1, len(aside))
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ugorji/go/codec"
+)
+
+// A follower keeps a read-only copy of every database of a primary. It
+// copies each database from a snapshot, then polls the primary's oplog and
+// applies the entries in order through the usual write path, so its own
+// oplog keeps the primary's sequence numbers and its change feeds work as
+// on the primary. Each pull starts with the entry the follower has last,
+// which must be the same on both, and entries it already has are checked
+// and skipped, which makes applying a page twice harmless. A database whose
+// oplog is pruned past the follower's position, whose epoch changed because
+// the primary restored it, or that disagrees with the primary in any other
+// way, is copied again.
+const (
+	oplogSeqHeader   = "Oplog-Seq"
+	oplogEpochHeader = "Oplog-Epoch"
+)
+
+var errReplicaDiverged = errors.New("Replica does not match the primary's oplog")
+
+// following is the URL of the primary when running as a follower.
+var following string
+
+var followInterval = time.Second
+
+type Follower struct {
+	primary string
+	client  *http.Client
+
+	mutex    sync.Mutex
+	replicas map[string]*Replica
+}
+
+// A Replica is the replication state of one database.
+type Replica struct {
+	Seq        uint64
+	PrimarySeq uint64
+	LastSync   time.Time
+	// CaughtUp is when the replica last had every change of the primary.
+	CaughtUp time.Time
+	Err      error
+}
+
+var follower *Follower
+
+func NewFollower(primary string) *Follower {
+	return &Follower{
+		primary:  primary,
+		client:   &http.Client{},
+		replicas: map[string]*Replica{},
+	}
+}
+
+// run syncs every interval until the process exits.
+func (f *Follower) run(interval time.Duration) {
+	for {
+		if err := f.sync(); err != nil {
+			log.Printf("Error following %s: %s", f.primary, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// sync copies the databases of the primary that are missing, deletes those
+// the primary no longer has and pulls the latest changes of the rest.
+func (f *Follower) sync() error {
+	names, err := f.primaryDatabases()
+	if err != nil {
+		return err
+	}
+	local, err := listDatabases()
+	if err != nil {
+		return err
+	}
+
+	primary := map[string]bool{}
+	for _, name := range names {
+		primary[name] = true
+	}
+	for _, name := range local {
+		if !primary[name] {
+			if err := deleteDb(name); err != nil {
+				return err
+			}
+			f.mutex.Lock()
+			delete(f.replicas, name)
+			f.mutex.Unlock()
+		}
+	}
+
+	for _, name := range names {
+		err := f.pull(name)
+		if err == errResumeTooOld || err == errReplicaDiverged {
+			if err = f.bootstrap(name); err == nil {
+				err = f.pull(name)
+			}
+		}
+		f.mutex.Lock()
+		replica := f.replica(name)
+		replica.Err = err
+		f.mutex.Unlock()
+		if err != nil {
+			log.Printf("Error replicating %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// replica returns the state of a database, creating it if needed. The
+// caller holds f.mutex.
+func (f *Follower) replica(db string) *Replica {
+	replica, ok := f.replicas[db]
+	if !ok {
+		replica = &Replica{}
+		f.replicas[db] = replica
+	}
+	return replica
+}
+
+func (f *Follower) get(path string, query url.Values) (*http.Response, error) {
+	u := f.primary + path
+	if query != nil {
+		u += "?" + query.Encode()
+	}
+	resp, err := f.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errResumeTooOld
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, body)
+	}
+	return resp, nil
+}
+
+func (f *Follower) primaryDatabases() ([]string, error) {
+	resp, err := f.get("/_databases", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := decodeJson(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	list, _ := body["databases"].([]interface{})
+	names := make([]string, 0, len(list))
+	for _, name := range list {
+		if name, ok := name.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// bootstrap replaces a database with a snapshot of the primary's.
+func (f *Follower) bootstrap(db string) error {
+	resp, err := f.get("/"+db+"/_snapshot", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	path := dbFileName(db) + ".snapshot"
+	err = writeDbFile(path, func(w io.Writer) error {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Copied %s from %s", db, f.primary)
+	return replaceDb(db, path)
+}
+
+// pull applies the primary's changes to a database a page at a time until
+// it has them all.
+func (f *Follower) pull(db string) error {
+	if _, err := os.Stat(dbFileName(db)); os.IsNotExist(err) {
+		return errResumeTooOld
+	}
+	for {
+		var since uint64
+		var epoch string
+		err := readDb(db, func(tx *bolt.Tx) error {
+			since, epoch = oplogSeq(tx), dbEpoch(tx)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		from := since
+		if from > 0 {
+			from--
+		}
+		query := url.Values{"since": {strconv.FormatUint(from, 10)}, "limit": {strconv.Itoa(oplogPage)}}
+		resp, err := f.get("/"+db+"/_oplog", query)
+		if err != nil {
+			return err
+		}
+		primarySeq, _ := strconv.ParseUint(resp.Header.Get(oplogSeqHeader), 10, 64)
+		if resp.Header.Get(oplogEpochHeader) != epoch {
+			resp.Body.Close()
+			return errReplicaDiverged
+		}
+		changes, err := readChanges(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if since > 0 && (len(changes) == 0 || changes[0].Seq != since) {
+			return errReplicaDiverged
+		}
+		if err := applyChanges(db, changes); err != nil {
+			return err
+		}
+
+		if len(changes) > 0 {
+			since = changes[len(changes)-1].Seq
+		}
+		f.mutex.Lock()
+		replica := f.replica(db)
+		replica.Seq, replica.PrimarySeq, replica.LastSync = since, primarySeq, time.Now()
+		if since >= primarySeq {
+			replica.CaughtUp = start
+		}
+		f.mutex.Unlock()
+		if len(changes) < oplogPage {
+			return nil
+		}
+	}
+}
+
+// readChanges reads the concatenated entries of an oplog range.
+func readChanges(reader io.Reader) ([]*Change, error) {
+	decoder := codec.NewDecoder(reader, jh)
+	var changes []*Change
+	for {
+		var entry map[interface{}]interface{}
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return changes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		change, err := parseChange(entry)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+}
+
+// applyChanges writes changes read from the primary's oplog to a replica in
+// one transaction.
+func applyChanges(db string, changes []*Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	return updateDb(db, func(tx *bolt.Tx) error {
+		return applyChangesTx(tx, changes)
+	})
+}
+
+// applyChangesTx writes changes from another server's oplog in tx, with
+// their own times. Changes the database already has are skipped once they
+// are found to match its own oplog; any other change must be the next in
+// sequence and log under the same number.
+func applyChangesTx(tx *bolt.Tx, changes []*Change) error {
+	set := txChangeSet(tx)
+	for _, change := range changes {
+		seq := oplogSeq(tx)
+		if change.Seq <= seq {
+			if value := tx.Bucket([]byte(oplogBucket)).Get(oplogKey(change.Seq)); value != nil {
+				local, err := decodeChange(oplogKey(change.Seq), value)
+				if err != nil {
+					return err
+				}
+				if !sameChange(local, change) {
+					return errReplicaDiverged
+				}
+			}
+			continue
+		} else if change.Seq != seq+1 {
+			return errReplicaDiverged
+		}
+		if set != nil {
+			set.at = change.Time
+		}
+		lookupId, err := ParseId(change.Id)
+		if err != nil {
+			return err
+		}
+		bucket, err := openCollection(tx, change.Collection)
+		if err != nil {
+			return err
+		}
+		if change.Op == ChangeDelete {
+			err = deleteDocValue(bucket, lookupId)
+		} else {
+			var encDoc []byte
+			if encDoc, err = encodeChangeDoc(change); err == nil {
+				err = putDocValue(bucket, lookupId, encDoc)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if oplogSeq(tx) != change.Seq {
+			return errReplicaDiverged
+		}
+	}
+	return nil
+}
+
+func encodeChangeDoc(change *Change) ([]byte, error) {
+	if change.doc == nil {
+		return nil, fmt.Errorf("Oplog entry %d has no document", change.Seq)
+	}
+	encDoc, err := encodeDoc(change.doc)
+	if err != nil {
+		return nil, err
+	}
+	return encDoc.Bytes(), nil
+}
+
+// status reports how far behind the primary each database is: the number
+// of changes still to apply, and how long ago the replica last had them
+// all.
+func (f *Follower) status() map[interface{}]interface{} {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	now := time.Now()
+	databases := map[interface{}]interface{}{}
+	for name, replica := range f.replicas {
+		db := map[interface{}]interface{}{
+			"seq":        replica.Seq,
+			"primarySeq": replica.PrimarySeq,
+			"behind":     uint64(0),
+			"lagSeconds": float64(0),
+		}
+		if replica.PrimarySeq > replica.Seq {
+			db["behind"] = replica.PrimarySeq - replica.Seq
+		}
+		if !replica.CaughtUp.IsZero() {
+			db["lagSeconds"] = now.Sub(replica.CaughtUp).Seconds()
+		}
+		if !replica.LastSync.IsZero() {
+			db["lastSync"] = NewDate(replica.LastSync)
+		}
+		if replica.Err != nil {
+			db["error"] = replica.Err.Error()
+		}
+		databases[name] = db
+	}
+	return map[interface{}]interface{}{
+		"role":      "follower",
+		"primary":   f.primary,
+		"databases": databases,
+	}
+}
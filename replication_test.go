@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hooklift/assert"
+)
+
+func dbSeq(t *testing.T, db string) uint64 {
+	var seq uint64
+	assert.Ok(t, readDb(db, func(tx *bolt.Tx) error {
+		seq = oplogSeq(tx)
+		return nil
+	}))
+	return seq
+}
+
+func TestApplyChanges(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "primary", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+	_, err := updateQuery("primary", "users", strings.NewReader(`{"query": {"name": "ada"}, "update": {"admin": true}}`))
+	assert.Ok(t, err)
+	_, err = bulk("primary", "", strings.NewReader(`[{"op": "delete", "collection": "users", "query": {"name": "bob"}}]`))
+	assert.Ok(t, err)
+
+	entries, latest, _, err := oplogRange("primary", 0, 0)
+	assert.Ok(t, err)
+	changes, err := readChanges(bytes.NewReader(entries))
+	assert.Ok(t, err)
+	assert.Equals(t, 4, len(changes))
+
+	// Overlapping pages are applied once.
+	assert.Ok(t, applyChanges("replica", changes[:2]))
+	assert.Ok(t, applyChanges("replica", changes))
+	assert.Ok(t, applyChanges("replica", changes[1:]))
+	assert.Equals(t, latest, dbSeq(t, "replica"))
+
+	assert.Equals(t, 1, countDocs(t, "replica", "users", `{}`))
+	primaryDoc, err := findDoc("primary", "users", changes[0].Id)
+	assert.Ok(t, err)
+	replicaDoc, err := findDoc("replica", "users", changes[0].Id)
+	assert.Ok(t, err)
+	expected, err := decodeJson(primaryDoc)
+	assert.Ok(t, err)
+	actual, err := decodeJson(replicaDoc)
+	assert.Ok(t, err)
+	assert.Equals(t, expected, actual)
+
+	// The replica logs the changes under the primary's sequence numbers.
+	replicated, err := oplogChanges(t, "replica", 2)
+	assert.Ok(t, err)
+	assert.Equals(t, 2, len(replicated))
+	assert.Equals(t, ChangeDelete, replicated[1].Op)
+	assert.Equals(t, changes[3].Id, replicated[1].Id)
+
+	// A replica missing changes is not patched.
+	assert.Equals(t, errReplicaDiverged, applyChanges("gap", changes[2:]))
+	assert.Equals(t, uint64(0), dbSeq(t, "gap"))
+
+	// Nor is one whose changes differ from the primary's under the same
+	// sequence numbers, as after the primary is restored.
+	insertTestDocs(t, "restored", "users", `{"name": "ada"}`, `{"name": "cy"}`, `{"name": "dee"}`)
+	entries, _, _, err = oplogRange("restored", 0, 0)
+	assert.Ok(t, err)
+	other, err := readChanges(bytes.NewReader(entries))
+	assert.Ok(t, err)
+	assert.Equals(t, errReplicaDiverged, applyChanges("replica", other))
+	assert.Equals(t, latest, dbSeq(t, "replica"))
+
+	// Restoring a database gives it a new epoch.
+	var epoch string
+	epochOf := func(db string) string {
+		assert.Ok(t, readDb(db, func(tx *bolt.Tx) error {
+			epoch = dbEpoch(tx)
+			return nil
+		}))
+		return epoch
+	}
+	var backup bytes.Buffer
+	assert.Ok(t, backupDb("primary", &backup, false))
+	assert.Ok(t, restoreDb("primary", &backup))
+	assert.Cond(t, epochOf("primary") != epochOf("replica"), "a restored database should have a new epoch")
+}
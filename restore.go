@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A database is restored from a file sent by the backup endpoint, gzipped
+// or not, and cloned from a consistent copy of another database. The new
+// file is written next to the database, checked and then moved in place,
+// so a bad upload leaves the database as it was. Clones leave webhooks
+// behind, so that a staging copy does not post to production receivers.
+var (
+	errDbExists         = errors.New("Database already exists")
+	errInvalidDbName    = errors.New("Database names can't be empty, start with _ or . or contain slashes")
+	errRestoreInCluster = errors.New("Databases can't be restored in a cluster")
+	errDbFileTruncated  = errors.New("Database file is truncated")
+)
+
+// maxCheckErrors is the number of consistency errors reported for a file.
+const maxCheckErrors = 10
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func validDbName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// checkDbFile runs bolt's consistency check on a database file. Files that
+// are not bolt databases, are truncated or point to missing pages are
+// refused, but bolt trusts page headers, and some damage to them, such as a
+// zeroed branch page, can still make it loop.
+func checkDbFile(path string) (err error) {
+	// Bolt panics on some malformed files, or faults on pages it misreads,
+	// rather than returning an error.
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Database file is corrupt: %v", r)
+		}
+	}()
+	// Opening grows the file, so its size is taken first.
+	size := fileSize(path)
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Size() > size {
+			return errDbFileTruncated
+		}
+		// Check reads the file in a goroutine of its own, where a fault
+		// would end the process, so the pages are read here first.
+		err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return walkBucket(b)
+		})
+		if err != nil {
+			return err
+		}
+		var problems []string
+		for err := range tx.Check() {
+			if len(problems) < maxCheckErrors {
+				problems = append(problems, err.Error())
+			}
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("Database file failed its consistency check: %s", strings.Join(problems, "; "))
+		}
+		return nil
+	})
+}
+
+func walkBucket(b *bolt.Bucket) error {
+	return b.ForEach(func(k []byte, v []byte) error {
+		if child := b.Bucket(k); v == nil && child != nil {
+			return walkBucket(child)
+		}
+		return nil
+	})
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// restoreDb replaces a database, or creates it, with the file read from
+// reader once it passes the consistency check.
+func restoreDb(name string, reader io.Reader) error {
+	if !validDbName(name) {
+		return errInvalidDbName
+	}
+	if cluster != nil {
+		return errRestoreInCluster
+	}
+	buffered := bufio.NewReader(reader)
+	if magic, _ := buffered.Peek(len(gzipMagic)); string(magic) == string(gzipMagic) {
+		zr, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		reader = zr
+	} else {
+		reader = buffered
+	}
+
+	path := dbFileName(name) + ".restore"
+	err := writeDbFile(path, func(w io.Writer) error {
+		_, err := io.Copy(w, reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkDbFile(path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := renewEpoch(path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return replaceDb(name, path)
+}
+
+// cloneDb creates the database target from a consistent copy of source.
+// In a cluster the clone records the index of the entry it applies.
+func cloneDb(source string, target string, index uint64) error {
+	c, err := beginCopy(source)
+	if err != nil {
+		return err
+	}
+	path := dbFileName(target) + ".clone"
+	err = writeDbFile(path, func(w io.Writer) error {
+		_, err := c.WriteTo(w)
+		return err
+	})
+	c.Close()
+	if err == nil {
+		err = prepareClone(path, index)
+	}
+	if err == nil {
+		err = addDb(target, path)
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+func prepareClone(path string, index uint64) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(webhooksBucket)) != nil {
+			if err := tx.DeleteBucket([]byte(webhooksBucket)); err != nil {
+				return err
+			}
+		}
+		if index > 0 {
+			return setDbIndex(tx, index)
+		}
+		return nil
+	})
+}
+
+// createClone clones a database through the cluster log in a cluster.
+func createClone(source string, target string) error {
+	if !validDbName(target) {
+		return errInvalidDbName
+	}
+	if _, err := os.Stat(dbFileName(source)); os.IsNotExist(err) {
+		return errDbNotFound
+	}
+	if _, err := os.Stat(dbFileName(target)); err == nil {
+		return errDbExists
+	}
+	if cluster != nil {
+		return cluster.proposeApplied(&RaftEntry{Type: RaftCloneDb, Db: target, Source: source})
+	}
+	return cloneDb(source, target, 0)
+}
+
+// writeDbFile writes a database file with write and syncs it, removing it
+// if anything fails.
+func writeDbFile(path string, write func(io.Writer) error) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/hooklift/assert"
+)
+
+func TestRestore(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+	var compressed, plain bytes.Buffer
+	assert.Ok(t, backupDb("app", &compressed, true))
+	assert.Ok(t, backupDb("app", &plain, false))
+	insertTestDocs(t, "app", "users", `{"name": "cy"}`)
+
+	assert.Ok(t, restoreDb("app", bytes.NewReader(compressed.Bytes())))
+	assert.Equals(t, 2, countDocs(t, "app", "users", `{}`))
+	assert.Ok(t, restoreDb("copy", bytes.NewReader(plain.Bytes())))
+	assert.Equals(t, 2, countDocs(t, "copy", "users", `{}`))
+
+	// Bad files leave the database as it was.
+	bad := [][]byte{[]byte("not a database")}
+	for n := 3 * 4096; n < plain.Len(); n += 4096 {
+		bad = append(bad, plain.Bytes()[:n-100])
+	}
+	for _, file := range bad {
+		assert.Cond(t, restoreDb("app", bytes.NewReader(file)) != nil, "a bad file should not be restored")
+		assert.Equals(t, 2, countDocs(t, "app", "users", `{}`))
+	}
+	_, err := os.Stat(dbFileName("app") + ".restore")
+	assert.Cond(t, os.IsNotExist(err), "the uploaded file should be removed")
+	assert.Equals(t, errInvalidDbName, restoreDb("../app", bytes.NewReader(plain.Bytes())))
+}
+
+func TestClone(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+	assert.Ok(t, updateDb("app", func(tx *bolt.Tx) error {
+		return applyWebhook(tx, RaftPutWebhook, map[interface{}]interface{}{"_id": "hook", "url": "http://example.com"})
+	}))
+
+	assert.Ok(t, createClone("app", "staging"))
+	assert.Equals(t, 2, countDocs(t, "staging", "users", `{}`))
+	assert.Ok(t, readDb("staging", func(tx *bolt.Tx) error {
+		assert.Cond(t, tx.Bucket([]byte(webhooksBucket)) == nil, "webhooks should not be cloned")
+		return nil
+	}))
+
+	// The clone is a database of its own.
+	_, err := insertDoc("staging", "users", strings.NewReader(`{"name": "cy"}`))
+	assert.Ok(t, err)
+	assert.Equals(t, 2, countDocs(t, "app", "users", `{}`))
+
+	assert.Equals(t, errDbExists, createClone("app", "staging"))
+	assert.Equals(t, errDbNotFound, createClone("missing", "other"))
+	assert.Equals(t, errInvalidDbName, createClone("app", "_other"))
+}
+
+func TestRestoreWaitsForReads(t *testing.T) {
+	defer withTestDir(t)()
+	insertTestDocs(t, "app", "users", `{"name": "ada"}`)
+	var backup bytes.Buffer
+	assert.Ok(t, backupDb("app", &backup, false))
+	insertTestDocs(t, "app", "users", `{"name": "bob"}`)
+
+	release := holdRead(t, "app", "users")
+	n := waitsFor(t, release, func() error {
+		return restoreDb("app", &backup)
+	})
+	assert.Equals(t, 2, n)
+	assert.Equals(t, 1, countDocs(t, "app", "users", `{}`))
+
+	release = holdRead(t, "app", "users")
+	waitsFor(t, release, func() error {
+		return deleteDb("app")
+	})
+	_, err := os.Stat(dbFileName("app"))
+	assert.Cond(t, os.IsNotExist(err), "the database should be deleted")
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"flag"
 	"log"
-
-	"github.com/boltdb/bolt"
+	"os"
+	"strings"
+	"sync"
 )
 
 // Database map
-var dbs map[string]*bolt.DB = make(map[string]*bolt.DB)
+var dbs map[string]*openDb = make(map[string]*openDb)
+var dbsMutex sync.Mutex
 
 // Root data directory
 var rootDir string
@@ -16,14 +18,75 @@ var rootDir string
 func main() {
 	var dir string
 	var bind string
+	var clusterId, clusterPeers string
+	var backupSchedule string
+	var list, verify bool
 	flag.StringVar(&dir, "dir", "", "(HTTP server) database directory")
 	flag.StringVar(&bind, "bind", ":8888", "(HTTP server) listening address")
+	flag.DurationVar(&idempotencyRetention, "idempotency-retention", idempotencyRetention, "(HTTP server) how long idempotency keys are remembered")
+	flag.DurationVar(&oplogRetention, "oplog-retention", oplogRetention, "(HTTP server) how long changes are kept in the oplog, 0 keeps them all")
+	flag.StringVar(&following, "follow", "", "(HTTP server) URL of a primary to replicate, serving read-only")
+	flag.DurationVar(&followInterval, "follow-interval", followInterval, "(HTTP server) how often a follower polls the primary")
+	flag.StringVar(&clusterId, "cluster-id", "", "(HTTP server) id of this server in a cluster")
+	flag.StringVar(&clusterPeers, "cluster-peers", "", "(HTTP server) members of a new cluster, as id=url pairs separated by commas")
+	flag.StringVar(&backupDir, "backup-dir", "", "(HTTP server) directory of scheduled backups")
+	flag.StringVar(&backupSchedule, "backup-schedule", "", "(HTTP server) when to back up every database, as a cron expression such as \"0 3 * * *\" or @daily")
+	flag.IntVar(&backupKeepLast, "backup-keep-last", 0, "(HTTP server) number of latest backups to keep")
+	flag.IntVar(&backupKeepDaily, "backup-keep-daily", 0, "(HTTP server) number of days to keep the latest backup of, 0 with -backup-keep-last=0 keeps all backups")
+	flag.DurationVar(&oplogArchiveInterval, "oplog-archive-interval", 0, "(HTTP server) how often the oplog of every database is archived to -backup-dir for point-in-time recovery, 0 does not archive it")
+	flag.BoolVar(&list, "list-backups", false, "list the backups in -backup-dir and exit")
+	flag.BoolVar(&verify, "verify-backups", false, "verify the checksums of the backups in -backup-dir and exit")
 	flag.Parse()
 
+	if list || verify {
+		if backupDir == "" {
+			log.Fatal("Please specify the backup directory, for example -backup-dir=/tmp/backups")
+		}
+		os.Exit(backupCommand(backupDir, verify))
+	}
 	if dir == "" {
 		log.Fatal("Please specify database directory, for example -dir=/tmp/db")
 	}
 	rootDir = dir
 
+	if clusterId != "" {
+		if following != "" {
+			log.Fatal("A server cannot both follow a primary and be in a cluster")
+		}
+		if err := startCluster(clusterId, clusterPeers); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if following != "" {
+		following = strings.TrimRight(following, "/")
+		follower = NewFollower(following)
+		go follower.run(followInterval)
+	} else {
+		go webhooks.run()
+	}
+
+	if backupSchedule != "" {
+		if backupDir == "" {
+			log.Fatal("Please specify where scheduled backups go, for example -backup-dir=/tmp/backups")
+		}
+		schedule, err := parseSchedule(backupSchedule)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.MkdirAll(backupDir, 0700); err != nil {
+			log.Fatal(err)
+		}
+		go runBackups(backupDir, schedule)
+	}
+	if oplogArchiveInterval > 0 {
+		if backupDir == "" {
+			log.Fatal("Please specify where the oplog is archived, for example -backup-dir=/tmp/backups")
+		}
+		if oplogRetention > 0 && oplogRetention < oplogArchiveInterval {
+			log.Printf("-oplog-retention=%s is shorter than -oplog-archive-interval=%s, so changes may be pruned before they are archived", oplogRetention, oplogArchiveInterval)
+		}
+		go runOplogArchive(backupDir, oplogArchiveInterval)
+	}
+
 	StartHttp(bind)
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/boltdb/bolt"
+)
+
+// A Transaction is a list of checks and bulk operations applied together in
+// a single bolt write transaction:
+//
+//	{
+//		"checks": [{"collection": "accounts", "id": "...", "query": {"balance": {"$gte": 100}}}],
+//		"ops": [
+//			{"op": "update", "collection": "accounts", "id": "...", "update": {...}},
+//			{"op": "insert", "collection": "transfers", "doc": {...}}
+//		]
+//	}
+//
+// If any check fails or any operation fails, nothing is written.
+type Transaction struct {
+	checks []*TxCheck
+	ops    []*BulkOp
+}
+
+// A TxCheck requires that a document exists, or with "exists": false that
+// none does. The document is the one with the given id, the documents
+// matching the query, or both; with "rev" it must also be at that revision.
+type TxCheck struct {
+	Collection string
+
+	id     string
+	query  map[interface{}]interface{}
+	rev    uint64
+	exists bool
+}
+
+var errTxCheckFailed = errors.New("Transaction check failed")
+
+func parseTxCheck(v interface{}) (*TxCheck, error) {
+	spec, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("Transaction checks must be objects")
+	}
+	check := &TxCheck{exists: true}
+	check.Collection, _ = spec["collection"].(string)
+	if check.Collection == "" {
+		return nil, errors.New("Transaction checks require a collection")
+	}
+	check.id, _ = spec["id"].(string)
+	check.query, _ = spec["query"].(map[interface{}]interface{})
+	if check.id == "" && check.query == nil {
+		return nil, errors.New("Transaction checks require an id or a query")
+	}
+	if rev, ok := spec["rev"]; ok {
+		r, ok := intValue(rev)
+		if !ok || r < 1 {
+			return nil, errors.New("Transaction check rev must be a positive integer")
+		}
+		check.rev = uint64(r)
+	}
+	if exists, ok := spec["exists"].(bool); ok {
+		check.exists = exists
+	}
+	return check, nil
+}
+
+func (check *TxCheck) verify(tx *bolt.Tx) error {
+	found := false
+	bucket, err := collectionBucket(tx, check.Collection)
+	if err != nil {
+		return err
+	}
+	if bucket != nil {
+		query := map[interface{}]interface{}{}
+		if check.query != nil {
+			query = withoutField(check.query, "limit")
+		}
+		if check.id != "" {
+			query["_id"] = check.id
+		}
+		_, err = runQuery(bucket, query, func(bucket *bolt.Bucket, key []byte, value []byte, doc map[interface{}]interface{}) error {
+			if check.rev == 0 || checkRev(value, check.rev) == nil {
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if found != check.exists {
+		return errTxCheckFailed
+	}
+	return nil
+}
+
+// add appends the checks and operations of a request body to t.
+func (t *Transaction) add(reader io.Reader) error {
+	request, err := decodeJson(reader)
+	if err != nil {
+		return err
+	}
+	checks, _ := request["checks"].([]interface{})
+	ops, _ := request["ops"].([]interface{})
+	if request["checks"] != nil && checks == nil || request["ops"] != nil && ops == nil {
+		return errors.New("Transaction checks and ops must be arrays")
+	}
+
+	var parsedChecks []*TxCheck
+	for _, v := range checks {
+		check, err := parseTxCheck(v)
+		if err != nil {
+			return err
+		}
+		parsedChecks = append(parsedChecks, check)
+	}
+	var parsedOps []*BulkOp
+	for i, v := range ops {
+		op, err := parseBulkOp(v)
+		if err != nil {
+			return fmt.Errorf("Operation %d: %s", i, err)
+		}
+		parsedOps = append(parsedOps, op)
+	}
+	t.checks = append(t.checks, parsedChecks...)
+	t.ops = append(t.ops, parsedOps...)
+	return nil
+}
+
+// commit runs the checks, then the operations, in one write transaction.
+// A failed check is reported with errTxCheckFailed and a failed operation
+// in the result items; either rolls everything back.
+func (t *Transaction) commit(db string) (*BulkResult, error) {
+	result := &BulkResult{}
+	err := updateDb(db, func(tx *bolt.Tx) error {
+		for i, check := range t.checks {
+			if err := check.verify(tx); err != nil {
+				result.Items = append(result.Items, map[interface{}]interface{}{"check": uint64(i), "error": err.Error()})
+				return err
+			}
+		}
+		return applyBulkOps(tx, t.ops, BulkTransaction, result)
+	})
+	if err == errBulkRolledBack {
+		err = nil
+	}
+	return result, err
+}
+
+func runTransaction(db string, reader io.Reader) (*BulkResult, error) {
+	t := &Transaction{}
+	if err := t.add(reader); err != nil {
+		return nil, err
+	}
+	return t.commit(db)
+}
+
+// Interactive transactions collect checks and operations over several
+// requests and apply them on commit. They are kept in memory and dropped
+// when they are not committed within their timeout.
+const (
+	defaultTxTimeout = 30 * time.Second
+	maxTxTimeout     = 5 * time.Minute
+)
+
+var errTxNotFound = errors.New("Transaction not found, it may have timed out")
+
+type openTransaction struct {
+	Transaction
+	db    string
+	timer *time.Timer
+}
+
+var (
+	txMutex sync.Mutex
+	openTxs = map[string]*openTransaction{}
+)
+
+// beginTransaction starts an interactive transaction, with an optional
+// {"timeout": seconds} body, and returns its id.
+func beginTransaction(db string, reader io.Reader) (string, time.Time, error) {
+	timeout := defaultTxTimeout
+	if request, err := decodeJson(reader); err == nil {
+		if v, ok := request["timeout"]; ok {
+			seconds, ok := floatValue(v)
+			if !ok || seconds <= 0 {
+				return "", time.Time{}, errors.New("Transaction timeout must be a positive number of seconds")
+			}
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+	} else if err != io.EOF {
+		return "", time.Time{}, err
+	}
+	if timeout > maxTxTimeout {
+		timeout = maxTxTimeout
+	}
+
+	id := uuid.New()
+	txMutex.Lock()
+	defer txMutex.Unlock()
+	openTxs[id] = &openTransaction{
+		db: db,
+		timer: time.AfterFunc(timeout, func() {
+			takeTransaction(db, id)
+		}),
+	}
+	return id, time.Now().Add(timeout), nil
+}
+
+// takeTransaction removes an open transaction so that only one request can
+// commit or abort it.
+func takeTransaction(db string, id string) (*openTransaction, error) {
+	txMutex.Lock()
+	defer txMutex.Unlock()
+	t, ok := openTxs[id]
+	if !ok || t.db != db {
+		return nil, errTxNotFound
+	}
+	delete(openTxs, id)
+	t.timer.Stop()
+	return t, nil
+}
+
+func addToTransaction(db string, id string, reader io.Reader) error {
+	// The body is read before locking so that a slow client does not hold
+	// up other transactions.
+	added := &Transaction{}
+	if err := added.add(reader); err != nil {
+		return err
+	}
+
+	txMutex.Lock()
+	defer txMutex.Unlock()
+	t, ok := openTxs[id]
+	if !ok || t.db != db {
+		return errTxNotFound
+	}
+	t.checks = append(t.checks, added.checks...)
+	t.ops = append(t.ops, added.ops...)
+	return nil
+}
+
+func commitTransaction(db string, id string) (*BulkResult, error) {
+	t, err := takeTransaction(db, id)
+	if err != nil {
+		return nil, err
+	}
+	return t.commit(db)
+}
+
+func abortTransaction(db string, id string) error {
+	_, err := takeTransaction(db, id)
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+func insertAccount(t *testing.T, name string, balance int) string {
+	encDoc, err := insertDoc("bank", "accounts", strings.NewReader(fmt.Sprintf(`{"name": %q, "balance": %d}`, name, balance)))
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc.Bytes())
+	assert.Ok(t, err)
+	return doc["_id"].(string)
+}
+
+func transfer(from string, to string, amount string) string {
+	return `{
+		"checks": [{"collection": "accounts", "id": "` + from + `", "query": {"balance": {"$gte": ` + amount + `}}}],
+		"ops": [
+			{"op": "update", "collection": "accounts", "id": "` + from + `", "update": {"balance": {"$expr": {"$subtract": ["$balance", ` + amount + `]}}}},
+			{"op": "update", "collection": "accounts", "id": "` + to + `", "update": {"balance": {"$expr": {"$add": ["$balance", ` + amount + `]}}}},
+			{"op": "insert", "collection": "transfers", "doc": {"from": "` + from + `", "to": "` + to + `", "amount": ` + amount + `}}
+		]
+	}`
+}
+
+func balance(t *testing.T, id string) interface{} {
+	encDoc, err := findDoc("bank", "accounts", id)
+	assert.Ok(t, err)
+	doc, err := decodeJson(encDoc)
+	assert.Ok(t, err)
+	return doc["balance"]
+}
+
+func TestTransaction(t *testing.T) {
+	defer withTestDir(t)()
+	ada := insertAccount(t, "ada", 300)
+	bob := insertAccount(t, "bob", 100)
+
+	result, err := runTransaction("bank", strings.NewReader(transfer(ada, bob, "200")))
+	assert.Ok(t, err)
+	assert.Cond(t, result.Committed, "the transfer should commit")
+	assert.Equals(t, uint64(100), balance(t, ada))
+	assert.Equals(t, uint64(300), balance(t, bob))
+
+	_, err = runTransaction("bank", strings.NewReader(transfer(ada, bob, "200")))
+	assert.Equals(t, errTxCheckFailed, err)
+	assert.Equals(t, uint64(100), balance(t, ada))
+	assert.Equals(t, 1, countDocs(t, "bank", "transfers", `{}`))
+
+	// A failing operation rolls back the operations before it.
+	missing, _, err := NewId()
+	assert.Ok(t, err)
+	result, err = runTransaction("bank", strings.NewReader(transfer(ada, missing, "50")))
+	assert.Ok(t, err)
+	assert.Cond(t, !result.Committed, "the transfer should roll back")
+	assert.Equals(t, uint64(100), balance(t, ada))
+}
+
+func TestInteractiveTransaction(t *testing.T) {
+	defer withTestDir(t)()
+	ada := insertAccount(t, "ada", 300)
+	bob := insertAccount(t, "bob", 100)
+
+	id, _, err := beginTransaction("bank", strings.NewReader(""))
+	assert.Ok(t, err)
+	assert.Ok(t, addToTransaction("bank", id, strings.NewReader(`{"checks": [{"collection": "accounts", "id": "`+ada+`", "rev": 1}]}`)))
+	assert.Ok(t, addToTransaction("bank", id, strings.NewReader(transfer(ada, bob, "100"))))
+	assert.Equals(t, uint64(300), balance(t, ada))
+
+	result, err := commitTransaction("bank", id)
+	assert.Ok(t, err)
+	assert.Cond(t, result.Committed, "the transaction should commit")
+	assert.Equals(t, uint64(200), balance(t, ada))
+	_, err = commitTransaction("bank", id)
+	assert.Equals(t, errTxNotFound, err)
+
+	id, _, err = beginTransaction("bank", strings.NewReader(`{"timeout": 0.01}`))
+	assert.Ok(t, err)
+	assert.Ok(t, addToTransaction("bank", id, strings.NewReader(transfer(ada, bob, "100"))))
+	time.Sleep(50 * time.Millisecond)
+	_, err = commitTransaction("bank", id)
+	assert.Equals(t, errTxNotFound, err)
+	assert.Equals(t, uint64(200), balance(t, ada))
+
+	id, _, err = beginTransaction("bank", strings.NewReader(""))
+	assert.Ok(t, err)
+	assert.Ok(t, abortTransaction("bank", id))
+	assert.Equals(t, errTxNotFound, addToTransaction("bank", id, strings.NewReader(`{}`)))
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// A webhook posts the changes of a collection that match its filter to a
+// URL. Webhooks are stored in the "_webhooks" bucket of their database with
+// their position, the sequence number of the last change they handled, so
+// the oplog is their queue: a worker per webhook reads the changes after
+// the position, posts those that match in order and moves the position past
+// each. A failed post is retried with exponential backoff up to the
+// webhook's number of attempts, then skipped. Workers resume from the
+// stored position after a restart, so a change is posted at least once and
+// receivers tell repeats apart by its sequence number.
+//
+// With a secret, the Rtd-Signature header of each post holds "sha256="
+// followed by the hex HMAC-SHA256 of the body. Only the server taking
+// writes posts: followers never do, and in a cluster the leader does, with
+// webhooks and their positions going through the Raft log.
+const webhooksBucket = "_webhooks"
+
+const (
+	webhookHeader   = "Rtd-Webhook"
+	signatureHeader = "Rtd-Signature"
+)
+
+// Operations on the webhooks of a database, also used as cluster log entry
+// types. A progress update is dropped if the webhook was deleted meanwhile.
+const (
+	RaftPutWebhook      = "putWebhook"
+	RaftDeleteWebhook   = "deleteWebhook"
+	RaftWebhookProgress = "webhookProgress"
+)
+
+var (
+	// webhookPoll is how long an idle worker waits before reading the oplog
+	// again, unless a write wakes it first.
+	webhookPoll = time.Second
+	// webhookScan is how often the databases are scanned for webhooks
+	// created by other servers of a cluster.
+	webhookScan    = 10 * time.Second
+	webhookTimeout = 10 * time.Second
+)
+
+var errWebhookNotFound = errors.New("Webhook not found")
+
+type Webhook struct {
+	Id         string
+	Db         string
+	Collection string
+	URL        string
+	Secret     string
+	Filter     map[interface{}]interface{}
+
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+
+	Seq          uint64
+	Delivered    uint64
+	Failed       uint64
+	LastError    string
+	LastDelivery time.Time
+}
+
+// doc returns the webhook as stored, or as shown to clients, who get
+// whether it is signed but not its secret.
+func (hook *Webhook) doc(withSecret bool) map[interface{}]interface{} {
+	doc := map[interface{}]interface{}{
+		"_id":        hook.Id,
+		"collection": hook.Collection,
+		"url":        hook.URL,
+		"retry": map[interface{}]interface{}{
+			"maxAttempts": uint64(hook.MaxAttempts),
+			"backoff":     hook.Backoff.Seconds(),
+			"maxBackoff":  hook.MaxBackoff.Seconds(),
+		},
+		"seq":       hook.Seq,
+		"delivered": hook.Delivered,
+		"failed":    hook.Failed,
+	}
+	if hook.Filter != nil {
+		doc["filter"] = hook.Filter
+	}
+	if withSecret {
+		if hook.Secret != "" {
+			doc["secret"] = hook.Secret
+		}
+	} else {
+		doc["signed"] = hook.Secret != ""
+	}
+	if hook.LastError != "" {
+		doc["lastError"] = hook.LastError
+	}
+	if !hook.LastDelivery.IsZero() {
+		doc["lastDelivery"] = NewDate(hook.LastDelivery)
+	}
+	return doc
+}
+
+// parseWebhook reads a webhook of db from a stored document or a client
+// request, checking its URL, filter and retry policy.
+func parseWebhook(db string, doc map[interface{}]interface{}) (*Webhook, error) {
+	hook := &Webhook{
+		Db:          db,
+		MaxAttempts: 8,
+		Backoff:     time.Second,
+		MaxBackoff:  5 * time.Minute,
+	}
+	hook.Id, _ = doc["_id"].(string)
+	hook.Collection, _ = doc["collection"].(string)
+	hook.URL, _ = doc["url"].(string)
+	hook.Secret, _ = doc["secret"].(string)
+	if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid webhook url %q", hook.URL)
+	}
+	if filter, ok := doc["filter"]; ok {
+		if hook.Filter, ok = filter.(map[interface{}]interface{}); !ok {
+			return nil, errors.New("A webhook filter must be an object")
+		}
+		if _, err := newChangeSubscriber(db, hook.Collection, hook.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	if retry, ok := doc["retry"]; ok {
+		policy, ok := retry.(map[interface{}]interface{})
+		if !ok {
+			return nil, errors.New("A webhook retry policy must be an object")
+		}
+		if v, ok := policy["maxAttempts"]; ok {
+			attempts, ok := intValue(v)
+			if !ok || attempts < 1 {
+				return nil, errors.New("maxAttempts must be a positive integer")
+			}
+			hook.MaxAttempts = int(attempts)
+		}
+		for field, d := range map[string]*time.Duration{"backoff": &hook.Backoff, "maxBackoff": &hook.MaxBackoff} {
+			if v, ok := policy[field]; ok {
+				seconds, ok := floatValue(v)
+				if !ok || seconds < 0 {
+					return nil, fmt.Errorf("%s must be a number of seconds", field)
+				}
+				*d = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+
+	seq, _ := intValue(doc["seq"])
+	delivered, _ := intValue(doc["delivered"])
+	failed, _ := intValue(doc["failed"])
+	hook.Seq, hook.Delivered, hook.Failed = uint64(seq), uint64(delivered), uint64(failed)
+	hook.LastError, _ = doc["lastError"].(string)
+	hook.LastDelivery, _ = dateValue(doc["lastDelivery"])
+	return hook, nil
+}
+
+// backoff returns how long to wait after the given failed attempt.
+func (hook *Webhook) backoff(attempt int) time.Duration {
+	d := hook.Backoff
+	for i := 1; i < attempt && d < hook.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > hook.MaxBackoff {
+		d = hook.MaxBackoff
+	}
+	return d
+}
+
+// createWebhook registers a webhook for the changes of a collection made
+// from now on.
+func createWebhook(db string, collection string, reader io.Reader) ([]byte, error) {
+	doc, err := decodeJson(reader)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range []string{"_id", "collection", "seq", "delivered", "failed", "lastError", "lastDelivery"} {
+		if _, ok := doc[field]; ok {
+			return nil, fmt.Errorf("Can't set %s, it is maintained by the database", field)
+		}
+	}
+	doc["collection"] = collection
+	if doc["_id"], _, err = NewId(); err != nil {
+		return nil, err
+	}
+	hook, err := parseWebhook(db, doc)
+	if err != nil {
+		return nil, err
+	}
+	err = readDb(db, func(tx *bolt.Tx) error {
+		hook.Seq = oplogSeq(tx)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := saveWebhook(hook, RaftPutWebhook); err != nil {
+		return nil, err
+	}
+	webhooks.start(db, hook.Id)
+
+	encHook, err := encodeDoc(hook.doc(false))
+	if err != nil {
+		return nil, err
+	}
+	return encHook.Bytes(), nil
+}
+
+func listWebhooks(db string, collection string) ([]byte, error) {
+	var result []byte
+	err := readDb(db, func(tx *bolt.Tx) error {
+		hooks, err := loadWebhooks(tx, db)
+		if err != nil {
+			return err
+		}
+		for _, hook := range hooks {
+			if hook.Collection != collection {
+				continue
+			}
+			encHook, err := encodeDoc(hook.doc(false))
+			if err != nil {
+				return err
+			}
+			result = append(result, encHook.Bytes()...)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func deleteWebhook(db string, collection string, id string) error {
+	hook, err := loadWebhook(db, id)
+	if err != nil {
+		return err
+	}
+	if hook.Collection != collection {
+		return errWebhookNotFound
+	}
+	return saveWebhook(hook, RaftDeleteWebhook)
+}
+
+// saveWebhook stores, deletes or updates the position of a webhook, through
+// the cluster log in a cluster.
+func saveWebhook(hook *Webhook, op string) error {
+	if cluster != nil {
+		return cluster.proposeApplied(&RaftEntry{Type: op, Db: hook.Db, Webhook: hook.doc(true)})
+	}
+	return updateDb(hook.Db, func(tx *bolt.Tx) error {
+		return applyWebhook(tx, op, hook.doc(true))
+	})
+}
+
+func applyWebhook(tx *bolt.Tx, op string, doc map[interface{}]interface{}) error {
+	id, _ := doc["_id"].(string)
+	bucket, err := tx.CreateBucketIfNotExists([]byte(webhooksBucket))
+	if err != nil {
+		return err
+	}
+	switch op {
+	case RaftDeleteWebhook:
+		return bucket.Delete([]byte(id))
+	case RaftWebhookProgress:
+		if bucket.Get([]byte(id)) == nil {
+			return nil
+		}
+	}
+	encHook, err := encodeDoc(doc)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(id), encHook.Bytes())
+}
+
+func loadWebhooks(tx *bolt.Tx, db string) ([]*Webhook, error) {
+	bucket := tx.Bucket([]byte(webhooksBucket))
+	if bucket == nil {
+		return nil, nil
+	}
+	var hooks []*Webhook
+	err := bucket.ForEach(func(k []byte, v []byte) error {
+		doc, err := decodeJson(v)
+		if err != nil {
+			return err
+		}
+		hook, err := parseWebhook(db, doc)
+		if err != nil {
+			return err
+		}
+		hooks = append(hooks, hook)
+		return nil
+	})
+	return hooks, err
+}
+
+// loadWebhook reads a webhook, without creating its database if it was
+// deleted.
+func loadWebhook(db string, id string) (*Webhook, error) {
+	if _, err := os.Stat(dbFileName(db)); os.IsNotExist(err) {
+		return nil, errWebhookNotFound
+	}
+	var hook *Webhook
+	err := readDb(db, func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(webhooksBucket))
+		if bucket == nil {
+			return errWebhookNotFound
+		}
+		v := bucket.Get([]byte(id))
+		if v == nil {
+			return errWebhookNotFound
+		}
+		doc, err := decodeJson(v)
+		if err != nil {
+			return err
+		}
+		hook, err = parseWebhook(db, doc)
+		return err
+	})
+	return hook, err
+}
+
+// deliversWebhooks reports whether this server posts webhooks.
+func deliversWebhooks() bool {
+	return following == "" && (cluster == nil || cluster.awaitLeadership())
+}
+
+// A WebhookDispatcher runs a worker for each webhook.
+type WebhookDispatcher struct {
+	client *http.Client
+
+	mutex   sync.Mutex
+	workers map[string]*webhookWorker
+	wg      sync.WaitGroup
+	stopped chan struct{}
+}
+
+type webhookWorker struct {
+	db   string
+	id   string
+	wake chan struct{}
+}
+
+var webhooks = NewWebhookDispatcher()
+
+func NewWebhookDispatcher() *WebhookDispatcher {
+	return &WebhookDispatcher{
+		client:  &http.Client{Timeout: webhookTimeout},
+		workers: map[string]*webhookWorker{},
+		stopped: make(chan struct{}),
+	}
+}
+
+// run starts workers for the webhooks of every database, and for those
+// created by other servers as they appear, until the dispatcher stops.
+func (d *WebhookDispatcher) run() {
+	for {
+		if err := d.scan(); err != nil {
+			log.Printf("Error looking for webhooks: %s", err)
+		}
+		select {
+		case <-time.After(webhookScan):
+		case <-d.stopped:
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) scan() error {
+	names, err := listDatabases()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var hooks []*Webhook
+		err := readDb(name, func(tx *bolt.Tx) error {
+			var err error
+			hooks, err = loadWebhooks(tx, name)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, hook := range hooks {
+			d.start(name, hook.Id)
+		}
+	}
+	return nil
+}
+
+// stop stops the workers and waits for them to finish.
+func (d *WebhookDispatcher) stop() {
+	close(d.stopped)
+	d.wg.Wait()
+}
+
+// start runs a worker for a webhook unless it has one.
+func (d *WebhookDispatcher) start(db string, id string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	key := db + "/" + id
+	if _, ok := d.workers[key]; ok {
+		return
+	}
+	select {
+	case <-d.stopped:
+		return
+	default:
+	}
+	w := &webhookWorker{db: db, id: id, wake: make(chan struct{}, 1)}
+	d.workers[key] = w
+	d.wg.Add(1)
+	go d.work(w)
+}
+
+// notify wakes the workers of a database after a write.
+func (d *WebhookDispatcher) notify(db string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, w := range d.workers {
+		if w.db != db {
+			continue
+		}
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// work delivers the changes for a webhook until it is deleted or the
+// dispatcher stops.
+func (d *WebhookDispatcher) work(w *webhookWorker) {
+	defer d.wg.Done()
+	defer func() {
+		d.mutex.Lock()
+		delete(d.workers, w.db+"/"+w.id)
+		d.mutex.Unlock()
+	}()
+	for {
+		more := false
+		if deliversWebhooks() {
+			hook, err := loadWebhook(w.db, w.id)
+			if err == errWebhookNotFound {
+				return
+			}
+			if err == nil {
+				more, err = d.deliverPage(hook)
+			}
+			if err != nil {
+				log.Printf("Error delivering webhook %s of %s: %s", w.id, w.db, err)
+			}
+		}
+		if more {
+			select {
+			case <-d.stopped:
+				return
+			default:
+			}
+			continue
+		}
+		select {
+		case <-w.wake:
+		case <-time.After(webhookPoll):
+		case <-d.stopped:
+			return
+		}
+	}
+}
+
+// deliverPage posts the matching changes of one page of the oplog after the
+// position of hook, saving the position as it goes, and reports whether
+// there may be more.
+func (d *WebhookDispatcher) deliverPage(hook *Webhook) (bool, error) {
+	sub, err := newChangeSubscriber(hook.Db, hook.Collection, hook.Filter)
+	if err != nil {
+		return false, err
+	}
+	start := hook.Seq
+	var changes []*Change
+	err = readDb(hook.Db, func(tx *bolt.Tx) error {
+		var err error
+		changes, err = readOplog(tx, hook.Seq, oplogPage)
+		if err != errResumeTooOld {
+			return err
+		}
+		// The changes after the position were pruned, or the database was
+		// replaced; carry on from the oldest change there is.
+		hook.LastError = err.Error()
+		from := oplogSeq(tx)
+		if oplog := tx.Bucket([]byte(oplogBucket)); oplog != nil && hook.Seq < from {
+			first, _ := oplog.Cursor().First()
+			from = binary.BigEndian.Uint64(first) - 1
+		}
+		hook.Seq = from
+		changes, err = readOplog(tx, from, oplogPage)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, change := range changes {
+		if !sub.matches(change) {
+			hook.Seq = change.Seq
+			continue
+		}
+		if !d.post(hook, change) {
+			return false, nil
+		}
+		hook.Seq = change.Seq
+		if err := saveWebhook(hook, RaftWebhookProgress); err != nil {
+			return false, err
+		}
+	}
+	if hook.Seq != start {
+		if err := saveWebhook(hook, RaftWebhookProgress); err != nil {
+			return false, err
+		}
+	}
+	return len(changes) == oplogPage, nil
+}
+
+// post sends a change to the webhook, retrying failures, and records the
+// outcome in hook. It returns false if the dispatcher stopped, the server
+// stopped taking writes or the webhook was deleted before it was done.
+func (d *WebhookDispatcher) post(hook *Webhook, change *Change) bool {
+	payload := change.entry(change.Op != ChangeDelete)
+	payload["db"] = hook.Db
+	payload["webhook"] = hook.Id
+	body, err := encodeDoc(payload)
+	if err != nil {
+		hook.LastError = err.Error()
+		hook.Failed++
+		return true
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := d.send(hook, body.Bytes())
+		if err == nil {
+			hook.Delivered++
+			hook.LastDelivery = time.Now()
+			hook.LastError = ""
+			return true
+		}
+		hook.LastError = err.Error()
+		if attempt >= hook.MaxAttempts {
+			log.Printf("Giving up on change %d for webhook %s of %s: %s", change.Seq, hook.Id, hook.Db, err)
+			hook.Failed++
+			return true
+		}
+		select {
+		case <-time.After(hook.backoff(attempt)):
+		case <-d.stopped:
+			return false
+		}
+		if !deliversWebhooks() {
+			return false
+		}
+		if _, err := loadWebhook(hook.Db, hook.Id); err == errWebhookNotFound {
+			return false
+		}
+	}
+}
+
+func (d *WebhookDispatcher) send(hook *Webhook, body []byte) error {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookHeader, hook.Id)
+	if hook.Secret != "" {
+		req.Header.Set(signatureHeader, signPayload(hook.Secret, body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", hook.URL, resp.Status)
+	}
+	return nil
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
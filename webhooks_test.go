@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hooklift/assert"
+)
+
+// webhookTarget records the posts it gets, failing the first failures of
+// them.
+func webhookTarget(t *testing.T, failures int) (*httptest.Server, chan map[interface{}]interface{}) {
+	var mutex sync.Mutex
+	posts := make(chan map[interface{}]interface{}, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Ok(t, err)
+		event, err := decodeJson(body)
+		assert.Ok(t, err)
+		assert.Equals(t, signPayload("s3cret", body), r.Header.Get(signatureHeader))
+		posts <- event
+	}))
+	return server, posts
+}
+
+// withTestWebhooks runs webhooks on a dispatcher of their own, which is
+// stopped before the test's databases are closed.
+func withTestWebhooks() func() {
+	d, poll := webhooks, webhookPoll
+	webhooks, webhookPoll = NewWebhookDispatcher(), 10*time.Millisecond
+	return func() {
+		webhooks.stop()
+		webhooks, webhookPoll = d, poll
+	}
+}
+
+func nextPost(t *testing.T, posts chan map[interface{}]interface{}) map[interface{}]interface{} {
+	select {
+	case event := <-posts:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no webhook posted")
+	}
+	return nil
+}
+
+func TestWebhooks(t *testing.T) {
+	defer withTestDir(t)()
+	defer withTestWebhooks()()
+
+	server, posts := webhookTarget(t, 2)
+	defer server.Close()
+
+	insertTestDocs(t, "hooks", "users", `{"name": "old", "admin": true}`)
+	encHook, err := createWebhook("hooks", "users", strings.NewReader(`{
+		"url": "`+server.URL+`", "secret": "s3cret", "filter": {"admin": true},
+		"retry": {"maxAttempts": 5, "backoff": 0.01}
+	}`))
+	assert.Ok(t, err)
+	hook, err := decodeJson(encHook)
+	assert.Ok(t, err)
+	assert.Equals(t, true, hook["signed"])
+	assert.Equals(t, nil, hook["secret"])
+	id := hook["_id"].(string)
+
+	insertTestDocs(t, "hooks", "users", `{"name": "bob"}`, `{"name": "ada", "admin": true}`)
+	insertTestDocs(t, "hooks", "others", `{"name": "cy", "admin": true}`)
+	_, err = updateQuery("hooks", "users", strings.NewReader(`{"query": {"name": "bob"}, "update": {"admin": true}}`))
+	assert.Ok(t, err)
+
+	// Changes before the webhook, of other collections or not matching its
+	// filter are not posted; the rest are, in order, after the failures.
+	insert := nextPost(t, posts)
+	assert.Equals(t, ChangeInsert, insert["op"])
+	assert.Equals(t, "ada", insert["doc"].(map[interface{}]interface{})["name"])
+	assert.Equals(t, "hooks", insert["db"])
+	assert.Equals(t, id, insert["webhook"])
+	update := nextPost(t, posts)
+	assert.Equals(t, ChangeUpdate, update["op"])
+	assert.Equals(t, insert["seq"].(uint64)+2, update["seq"])
+
+	// The position survives a restart, so nothing is posted twice.
+	webhooks.stop()
+	insertTestDocs(t, "hooks", "users", `{"name": "dee", "admin": true}`)
+	webhooks = NewWebhookDispatcher()
+	assert.Ok(t, webhooks.scan())
+	assert.Equals(t, "dee", nextPost(t, posts)["doc"].(map[interface{}]interface{})["name"])
+	select {
+	case event := <-posts:
+		t.Fatalf("unexpected post %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	encHooks, err := listWebhooks("hooks", "users")
+	assert.Ok(t, err)
+	hook, err = decodeJson(encHooks)
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(3), hook["delivered"])
+	assert.Equals(t, dbSeq(t, "hooks"), hook["seq"])
+
+	assert.Equals(t, errWebhookNotFound, deleteWebhook("hooks", "others", id))
+	assert.Ok(t, deleteWebhook("hooks", "users", id))
+	insertTestDocs(t, "hooks", "users", `{"name": "eve", "admin": true}`)
+	select {
+	case event := <-posts:
+		t.Fatalf("unexpected post %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = createWebhook("hooks", "users", strings.NewReader(`{"url": "ftp://example.com"}`))
+	assert.Cond(t, err != nil, "a webhook needs an http url")
+	_, err = createWebhook("hooks", "users", strings.NewReader(`{"url": "http://example.com", "retry": {"maxAttempts": 0}}`))
+	assert.Cond(t, err != nil, "a webhook needs at least one attempt")
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	defer withTestDir(t)()
+	defer withTestWebhooks()()
+
+	server, posts := webhookTarget(t, 2)
+	defer server.Close()
+	_, err := createWebhook("hooks", "users", strings.NewReader(`{
+		"url": "`+server.URL+`", "secret": "s3cret", "retry": {"maxAttempts": 2, "backoff": 0.01}
+	}`))
+	assert.Ok(t, err)
+	insertTestDocs(t, "hooks", "users", `{"name": "ada"}`, `{"name": "bob"}`)
+
+	// The first change fails twice and is skipped.
+	assert.Equals(t, "bob", nextPost(t, posts)["doc"].(map[interface{}]interface{})["name"])
+	webhooks.stop()
+	webhooks = NewWebhookDispatcher()
+	encHooks, err := listWebhooks("hooks", "users")
+	assert.Ok(t, err)
+	hook, err := decodeJson(encHooks)
+	assert.Ok(t, err)
+	assert.Equals(t, uint64(1), hook["failed"])
+	assert.Equals(t, uint64(1), hook["delivered"])
+}